@@ -0,0 +1,196 @@
+package core_refactor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IPACL 是按客户端 IP 的访问控制列表，条目为 CIDR 或单个 IP。
+// 命中 Deny 的地址总是拒绝；Allow 非空时只放行命中 Allow 的地址；两者皆空时全部放行。
+type IPACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// ACLConfig 同时描述监听器与拦截两级访问控制。
+type ACLConfig struct {
+	// Listener 在 Accept 时检查，不允许的连接被立即关闭。
+	Listener IPACL `json:"listener"`
+	// Intercept 决定是否对客户端解密与执行钩子；不允许的客户端 CONNECT 按原样建立盲隧道，
+	// 明文请求不经规则、钩子与抓包直接转发。
+	Intercept IPACL `json:"intercept"`
+}
+
+// compiledACL 是解析后的 ACLConfig。
+type compiledACL struct {
+	config                        ACLConfig
+	listenAllow, listenDeny       []*net.IPNet
+	interceptAllow, interceptDeny []*net.IPNet
+}
+
+func compileACL(c ACLConfig) (*compiledACL, error) {
+	a := &compiledACL{config: c}
+	for _, p := range []struct {
+		dst  *[]*net.IPNet
+		src  []string
+		name string
+	}{
+		{&a.listenAllow, c.Listener.Allow, "listener allow"},
+		{&a.listenDeny, c.Listener.Deny, "listener deny"},
+		{&a.interceptAllow, c.Intercept.Allow, "intercept allow"},
+		{&a.interceptDeny, c.Intercept.Deny, "intercept deny"},
+	} {
+		nets, err := parseCIDRs(p.src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.name, err)
+		}
+		*p.dst = nets
+	}
+	return a, nil
+}
+
+// parseCIDRs 逐项用 parseCIDROrIP 解析 CIDR 或单个 IP（视为 /32 或 /128）。
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		n, err := parseCIDROrIP(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func aclAllows(ip net.IP, allow, deny []*net.IPNet) bool {
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, n := range allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *compiledACL) allowListener(ip net.IP) bool {
+	return a == nil || aclAllows(ip, a.listenAllow, a.listenDeny)
+}
+
+func (a *compiledACL) allowIntercept(ip net.IP) bool {
+	return a == nil || aclAllows(ip, a.interceptAllow, a.interceptDeny)
+}
+
+// addrIP 返回连接地址中的 IP；非 IP 地址（如 Unix socket）返回 nil。
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// SetACL 在运行时替换访问控制列表；已建立的连接不受影响。
+func (m *MITM) SetACL(c ACLConfig) error {
+	a, err := compileACL(c)
+	if err != nil {
+		return err
+	}
+	m.acl.Store(a)
+	return nil
+}
+
+// ACL 返回当前访问控制列表。
+func (m *MITM) ACL() ACLConfig {
+	if a := m.acl.Load(); a != nil {
+		return a.config
+	}
+	return ACLConfig{}
+}
+
+// blindTunnel 为不允许拦截的客户端建立 CONNECT 盲隧道：不签发证书、不解密，原样转发字节。
+func (m *MITM) blindTunnel(ctx context.Context, client *clientConn, req *http.Request) {
+	srv, err := dialServer(ctx, m.dial, withPort(req.Host, "443"), m.proxyFunc(req), m.dialTimeout)
+	if err != nil {
+		m.logger.Warn("blind tunnel dial failed", "client", req.RemoteAddr, "host", req.Host, "error", err)
+		io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	defer srv.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	_ = client.SetDeadline(time.Time{})
+	m.logger.Info("blind tunnel opened", "client", req.RemoteAddr, "host", req.Host)
+	closeBoth := func() {
+		client.Close()
+		srv.Close()
+	}
+	m.tunnel(struct {
+		io.Reader
+		io.Writer
+	}{client.reader, client}, struct {
+		io.Reader
+		io.Writer
+	}{srv.reader, srv}, closeBoth)
+}
+
+// passthrough 为不允许拦截的客户端直接转发明文请求，不执行规则、钩子与抓包。
+func (s *session) passthrough(req *http.Request, isWS bool) {
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+	resp, srv, err := s.mitm.roundTrip(s.ctx, req)
+	if err != nil {
+		s.mitm.flowLog(req).Error("forward request failed", "url", req.URL.String(), "error", err)
+		s.writeError(req, http.StatusBadGateway, err, nil)
+		return
+	}
+	if isWS {
+		s.handleWebSocket(req, resp, srv)
+		return
+	}
+	s.submit(func() error { return s.writeResponse(req, resp) })
+}
+
+// handleACL 查询（GET）或替换（PUT/POST）访问控制列表。
+func (m *MITM) handleACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, m.ACL())
+	case http.MethodPut, http.MethodPost:
+		var c ACLConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "decode acl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.SetACL(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.ACL())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,102 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestACLMatching(t *testing.T) {
+	a, err := compileACL(ACLConfig{Listener: IPACL{Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.1.2.3"}}})
+	if err != nil {
+		t.Fatalf("compileACL: %v", err)
+	}
+	for ip, want := range map[string]bool{"10.9.9.9": true, "10.1.2.3": false, "192.168.1.1": false, "::1": true} {
+		if got := a.allowListener(net.ParseIP(ip)); got != want {
+			t.Errorf("allowListener(%s) = %v", ip, got)
+		}
+	}
+	if !a.allowIntercept(net.ParseIP("192.168.1.1")) {
+		t.Error("empty intercept list must allow everyone")
+	}
+	if _, err := compileACL(ACLConfig{Intercept: IPACL{Deny: []string{"10.0.0.0/33"}}}); err == nil {
+		t.Error("expected invalid CIDR error")
+	}
+}
+
+func TestListenerACLRejects(t *testing.T) {
+	addr := startTestMITM(t, nil, WithACL(ACLConfig{Listener: IPACL{Deny: []string{"127.0.0.0/8"}}}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("expected connection to be closed, got n=%d err=%v", n, err)
+	}
+}
+
+func TestInterceptACLBlindTunnel(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "real")
+	}))
+	t.Cleanup(upstream.Close)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "real")
+	}))
+	t.Cleanup(plain.Close)
+
+	mock := func(req *http.Request) *http.Response {
+		return textResponse(req, http.StatusOK, "mocked")
+	}
+	addr := startTestMITM(t, nil, WithRequestHandler(mock), WithACL(ACLConfig{Intercept: IPACL{Deny: []string{"127.0.0.1"}}}))
+
+	// 明文请求不经钩子直接转发。
+	target := plain.Listener.Addr().String()
+	if _, body := doProxyRequest(t, addr, fmt.Sprintf("GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)); body != "real" {
+		t.Fatalf("plain body = %q", body)
+	}
+
+	// CONNECT 建立盲隧道：客户端看到的是上游自己的证书。
+	connectCert := func() []byte {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		target := upstream.Listener.Addr().String()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		br := bufio.NewReader(conn)
+		if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %v %v", resp, err)
+		}
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		return tc.ConnectionState().PeerCertificates[0].Raw
+	}
+	if !bytes.Equal(connectCert(), upstream.Certificate().Raw) {
+		t.Fatal("expected upstream certificate through blind tunnel")
+	}
+
+	// 通过管理接口放开拦截后改为签发代理证书。
+	body := `{"intercept":{}}`
+	resp, _ := doProxyRequest(t, addr, fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n\r\n%s",
+		RouteACL, managePort(addr), len(body), body))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT acl status = %d", resp.StatusCode)
+	}
+	if bytes.Equal(connectCert(), upstream.Certificate().Raw) {
+		t.Fatal("expected intercepted connection after ACL update")
+	}
+}
@@ -0,0 +1,157 @@
+package core_refactor
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AdminConfig 描述独立的管理监听器。
+type AdminConfig struct {
+	// Network 为 "tcp"（默认）或 "unix"。
+	Network string
+	// Addr 为 TCP 地址（如 127.0.0.1:9091）或 Unix socket 路径。
+	Addr string
+	// Token 非空时要求 Authorization: Bearer <Token>；为空时 TCP 监听器只接受回环客户端，
+	// Unix socket 依赖文件权限。
+	Token string
+	// InBand 为 true 时同时保留代理端口上的带内管理接口（供浏览器扩展等使用）；
+	// 否则发往代理自身的请求一律返回 404。
+	InBand bool
+}
+
+type adminRoute struct {
+	pattern string
+	handler http.Handler
+}
+
+// HandleAdmin 在独立管理监听器上注册处理函数，pattern 使用 http.ServeMux 语法，
+// 可带方法与通配段（如 "GET /mitm/items/{id}"）；非法或冲突的 pattern 会 panic。
+// 通过 HandleFunc 注册的路由在管理监听器上同样可用。
+func (m *MITM) HandleAdmin(pattern string, h http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	routes := append(append([]adminRoute(nil), m.adminRoutes...), adminRoute{pattern, h})
+	m.adminMux.Store(m.buildAdminMux(routes))
+	m.adminRoutes = routes
+}
+
+// buildAdminMux 用 HandleAdmin 的路由与 manageRouter 中的路径构造路由表，调用方需持有 m.mu。
+// manageRouter 的处理函数在请求时查找，HandleFunc 覆盖同名路径后立即生效。
+func (m *MITM) buildAdminMux(routes []adminRoute) *http.ServeMux {
+	mux := http.NewServeMux()
+	patterns := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		mux.Handle(r.pattern, r.handler)
+		patterns[r.pattern] = true
+	}
+	for path := range m.manageRouter {
+		if patterns[path] {
+			continue
+		}
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			m.mu.Lock()
+			h := m.manageRouter[path]
+			m.mu.Unlock()
+			h(w, r)
+		})
+	}
+	return mux
+}
+
+// AdminHandler 返回管理监听器使用的 http.Handler（含 token 校验），可挂载到自有的 http.Server 上。
+func (m *MITM) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.adminAuthorized(r) {
+			if m.admin != nil && m.admin.Token != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mitm-admin"`)
+				http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		m.adminMux.Load().ServeHTTP(w, r)
+	})
+}
+
+func (m *MITM) adminAuthorized(r *http.Request) bool {
+	if m.admin != nil && m.admin.Token != "" {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		return strings.EqualFold(scheme, "Bearer") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(m.admin.Token)) == 1
+	}
+	if m.admin != nil && m.admin.Network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startAdmin 启动独立管理监听器（若已配置）。
+func (m *MITM) startAdmin() error {
+	if m.admin == nil {
+		return nil
+	}
+	network := m.admin.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		// 清理上次异常退出遗留的 socket 文件。
+		if fi, err := os.Lstat(m.admin.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(m.admin.Addr)
+		}
+	}
+	ln, err := net.Listen(network, m.admin.Addr)
+	if err != nil {
+		return fmt.Errorf("admin listen %s %s: %w", network, m.admin.Addr, err)
+	}
+	srv := &http.Server{
+		Handler:           m.AdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(m.logger.Handler(), slog.LevelDebug),
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		ln.Close()
+		return errors.New("mitm already stopped")
+	}
+	m.adminServer = srv
+	m.adminListener = ln
+	m.mu.Unlock()
+
+	m.logger.Info("admin listening", "network", network, "addr", ln.Addr().String())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.logger.Error("admin server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// AdminAddr 返回管理监听地址；未配置或未启动时返回 nil。
+func (m *MITM) AdminAddr() net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.adminListener == nil {
+		return nil
+	}
+	return m.adminListener.Addr()
+}
+
+// inBandManage 报告代理端口上的带内管理接口是否可用。
+func (m *MITM) inBandManage() bool {
+	return m.admin == nil || m.admin.InBand
+}
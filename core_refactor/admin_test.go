@@ -0,0 +1,90 @@
+package core_refactor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminListenerToken(t *testing.T) {
+	var m *MITM
+	addr := startTestMITM(t, func(mm *MITM) {
+		m = mm
+		m.HandleAdmin("GET /mitm/items/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "item "+r.PathValue("id"))
+		}))
+	}, WithAdmin(AdminConfig{Addr: "127.0.0.1:0", Token: "s3cret"}))
+	base := "http://" + m.AdminAddr().String()
+
+	do := func(method, path, token string) (int, string) {
+		req, _ := http.NewRequest(method, base+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := do("GET", RouteACL, ""); status != http.StatusUnauthorized {
+		t.Fatalf("no token status = %d", status)
+	}
+	if status, _ := do("GET", RouteACL, "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("wrong token status = %d", status)
+	}
+	if status, body := do("GET", RouteACL, "s3cret"); status != http.StatusOK || !strings.Contains(body, `"listener"`) {
+		t.Fatalf("GET acl = %d %s", status, body)
+	}
+	if status, body := do("GET", "/mitm/items/42", "s3cret"); status != http.StatusOK || body != "item 42" {
+		t.Fatalf("GET item = %d %q", status, body)
+	}
+	if status, _ := do("DELETE", "/mitm/items/42", "s3cret"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE item status = %d", status)
+	}
+	if status, _ := do("GET", "/mitm/missing", "s3cret"); status != http.StatusNotFound {
+		t.Fatalf("missing route status = %d", status)
+	}
+
+	// 启用独立管理监听器后代理端口上的带内管理接口默认关闭。
+	resp, _ := doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", RouteACL, managePort(addr)))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("in-band status = %d", resp.StatusCode)
+	}
+}
+
+func TestAdminUnixSocketInBand(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	var m *MITM
+	addr := startTestMITM(t, func(mm *MITM) { m = mm }, WithAdmin(AdminConfig{Network: "unix", Addr: sock, InBand: true}))
+	if m.AdminAddr() == nil {
+		t.Fatal("admin listener not started")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://admin" + RouteProfiles)
+	if err != nil {
+		t.Fatalf("GET over unix socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unix status = %d", resp.StatusCode)
+	}
+
+	resp, _ = doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", RouteProfiles, managePort(addr)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("in-band status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,416 @@
+package core_refactor
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthRealm = "mitm-proxy"
+	// digestNonceTTL 是 Digest nonce 的有效期，过期后以 stale=true 重新质询。
+	digestNonceTTL = 5 * time.Minute
+)
+
+// CredentialStore 校验代理客户端的用户名与密码。
+type CredentialStore interface {
+	Verify(user, password string) bool
+}
+
+// DigestCredentialStore 是支持 Digest 认证的凭据存储：返回 MD5(user:realm:password)（十六进制）。
+type DigestCredentialStore interface {
+	CredentialStore
+	DigestHA1(user, realm string) (string, bool)
+}
+
+// StaticCredentials 是用户名到明文密码的静态凭据表，同时支持 Basic 与 Digest。
+type StaticCredentials map[string]string
+
+// Verify 实现 CredentialStore。
+func (c StaticCredentials) Verify(user, password string) bool {
+	want, ok := c[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// DigestHA1 实现 DigestCredentialStore。
+func (c StaticCredentials) DigestHA1(user, realm string) (string, bool) {
+	pw, ok := c[user]
+	if !ok {
+		return "", false
+	}
+	return md5Hex(user + ":" + realm + ":" + pw), true
+}
+
+// CredentialFunc 以回调校验凭据，例如对接外部账号系统。
+type CredentialFunc func(user, password string) bool
+
+// Verify 实现 CredentialStore。
+func (f CredentialFunc) Verify(user, password string) bool {
+	return f(user, password)
+}
+
+// Htpasswd 是从 htpasswd 文件加载的凭据，支持 {SHA}（htpasswd -s）、$apr1$（htpasswd -m）
+// 与显式标记为 {PLAIN} 的明文条目；
+// 文件修改后在下次校验时自动重新加载。仅支持 Basic 认证。
+type Htpasswd struct {
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	entries map[string]string
+}
+
+// LoadHtpasswd 加载 htpasswd 文件。bcrypt、crypt(3)（DES、$5$/$6$ 等）与其他无法识别的条目会返回错误，
+// 以免被误当作明文比较。
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload 重新读取文件。
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("open htpasswd: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat htpasswd: %w", err)
+	}
+	entries, err := parseHtpasswd(f)
+	if err != nil {
+		return fmt.Errorf("parse htpasswd %s: %w", h.path, err)
+	}
+	h.mu.Lock()
+	h.entries, h.modTime = entries, info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing ':'", n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{PLAIN}"):
+		case strings.HasPrefix(hash, "$2"):
+			return nil, fmt.Errorf("line %d: bcrypt hashes are not supported, use htpasswd -m or -s", n)
+		default:
+			return nil, fmt.Errorf("line %d: unsupported hash format (crypt or unknown), use htpasswd -m or -s, or prefix plaintext with {PLAIN}", n)
+		}
+		entries[user] = hash
+	}
+	return entries, sc.Err()
+}
+
+// Verify 实现 CredentialStore。
+func (h *Htpasswd) Verify(user, password string) bool {
+	if info, err := os.Stat(h.path); err == nil {
+		h.mu.RLock()
+		changed := !info.ModTime().Equal(h.modTime)
+		h.mu.RUnlock()
+		if changed {
+			h.Reload()
+		}
+	}
+	h.mu.RLock()
+	hash, ok := h.entries[user]
+	h.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	var got string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		got = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		got = apr1Crypt(password, salt)
+	case strings.HasPrefix(hash, "{PLAIN}"):
+		got = "{PLAIN}" + password
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1
+}
+
+// apr1Crypt 实现 Apache 的 MD5-crypt 变体（$apr1$）。
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// ProxyAuth 配置代理客户端认证。
+type ProxyAuth struct {
+	// Realm 是质询中的 realm，默认 "mitm-proxy"。
+	Realm string
+	// Store 校验凭据，必填。
+	Store CredentialStore
+	// Digest 为 true 且 Store 实现 DigestCredentialStore 时同时提供 Digest（MD5、qop=auth）质询。
+	// 响应中的 uri 须与请求目标一致；nonce 无状态且不跟踪 nc，同一请求目标的 Authorization 头
+	// 在 nonce 有效期（5 分钟）内可被重放，Digest 不提供重放保护。
+	Digest bool
+}
+
+// proxyAuthenticator 校验请求的 Proxy-Authorization 头。
+type proxyAuthenticator struct {
+	realm  string
+	store  CredentialStore
+	digest DigestCredentialStore
+	secret [32]byte
+}
+
+func newProxyAuthenticator(a ProxyAuth) *proxyAuthenticator {
+	p := &proxyAuthenticator{realm: a.Realm, store: a.Store}
+	if p.realm == "" {
+		p.realm = defaultAuthRealm
+	}
+	if ds, ok := a.Store.(DigestCredentialStore); ok && a.Digest {
+		p.digest = ds
+	}
+	rand.Read(p.secret[:])
+	return p
+}
+
+// authenticate 返回认证通过的用户名；stale 表示 Digest nonce 已过期但凭据正确。
+func (p *proxyAuthenticator) authenticate(req *http.Request) (user string, ok, stale bool) {
+	scheme, cred, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+		if err != nil {
+			return "", false, false
+		}
+		user, pass, found := strings.Cut(string(raw), ":")
+		if !found || !p.store.Verify(user, pass) {
+			return "", false, false
+		}
+		return user, true, false
+	case strings.EqualFold(scheme, "Digest") && p.digest != nil:
+		return p.verifyDigest(req, parseAuthParams(cred))
+	}
+	return "", false, false
+}
+
+// verifyDigest 按 RFC 7616（MD5）校验 Digest 响应；nonce 为带时间戳的 HMAC，不做 nc 重放跟踪。
+// uri 必须与请求目标（CONNECT 时为 authority）一致（RFC 7616 §3.4.6），防止凭据被挪用到其他目标。
+func (p *proxyAuthenticator) verifyDigest(req *http.Request, params map[string]string) (string, bool, bool) {
+	user, nonce := params["username"], params["nonce"]
+	if params["realm"] != p.realm || user == "" || params["uri"] != req.RequestURI {
+		return "", false, false
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return "", false, false
+	}
+	issued, valid := p.checkNonce(nonce)
+	if !valid {
+		return "", false, false
+	}
+	ha1, ok := p.digest.DigestHA1(user, p.realm)
+	if !ok {
+		return "", false, false
+	}
+	ha2 := md5Hex(req.Method + ":" + params["uri"])
+	var want string
+	switch params["qop"] {
+	case "auth":
+		want = md5Hex(strings.Join([]string{ha1, nonce, params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	case "":
+		want = md5Hex(ha1 + ":" + nonce + ":" + ha2)
+	default:
+		return "", false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(params["response"])) != 1 {
+		return "", false, false
+	}
+	if time.Since(issued) > digestNonceTTL {
+		return "", false, true
+	}
+	return user, true, false
+}
+
+// newNonce 生成 "时间戳.HMAC" 形式的无状态 nonce。
+func (p *proxyAuthenticator) newNonce() string {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, p.secret[:])
+	mac.Write(ts[:])
+	return hex.EncodeToString(ts[:]) + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (p *proxyAuthenticator) checkNonce(nonce string) (time.Time, bool) {
+	tsHex, sig, ok := strings.Cut(nonce, ".")
+	ts, err := hex.DecodeString(tsHex)
+	if !ok || err != nil || len(ts) != 8 {
+		return time.Time{}, false
+	}
+	mac := hmac.New(sha256.New, p.secret[:])
+	mac.Write(ts)
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil)[:16])), []byte(sig)) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(ts)), 0), true
+}
+
+// challenge 构造 407 响应，携带 Basic（及可选 Digest）质询。
+func (p *proxyAuthenticator) challenge(req *http.Request, stale bool) *http.Response {
+	const msg = "407 proxy authentication required"
+	h := http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}
+	if p.digest != nil {
+		d := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q`, p.realm, p.newNonce())
+		if stale {
+			d += ", stale=true"
+		}
+		h.Add("Proxy-Authenticate", d)
+	}
+	h.Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, p.realm))
+	return &http.Response{
+		StatusCode:    http.StatusProxyAuthRequired,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+	}
+}
+
+// parseAuthParams 解析 key=value / key="value" 形式的认证参数列表。
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			val, rest = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+		params[key] = strings.TrimSpace(val)
+		_, rest, _ = strings.Cut(rest, ",")
+		s = strings.TrimSpace(rest)
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorize 校验代理认证并把用户名记到会话上；未通过时写回 407 并返回 false。
+// 管理接口请求与 TLS 隧道内的请求（已在 CONNECT 时认证）不再校验。
+func (s *session) authorize(req *http.Request) bool {
+	auth := s.mitm.auth
+	if auth == nil || s.client.isTLS || s.mitm.mustManageRequest(req) {
+		return true
+	}
+	user, ok, stale := auth.authenticate(req)
+	req.Header.Del("Proxy-Authorization")
+	if ok {
+		s.user = user
+		return true
+	}
+	s.mitm.logger.Warn("proxy authentication failed", "client", s.client.RemoteAddr().String(), "host", req.Host, "stale", stale)
+	// 丢弃请求体以便客户端在同一连接上携带凭据重试。
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	flow := newFlow(s.client.RemoteAddr().String())
+	req = req.WithContext(contextWithFlow(s.ctx, flow))
+	s.respond(req, auth.challenge(req, stale))
+	return false
+}
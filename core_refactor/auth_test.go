@@ -0,0 +1,183 @@
+package core_refactor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestProxyAuthBasic(t *testing.T) {
+	leaked := make(chan string, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked <- r.Header.Get("Proxy-Authorization")
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	users := make(chan string, 4)
+	handler := func(req *http.Request) *http.Response {
+		users <- FlowFromRequest(req).User
+		return nil
+	}
+	addr := startTestMITM(t, nil, WithRequestHandler(handler),
+		WithProxyAuth(ProxyAuth{Store: StaticCredentials{"alice": "secret"}}))
+	target := upstream.Listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	send := func(auth string) *http.Response {
+		t.Helper()
+		raw := fmt.Sprintf("POST http://%s/ HTTP/1.1\r\nHost: %s\r\nContent-Length: 3\r\n", target, target)
+		if auth != "" {
+			raw += "Proxy-Authorization: " + auth + "\r\n"
+		}
+		io.WriteString(conn, raw+"\r\nabc")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, auth := range []string{"", basicAuth("alice", "wrong"), "Bearer x"} {
+		resp := send(auth)
+		if resp.StatusCode != http.StatusProxyAuthRequired || !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), `Basic realm="mitm-proxy"`) {
+			t.Fatalf("auth %q: status %d, challenge %q", auth, resp.StatusCode, resp.Header.Values("Proxy-Authenticate"))
+		}
+	}
+	// 质询后可在同一连接上带凭据重试。
+	if resp := send(basicAuth("alice", "secret")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated status = %d", resp.StatusCode)
+	}
+	if u := <-users; u != "alice" {
+		t.Fatalf("flow user = %q", u)
+	}
+	if h := <-leaked; h != "" {
+		t.Fatalf("Proxy-Authorization forwarded upstream: %q", h)
+	}
+}
+
+func TestProxyAuthConnectDigest(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	t.Cleanup(upstream.Close)
+
+	users := make(chan string, 1)
+	addr := startTestMITM(t, nil, WithRequestHandler(func(req *http.Request) *http.Response {
+		users <- FlowFromRequest(req).User
+		return nil
+	}), WithProxyAuth(ProxyAuth{Realm: "dev", Store: StaticCredentials{"bob": "pw"}, Digest: true}))
+	target := upstream.Listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("CONNECT without auth: %v %v", resp, err)
+	}
+	io.ReadAll(resp.Body)
+	var nonce string
+	for _, c := range resp.Header.Values("Proxy-Authenticate") {
+		if scheme, params, _ := strings.Cut(c, " "); scheme == "Digest" {
+			nonce = parseAuthParams(params)["nonce"]
+		}
+	}
+	if nonce == "" {
+		t.Fatalf("no digest challenge in %q", resp.Header.Values("Proxy-Authenticate"))
+	}
+
+	connect := func(uri string) *http.Response {
+		t.Helper()
+		ha1 := md5Hex("bob:dev:pw")
+		ha2 := md5Hex("CONNECT:" + uri)
+		response := md5Hex(strings.Join([]string{ha1, nonce, "00000001", "abc", "auth", ha2}, ":"))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Digest username=\"bob\", realm=\"dev\", "+
+			"nonce=\"%s\", uri=\"%s\", qop=auth, nc=00000001, cnonce=\"abc\", response=\"%s\"\r\n\r\n", target, target, nonce, uri, response)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read CONNECT response: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			io.ReadAll(resp.Body)
+		}
+		return resp
+	}
+	// 为其他目标计算的 Digest 响应不能用于本次请求。
+	if resp := connect("other.example:443"); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("CONNECT with mismatched uri: status %d", resp.StatusCode)
+	}
+	if resp := connect(target); resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT with digest: status %d", resp.StatusCode)
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	resp, err = http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("tunnelled request: %v %v", resp, err)
+	}
+	if u := <-users; u != "bob" {
+		t.Fatalf("flow user = %q", u)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"md5:$apr1$r31abcde$kl9eNjSys8oZ/nHjspdaj0\n" +
+		"plain:{PLAIN}hunter2\n"
+	os.WriteFile(path, []byte(content), 0o600)
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("LoadHtpasswd: %v", err)
+	}
+	for _, c := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"sha", "secret", true}, {"sha", "nope", false},
+		{"md5", "myPassword", true}, {"md5", "mypassword", false},
+		{"plain", "hunter2", true}, {"nobody", "hunter2", false},
+	} {
+		if got := h.Verify(c.user, c.pass); got != c.want {
+			t.Errorf("Verify(%s, %s) = %v", c.user, c.pass, got)
+		}
+	}
+
+	for _, line := range []string{
+		"x:$2y$05$abcdefghijklmnopqrstuv", // bcrypt
+		"x:rqXexS6ZhobKA",                 // crypt(3) DES（htpasswd -d）
+		"x:$6$salt$abcdefghijklmnop",      // SHA-crypt
+		"x:hunter2",                       // 未标记的明文
+	} {
+		os.WriteFile(path, []byte(line+"\n"), 0o600)
+		if _, err := LoadHtpasswd(path); err == nil {
+			t.Fatalf("expected %q to be rejected", line)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package core_refactor
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 表示目标上游的熔断器处于打开状态，请求被快速拒绝。
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// circuitOpenError 携带被熔断的主机与建议的重试等待时间。
+type circuitOpenError struct {
+	host       string
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%v: %s (%s)", ErrCircuitOpen, e.host, e.reason)
+}
+
+func (e *circuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+
+// CircuitState 是单个上游的熔断状态。
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig 描述每个上游主机的熔断策略。零值字段使用默认值。
+type BreakerConfig struct {
+	// FailureThreshold 连续失败多少次后打开熔断器。
+	FailureThreshold int
+	// OpenTimeout 熔断器打开后多久进入半开状态尝试探测。
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests 半开状态下允许同时进行的探测请求数。
+	HalfOpenMaxRequests int
+}
+
+const (
+	defaultBreakerThreshold   = 5
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// UpstreamHealth 是单个上游主机的健康状况快照。
+type UpstreamHealth struct {
+	Host                string    `json:"host"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Requests            int64     `json:"requests"`
+	Failures            int64     `json:"failures"`
+	Rejected            int64     `json:"rejected"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastFailure         time.Time `json:"lastFailure,omitempty"`
+	LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+	OpenedAt            time.Time `json:"openedAt,omitempty"`
+}
+
+type hostHealth struct {
+	state       CircuitState
+	consecutive int
+	requests    int64
+	failures    int64
+	rejected    int64
+	probes      int
+	lastError   string
+	lastFailure time.Time
+	lastSuccess time.Time
+	openedAt    time.Time
+}
+
+// healthTracker 按上游 host:port 统计请求结果；启用熔断时据此快速拒绝请求。
+type healthTracker struct {
+	cfg     BreakerConfig
+	enabled bool
+
+	mu    sync.Mutex
+	hosts map[string]*hostHealth
+	now   func() time.Time
+}
+
+func newHealthTracker(cfg *BreakerConfig) *healthTracker {
+	t := &healthTracker{hosts: make(map[string]*hostHealth), now: time.Now}
+	if cfg != nil {
+		t.enabled = true
+		t.cfg = *cfg
+	}
+	if t.cfg.FailureThreshold <= 0 {
+		t.cfg.FailureThreshold = defaultBreakerThreshold
+	}
+	if t.cfg.OpenTimeout <= 0 {
+		t.cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if t.cfg.HalfOpenMaxRequests <= 0 {
+		t.cfg.HalfOpenMaxRequests = 1
+	}
+	return t
+}
+
+func (t *healthTracker) get(host string) *hostHealth {
+	h := t.hosts[host]
+	if h == nil {
+		h = &hostHealth{}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// allow 判断是否允许向 host 发起请求；熔断打开时返回 ErrCircuitOpen。
+func (t *healthTracker) allow(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	h.requests++
+	if !t.enabled {
+		return nil
+	}
+
+	switch h.state {
+	case CircuitOpen:
+		if elapsed := t.now().Sub(h.openedAt); elapsed < t.cfg.OpenTimeout {
+			h.rejected++
+			return &circuitOpenError{host: host, reason: h.lastError, retryAfter: t.cfg.OpenTimeout - elapsed}
+		}
+		h.state = CircuitHalfOpen
+		h.probes = 0
+		fallthrough
+	case CircuitHalfOpen:
+		if h.probes >= t.cfg.HalfOpenMaxRequests {
+			h.rejected++
+			return &circuitOpenError{host: host, reason: "probing", retryAfter: time.Second}
+		}
+		h.probes++
+	}
+	return nil
+}
+
+// record 记录一次请求结果，并推动熔断状态迁移。
+func (t *healthTracker) record(host string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(host)
+	now := t.now()
+
+	if err == nil {
+		h.consecutive = 0
+		h.lastSuccess = now
+		h.state = CircuitClosed
+		h.probes = 0
+		return
+	}
+
+	h.consecutive++
+	h.failures++
+	h.lastError = err.Error()
+	h.lastFailure = now
+	if !t.enabled {
+		return
+	}
+	if h.state == CircuitHalfOpen || h.consecutive >= t.cfg.FailureThreshold {
+		h.state = CircuitOpen
+		h.openedAt = now
+		h.probes = 0
+	}
+}
+
+// release 归还 allow 占用的半开探测名额而不记录结果，用于请求因上下文取消而没有结论的情况。
+func (t *healthTracker) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h := t.hosts[host]; h != nil && h.state == CircuitHalfOpen && h.probes > 0 {
+		h.probes--
+	}
+}
+
+func (t *healthTracker) snapshot() []UpstreamHealth {
+	t.mu.Lock()
+	out := make([]UpstreamHealth, 0, len(t.hosts))
+	for host, h := range t.hosts {
+		out = append(out, UpstreamHealth{
+			Host:                host,
+			State:               h.state.String(),
+			ConsecutiveFailures: h.consecutive,
+			Requests:            h.requests,
+			Failures:            h.failures,
+			Rejected:            h.rejected,
+			LastError:           h.lastError,
+			LastFailure:         h.lastFailure,
+			LastSuccess:         h.lastSuccess,
+			OpenedAt:            h.openedAt,
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// UpstreamHealth 返回所有访问过的上游主机的健康状况。
+func (m *MITM) UpstreamHealth() []UpstreamHealth {
+	return m.health.snapshot()
+}
@@ -0,0 +1,129 @@
+package core_refactor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerStateTransitions(t *testing.T) {
+	now := time.Now()
+	tr := newHealthTracker(&BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+	tr.now = func() time.Time { return now }
+	host := "example.com:443"
+	fail := errors.New("dial refused")
+
+	for i := 0; i < 2; i++ {
+		if err := tr.allow(host); err != nil {
+			t.Fatalf("allow #%d: %v", i, err)
+		}
+		tr.record(host, fail)
+	}
+	if err := tr.allow(host); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow while open = %v, want ErrCircuitOpen", err)
+	}
+
+	// 超过 OpenTimeout 后进入半开状态，只放行一个探测请求。
+	now = now.Add(2 * time.Minute)
+	if err := tr.allow(host); err != nil {
+		t.Fatalf("half-open probe rejected: %v", err)
+	}
+	if err := tr.allow(host); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second half-open request = %v, want ErrCircuitOpen", err)
+	}
+	tr.record(host, nil)
+
+	if err := tr.allow(host); err != nil {
+		t.Fatalf("allow after recovery: %v", err)
+	}
+	snap := tr.snapshot()
+	if len(snap) != 1 || snap[0].State != "closed" || snap[0].Failures != 2 || snap[0].Rejected != 2 {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+}
+
+func TestCircuitBreakerFastFail(t *testing.T) {
+	// 取得一个无人监听的端口作为宕机的上游。
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	addr := startTestMITM(t, nil,
+		WithRetryPolicy(RetryPolicy{}),
+		WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}),
+	)
+
+	req := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", dead)
+	if resp, _ := doProxyRequest(t, addr, req); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("first status = %d, want 502", resp.StatusCode)
+	}
+	resp, _ := doProxyRequest(t, addr, req)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second status = %d, want 503", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", RouteUpstreams, managePort(addr)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upstreams status = %d", resp.StatusCode)
+	}
+	var out struct {
+		Upstreams []UpstreamHealth `json:"upstreams"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil {
+		t.Fatalf("decode upstreams: %v", err)
+	}
+	if len(out.Upstreams) != 1 || out.Upstreams[0].Host != dead || out.Upstreams[0].State != "open" {
+		t.Fatalf("upstreams = %+v", out.Upstreams)
+	}
+}
+
+func TestCircuitBreakerReleasesCancelledProbe(t *testing.T) {
+	// 只接受连接、从不响应的上游，使探测请求一直挂起直到被取消。
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	host := ln.Addr().String()
+
+	var m *MITM
+	startTestMITM(t, func(mm *MITM) { m = mm },
+		WithRetryPolicy(RetryPolicy{}),
+		WithCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute}),
+	)
+	now := time.Now()
+	m.health.now = func() time.Time { return now }
+	m.health.record(host, errors.New("boom"))
+	now = now.Add(2 * time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/", http.NoBody)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, _, err := m.roundTrip(ctx, req); err == nil {
+		t.Fatal("expected cancelled probe to fail")
+	}
+
+	if err := m.health.allow(host); err != nil {
+		t.Fatalf("allow after cancelled probe = %v, want a new probe slot", err)
+	}
+}
@@ -0,0 +1,575 @@
+package core_refactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBreakpointTimeout 是断点等待决定的默认时长，超时后按原样放行。
+const DefaultBreakpointTimeout = 2 * time.Minute
+
+const (
+	// breakpointBodyLimit 是响应断点读取并展示的响应体上限。
+	breakpointBodyLimit = 1 << 20
+	// breakpointReadWait 是响应断点等待读取响应体的最长时间，长轮询等慢速响应超时后以已读部分暂停。
+	breakpointReadWait = 5 * time.Second
+)
+
+// ErrBreakpointNotFound 表示指定的暂停项不存在（已处理或已超时）。
+var ErrBreakpointNotFound = errors.New("breakpoint not found")
+
+// BreakpointStage 表示断点暂停的阶段。
+type BreakpointStage string
+
+const (
+	// BreakRequest 在请求转发到上游之前暂停。
+	BreakRequest BreakpointStage = "request"
+	// BreakResponse 在响应写回客户端之前暂停。
+	BreakResponse BreakpointStage = "response"
+)
+
+// BreakpointAction 是对暂停项作出的决定。
+type BreakpointAction string
+
+const (
+	// BreakpointResume 应用修改（可为空）后继续处理。
+	BreakpointResume BreakpointAction = "resume"
+	// BreakpointDrop 丢弃请求并断开客户端连接。
+	BreakpointDrop BreakpointAction = "drop"
+	// BreakpointRespond 不再继续处理，以 BreakpointEdit 描述的自定义响应回复客户端。
+	BreakpointRespond BreakpointAction = "respond"
+)
+
+// BreakpointRule 描述在哪些请求上设置断点；Request/Response 都为 false 时只在请求阶段暂停。
+type BreakpointRule struct {
+	Name     string    `json:"name,omitempty"`
+	Match    RuleMatch `json:"match"`
+	Request  bool      `json:"request,omitempty"`
+	Response bool      `json:"response,omitempty"`
+}
+
+func (r BreakpointRule) stages(stage BreakpointStage) bool {
+	if !r.Request && !r.Response {
+		return stage == BreakRequest
+	}
+	return (stage == BreakRequest && r.Request) || (stage == BreakResponse && r.Response)
+}
+
+// BreakpointEdit 描述对暂停中的请求/响应的修改，零值字段保持不变。
+// 请求阶段使用 Method/URL，响应阶段与自定义响应使用 Status；Header 非 nil 时整体替换。
+type BreakpointEdit struct {
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *string     `json:"body,omitempty"`
+}
+
+// PausedFlow 是一个正在断点上等待决定的请求或响应快照。
+type PausedFlow struct {
+	ID     uint64          `json:"id"`
+	FlowID uint64          `json:"flowId"`
+	Rule   string          `json:"rule,omitempty"`
+	Stage  BreakpointStage `json:"stage"`
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	Status int             `json:"status,omitempty"`
+	Header http.Header     `json:"header"`
+	Body   string          `json:"body"`
+	// Truncated 表示 Body 只是响应体的开头部分（SSE、超过上限或未及时读完的响应）；
+	// 此时不修改 Body 放行会原样转发完整的响应体。
+	Truncated bool      `json:"truncated,omitempty"`
+	PausedAt  time.Time `json:"pausedAt"`
+	Deadline  time.Time `json:"deadline"`
+}
+
+type breakpointDecision struct {
+	action BreakpointAction
+	edit   BreakpointEdit
+}
+
+type pausedEntry struct {
+	info   PausedFlow
+	decide chan breakpointDecision
+}
+
+// Breakpoints 管理断点规则与当前暂停的请求/响应。
+type Breakpoints struct {
+	mu       sync.Mutex
+	rules    []BreakpointRule
+	compiled []compiledRule
+	timeout  time.Duration
+	seq      uint64
+	pending  map[uint64]*pausedEntry
+}
+
+// NewBreakpoints 创建断点管理器；timeout <= 0 时使用 DefaultBreakpointTimeout。
+func NewBreakpoints(timeout time.Duration, rules ...BreakpointRule) (*Breakpoints, error) {
+	if timeout <= 0 {
+		timeout = DefaultBreakpointTimeout
+	}
+	b := &Breakpoints{timeout: timeout, pending: make(map[uint64]*pausedEntry)}
+	if err := b.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetRules 替换全部断点规则；已暂停的项不受影响。
+func (b *Breakpoints) SetRules(rules []BreakpointRule) error {
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, r := range rules {
+		cr, err := compileRule(Rule{Name: r.Name, Match: r.Match})
+		if err != nil {
+			return fmt.Errorf("breakpoint %d (%s): %w", i, r.Name, err)
+		}
+		compiled = append(compiled, cr)
+	}
+	b.mu.Lock()
+	b.rules = append([]BreakpointRule(nil), rules...)
+	b.compiled = compiled
+	b.mu.Unlock()
+	return nil
+}
+
+// Rules 返回当前断点规则。
+func (b *Breakpoints) Rules() []BreakpointRule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BreakpointRule(nil), b.rules...)
+}
+
+// Pending 返回当前暂停中的项，按暂停顺序排列。
+func (b *Breakpoints) Pending() []PausedFlow {
+	b.mu.Lock()
+	out := make([]PausedFlow, 0, len(b.pending))
+	for _, e := range b.pending {
+		out = append(out, e.info)
+	}
+	b.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Resolve 对暂停项作出决定，唤醒阻塞在断点上的会话。
+func (b *Breakpoints) Resolve(id uint64, action BreakpointAction, edit BreakpointEdit) error {
+	switch action {
+	case BreakpointResume, BreakpointDrop, BreakpointRespond:
+	default:
+		return fmt.Errorf("unknown breakpoint action %q", action)
+	}
+	if edit.URL != "" {
+		if _, err := url.Parse(edit.URL); err != nil {
+			return fmt.Errorf("bad url: %w", err)
+		}
+	}
+
+	b.mu.Lock()
+	e, ok := b.pending[id]
+	if ok {
+		delete(b.pending, id)
+	}
+	b.mu.Unlock()
+	if !ok {
+		return ErrBreakpointNotFound
+	}
+	e.decide <- breakpointDecision{action: action, edit: edit}
+	return nil
+}
+
+// match 返回命中指定阶段的第一条断点规则名。
+func (b *Breakpoints) match(req *http.Request, stage BreakpointStage) (string, bool) {
+	b.mu.Lock()
+	rules, compiled := b.rules, b.compiled
+	b.mu.Unlock()
+	if len(rules) == 0 {
+		return "", false
+	}
+	ip := requestClientIP(req)
+	for i := range compiled {
+		if rules[i].stages(stage) && compiled[i].matches(req, ip) {
+			return rules[i].Name, true
+		}
+	}
+	return "", false
+}
+
+// wait 登记暂停项并阻塞到作出决定、超时（按原样放行）或 ctx 结束（丢弃）。
+func (b *Breakpoints) wait(ctx context.Context, info PausedFlow) (breakpointDecision, bool) {
+	e := &pausedEntry{decide: make(chan breakpointDecision, 1)}
+	b.mu.Lock()
+	b.seq++
+	info.ID = b.seq
+	info.PausedAt = time.Now()
+	info.Deadline = info.PausedAt.Add(b.timeout)
+	e.info = info
+	b.pending[info.ID] = e
+	timeout := b.timeout
+	b.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var d breakpointDecision
+	timedOut := false
+	select {
+	case d = <-e.decide:
+		return d, false
+	case <-timer.C:
+		d, timedOut = breakpointDecision{action: BreakpointResume}, true
+	case <-ctx.Done():
+		d = breakpointDecision{action: BreakpointDrop}
+	}
+
+	b.mu.Lock()
+	_, still := b.pending[info.ID]
+	delete(b.pending, info.ID)
+	b.mu.Unlock()
+	if !still {
+		// Resolve 已在超时的同时取走该项，以其决定为准。
+		return <-e.decide, false
+	}
+	return d, timedOut
+}
+
+// bufferBody 读取完整的消息体并替换为可重复读取的内存副本。
+func bufferBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// requestURL 返回请求的完整 URL；origin-form 请求（如 HTTPS 隧道内）的主机取自 Host 头。
+func requestURL(req *http.Request) string {
+	if req.Host == "" || req.Host == req.URL.Host {
+		return req.URL.String()
+	}
+	u := *req.URL
+	u.Host = req.Host
+	return u.String()
+}
+
+// pauseRequest 在请求命中断点时暂停并等待决定，返回 false 表示请求已被处理（丢弃或自定义响应）。
+func (s *session) pauseRequest(req *http.Request) bool {
+	name, ok := s.mitm.breakpoints.match(req, BreakRequest)
+	if !ok {
+		return true
+	}
+	body, err := bufferBody(req.Body)
+	if err != nil {
+		s.writeError(req, http.StatusBadGateway, err, nil)
+		return false
+	}
+	setRequestBody(req, body)
+
+	info := PausedFlow{
+		Rule:   name,
+		Stage:  BreakRequest,
+		Method: req.Method,
+		URL:    requestURL(req),
+		Header: req.Header.Clone(),
+		Body:   string(body),
+	}
+	if f := FlowFromRequest(req); f != nil {
+		info.FlowID = f.ID
+	}
+	d := s.awaitBreakpoint(info)
+
+	switch d.action {
+	case BreakpointDrop:
+		s.dropClient()
+		return false
+	case BreakpointRespond:
+		s.respond(req, breakpointResponse(req, d.edit))
+		return false
+	}
+
+	e := d.edit
+	if e.Method != "" {
+		req.Method = e.Method
+	}
+	if e.URL != "" {
+		if u, err := url.Parse(e.URL); err == nil {
+			if u.Host == "" {
+				// 相对 URL 只替换路径与查询，主机沿用原请求的 Host（HTTPS 隧道内的请求 URL.Host 为空）。
+				u.Scheme, u.Host = req.URL.Scheme, req.URL.Host
+			} else {
+				req.Host = u.Host
+			}
+			req.URL = u
+		}
+	}
+	if e.Header != nil {
+		req.Header = e.Header.Clone()
+	}
+	if e.Body != nil {
+		setRequestBody(req, []byte(*e.Body))
+	}
+	return true
+}
+
+// pauseResponse 在响应命中断点时暂停并等待决定，返回 nil 表示连接已被丢弃。
+func (s *session) pauseResponse(req *http.Request, resp *http.Response) *http.Response {
+	name, ok := s.mitm.breakpoints.match(req, BreakResponse)
+	if !ok {
+		return resp
+	}
+	body, truncated, err := s.peekResponseBody(resp)
+	if err != nil {
+		s.writeError(req, http.StatusBadGateway, err, nil)
+		return nil
+	}
+
+	info := PausedFlow{
+		Rule:      name,
+		Stage:     BreakResponse,
+		Method:    req.Method,
+		URL:       requestURL(req),
+		Status:    resp.StatusCode,
+		Header:    resp.Header.Clone(),
+		Body:      string(body),
+		Truncated: truncated,
+	}
+	if f := FlowFromRequest(req); f != nil {
+		info.FlowID = f.ID
+	}
+	d := s.awaitBreakpoint(info)
+
+	switch d.action {
+	case BreakpointDrop:
+		resp.Body.Close()
+		s.dropClient()
+		return nil
+	case BreakpointRespond:
+		resp.Body.Close()
+		return breakpointResponse(req, d.edit)
+	}
+
+	e := d.edit
+	if e.Status != 0 {
+		resp.StatusCode = e.Status
+		resp.Status = fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	if e.Header != nil {
+		resp.Header = e.Header.Clone()
+	}
+	if e.Body != nil {
+		resp.Body.Close()
+		setResponseBody(resp, []byte(*e.Body))
+	}
+	return resp
+}
+
+// peekResponseBody 读取响应体用于断点展示。完整读到的响应体替换为内存副本；SSE 不读取，
+// 超过 breakpointBodyLimit 或 breakpointReadWait 内未读完时返回已读部分并标记截断，
+// 此时 resp.Body 替换为先输出已读部分、再接续原响应体的读取器。
+func (s *session) peekResponseBody(resp *http.Response) ([]byte, bool, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil, false, nil
+	}
+	if isEventStream(resp) {
+		return nil, true, nil
+	}
+	p := &peekedBody{src: resp.Body, done: make(chan struct{})}
+	go p.fill(breakpointBodyLimit)
+	timer := time.NewTimer(breakpointReadWait)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		if p.err != nil {
+			resp.Body.Close()
+			return nil, false, p.err
+		}
+		if !p.more {
+			resp.Body.Close()
+			setResponseBody(resp, p.buf)
+			return p.buf, false, nil
+		}
+		resp.Body = p
+		return p.buf, true, nil
+	case <-timer.C:
+	case <-s.ctx.Done():
+	}
+	// 读取仍在进行，只能展示此刻已读到的部分。
+	p.mu.Lock()
+	snapshot := append([]byte(nil), p.buf...)
+	p.mu.Unlock()
+	resp.Body = p
+	return snapshot, true, nil
+}
+
+// peekedBody 在后台读取响应体的前若干字节，Read 时先输出这部分再接续原响应体。
+type peekedBody struct {
+	src  io.ReadCloser
+	done chan struct{}
+
+	mu   sync.Mutex
+	buf  []byte
+	more bool // 读满上限后原响应体可能还有剩余
+	err  error
+	off  int
+}
+
+func (p *peekedBody) fill(limit int) {
+	defer close(p.done)
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := p.src.Read(chunk[:min(len(chunk), limit-len(p.buf))])
+		p.mu.Lock()
+		p.buf = append(p.buf, chunk[:n]...)
+		full := len(p.buf) >= limit
+		p.mu.Unlock()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.err = err
+			return
+		}
+		if full {
+			p.more = true
+			return
+		}
+	}
+}
+
+func (p *peekedBody) Read(b []byte) (int, error) {
+	<-p.done
+	if p.off < len(p.buf) {
+		n := copy(b, p.buf[p.off:])
+		p.off += n
+		return n, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	if !p.more {
+		return 0, io.EOF
+	}
+	return p.src.Read(b)
+}
+
+func (p *peekedBody) Close() error {
+	return p.src.Close()
+}
+
+// awaitBreakpoint 阻塞当前会话直到作出决定。等待期间解除客户端连接的超时，
+// 避免长时间暂停导致后续写响应失败；响应仍经 writeLoop 按顺序写出。
+func (s *session) awaitBreakpoint(info PausedFlow) breakpointDecision {
+	_ = s.client.SetDeadline(time.Time{})
+	s.mitm.logger.Info("breakpoint paused", "flow", info.FlowID, "rule", info.Rule, "method", info.Method, "url", info.URL, "stage", info.Stage)
+	d, timedOut := s.mitm.breakpoints.wait(s.ctx, info)
+	if timedOut {
+		s.mitm.logger.Warn("breakpoint timed out, resuming", "flow", info.FlowID, "rule", info.Rule, "url", info.URL)
+	}
+	return d
+}
+
+// dropClient 按顺序在之前的响应写完后断开客户端连接。
+func (s *session) dropClient() {
+	s.submit(func() error {
+		s.client.reset()
+		return errBreakpointDropped
+	})
+}
+
+var errBreakpointDropped = errors.New("dropped at breakpoint")
+
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	if req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Length")
+}
+
+// breakpointResponse 根据 BreakpointEdit 构造自定义响应，Status 为空时默认 200。
+func breakpointResponse(req *http.Request, e BreakpointEdit) *http.Response {
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := ""
+	if e.Body != nil {
+		body = *e.Body
+	}
+	resp := textResponse(req, status, body)
+	if e.Header != nil {
+		resp.Header = e.Header.Clone()
+		resp.Header.Del("Content-Length")
+	}
+	return resp
+}
+
+// breakpointCommand 是管理接口中对暂停项作出决定的请求体。
+type breakpointCommand struct {
+	ID     uint64           `json:"id"`
+	Action BreakpointAction `json:"action"`
+	BreakpointEdit
+}
+
+// handleBreakpoints 管理断点：GET 返回规则与暂停项，PUT 替换规则，
+// POST {"id":1,"action":"resume|drop|respond",...修改字段} 对暂停项作出决定。
+func (m *MITM) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"rules":   m.breakpoints.Rules(),
+			"pending": m.breakpoints.Pending(),
+		})
+	case http.MethodPut:
+		var rules []BreakpointRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "decode breakpoint rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.breakpoints.SetRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.breakpoints.Rules())
+	case http.MethodPost:
+		var cmd breakpointCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, "decode breakpoint command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.breakpoints.Resolve(cmd.ID, cmd.Action, cmd.BreakpointEdit); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrBreakpointNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.breakpoints.Pending())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
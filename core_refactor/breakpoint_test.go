@@ -0,0 +1,235 @@
+package core_refactor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type breakpointResult struct {
+	resp *http.Response
+	body string
+	err  error
+}
+
+// newBreakpointSetup 启动回显上游与带断点的代理，返回发送请求的函数与断点管理器。
+func newBreakpointSetup(t *testing.T, timeout time.Duration, rules ...BreakpointRule) (func(raw string) <-chan breakpointResult, *Breakpoints, string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Edit"), body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	b, err := NewBreakpoints(timeout, rules...)
+	if err != nil {
+		t.Fatalf("NewBreakpoints: %v", err)
+	}
+	addr := startTestMITM(t, nil, WithBreakpoints(b))
+
+	send := func(raw string) <-chan breakpointResult {
+		ch := make(chan breakpointResult, 1)
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				ch <- breakpointResult{err: err}
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, raw)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				ch <- breakpointResult{err: err}
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			ch <- breakpointResult{resp: resp, body: string(body), err: err}
+		}()
+		return ch
+	}
+	return send, b, upstream.Listener.Addr().String()
+}
+
+func waitPaused(t *testing.T, b *Breakpoints) PausedFlow {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := b.Pending(); len(p) > 0 {
+			return p[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no paused flow")
+	return PausedFlow{}
+}
+
+func TestBreakpointEditRequest(t *testing.T) {
+	send, b, host := newBreakpointSetup(t, 0, BreakpointRule{Name: "api", Match: RuleMatch{Path: "/api/*"}})
+
+	ch := send(fmt.Sprintf("POST /api/a HTTP/1.1\r\nHost: %s\r\nContent-Length: 5\r\n\r\nhello", host))
+	p := waitPaused(t, b)
+	if p.Stage != BreakRequest || p.Rule != "api" || p.Method != "POST" || p.Body != "hello" {
+		t.Fatalf("paused = %+v", p)
+	}
+
+	body := "edited body"
+	header := p.Header.Clone()
+	header.Set("X-Edit", "yes")
+	if err := b.Resolve(p.ID, BreakpointResume, BreakpointEdit{
+		Method: "PUT",
+		URL:    fmt.Sprintf("http://%s/api/b", host),
+		Header: header,
+		Body:   &body,
+	}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	res := <-ch
+	if res.err != nil || res.body != "PUT /api/b yes edited body" {
+		t.Fatalf("result = %q, %v", res.body, res.err)
+	}
+	if err := b.Resolve(p.ID, BreakpointResume, BreakpointEdit{}); err != ErrBreakpointNotFound {
+		t.Fatalf("second Resolve err = %v", err)
+	}
+}
+
+func TestBreakpointEditRelativeURL(t *testing.T) {
+	send, b, host := newBreakpointSetup(t, 0, BreakpointRule{Name: "api", Match: RuleMatch{Path: "/api/*"}})
+
+	// origin-form 请求（与 HTTPS 隧道内的请求相同）的 URL 不含主机。
+	ch := send(fmt.Sprintf("GET /api/a HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	p := waitPaused(t, b)
+	if want := fmt.Sprintf("http://%s/api/a", host); p.URL != want {
+		t.Fatalf("paused URL = %q, want %q", p.URL, want)
+	}
+	if err := b.Resolve(p.ID, BreakpointResume, BreakpointEdit{URL: "/other?x=1"}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	res := <-ch
+	if res.err != nil || res.body != "GET /other  " {
+		t.Fatalf("result = %q, %v", res.body, res.err)
+	}
+}
+
+func TestBreakpointResponse(t *testing.T) {
+	send, b, host := newBreakpointSetup(t, 0, BreakpointRule{Match: RuleMatch{Host: "127.0.0.1"}, Response: true})
+
+	ch := send(fmt.Sprintf("GET /x HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	p := waitPaused(t, b)
+	if p.Stage != BreakResponse || p.Status != 200 || p.Body != "GET /x  " {
+		t.Fatalf("paused = %+v", p)
+	}
+	body := "patched"
+	b.Resolve(p.ID, BreakpointResume, BreakpointEdit{Status: 418, Body: &body})
+
+	res := <-ch
+	if res.err != nil || res.resp.StatusCode != 418 || res.body != "patched" {
+		t.Fatalf("result = %+v", res)
+	}
+}
+
+func TestBreakpointRespondAndDrop(t *testing.T) {
+	send, b, host := newBreakpointSetup(t, 0, BreakpointRule{Match: RuleMatch{Path: "/*"}})
+	raw := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+
+	ch := send(raw)
+	body := "mocked"
+	b.Resolve(waitPaused(t, b).ID, BreakpointRespond, BreakpointEdit{
+		Status: 201,
+		Header: http.Header{"X-Mock": {"1"}},
+		Body:   &body,
+	})
+	res := <-ch
+	if res.err != nil || res.resp.StatusCode != 201 || res.body != "mocked" || res.resp.Header.Get("X-Mock") != "1" {
+		t.Fatalf("respond result = %+v", res)
+	}
+
+	ch = send(raw)
+	b.Resolve(waitPaused(t, b).ID, BreakpointDrop, BreakpointEdit{})
+	if res := <-ch; res.err == nil {
+		t.Fatalf("expected dropped connection, got %+v", res)
+	}
+}
+
+func TestBreakpointTimeout(t *testing.T) {
+	send, b, host := newBreakpointSetup(t, 50*time.Millisecond, BreakpointRule{Match: RuleMatch{Path: "/*"}})
+
+	res := <-send(fmt.Sprintf("GET /slow HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	if res.err != nil || res.body != "GET /slow  " {
+		t.Fatalf("result = %q, %v", res.body, res.err)
+	}
+	if p := b.Pending(); len(p) != 0 {
+		t.Fatalf("pending after timeout: %+v", p)
+	}
+}
+
+func TestBreakpointResponseStreaming(t *testing.T) {
+	release := make(chan struct{})
+	big := strings.Repeat("x", breakpointBodyLimit+100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			// 未知长度的大响应体。
+			w.(http.Flusher).Flush()
+			io.WriteString(w, big)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: a\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: b\n\n")
+	}))
+	t.Cleanup(upstream.Close)
+	host := upstream.Listener.Addr().String()
+	b, _ := NewBreakpoints(time.Minute, BreakpointRule{Match: RuleMatch{Path: "/*"}, Response: true})
+	addr := startTestMITM(t, nil, WithBreakpoints(b))
+
+	// SSE 流不会读到结束，暂停不能等待响应体读完。
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	p := waitPaused(t, b)
+	if !p.Truncated || p.Body != "" {
+		t.Fatalf("paused SSE = %+v", p)
+	}
+	b.Resolve(p.ID, BreakpointResume, BreakpointEdit{})
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	close(release)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "data: a\n\ndata: b\n\n" {
+		t.Fatalf("SSE body = %q", body)
+	}
+
+	// 超过上限的响应体只展示开头，放行后完整转发。
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn2, "GET /big HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	p = waitPaused(t, b)
+	if !p.Truncated || len(p.Body) != breakpointBodyLimit {
+		t.Fatalf("paused big body: truncated=%v len=%d", p.Truncated, len(p.Body))
+	}
+	b.Resolve(p.ID, BreakpointResume, BreakpointEdit{})
+	resp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != big {
+		t.Fatalf("big body length = %d", len(body))
+	}
+}
@@ -83,21 +83,27 @@ func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.PrivateKey, erro
 
 // SignHost 为给定主机列表签发 TLS 证书；相同首主机名会命中缓存。
 func (ca *CA) SignHost(hosts []string) (tls.Certificate, error) {
+	cert, _, err := ca.signHost(hosts)
+	return cert, err
+}
+
+// signHost 同 SignHost，额外返回是否命中缓存。
+func (ca *CA) signHost(hosts []string) (tls.Certificate, bool, error) {
 	if len(hosts) == 0 {
-		return tls.Certificate{}, fmt.Errorf("no hosts provided")
+		return tls.Certificate{}, false, fmt.Errorf("no hosts provided")
 	}
 	cacheKey := hosts[0]
 
 	ca.mu.RLock()
 	if c, ok := ca.cache[cacheKey]; ok {
 		ca.mu.RUnlock()
-		return c, nil
+		return c, true, nil
 	}
 	ca.mu.RUnlock()
 
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("generate private key: %w", err)
+		return tls.Certificate{}, false, fmt.Errorf("generate private key: %w", err)
 	}
 
 	template := &x509.Certificate{
@@ -123,7 +129,7 @@ func (ca *CA) SignHost(hosts []string) (tls.Certificate, error) {
 
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &priv.PublicKey, ca.key)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+		return tls.Certificate{}, false, fmt.Errorf("create certificate: %w", err)
 	}
 
 	tlsCert := tls.Certificate{
@@ -134,5 +140,5 @@ func (ca *CA) SignHost(hosts []string) (tls.Certificate, error) {
 	ca.mu.Lock()
 	ca.cache[cacheKey] = tlsCert
 	ca.mu.Unlock()
-	return tlsCert, nil
+	return tlsCert, false, nil
 }
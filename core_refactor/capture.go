@@ -0,0 +1,306 @@
+package core_refactor
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCaptureEntries = 1000
+	defaultCaptureBody    = 1 << 20
+)
+
+// CaptureConfig 控制抓包存储的容量。
+type CaptureConfig struct {
+	// MaxEntries 最多保留的交换记录数，超出后丢弃最早的记录；0 表示 1000。
+	MaxEntries int
+	// MaxBodySize 每个请求/响应体最多保留的字节数，超出部分只计数不保存；0 表示 1MB。
+	MaxBodySize int64
+}
+
+// CapturedRequest 是转发到上游的请求快照。
+type CapturedRequest struct {
+	Method string
+	URL    string
+	Proto  string
+	Header http.Header
+	Body   []byte
+	// BodySize 是请求体的实际字节数，Truncated 表示 Body 只保存了其中一部分。
+	BodySize  int64
+	Truncated bool
+}
+
+// CapturedResponse 是写回客户端的响应快照，Body 为线上（未解压）的字节。
+type CapturedResponse struct {
+	StatusCode int
+	Status     string
+	Proto      string
+	Header     http.Header
+	Body       []byte
+	BodySize   int64
+	Truncated  bool
+	// Events 是 text/event-stream 响应中转发给客户端的事件（钩子处理后），总数据量受 MaxBodySize 限制。
+	Events []SSEEvent
+}
+
+// CaptureTimings 记录一次交换各阶段的耗时。
+type CaptureTimings struct {
+	// Wait 从开始转发到收到上游响应头的时间（含拨号与重试）。
+	Wait time.Duration
+	// Receive 响应体写回客户端所用的时间。
+	Receive time.Duration
+}
+
+// CapturedExchange 是一次完整的请求/响应交换记录。
+type CapturedExchange struct {
+	FlowID     uint64
+	ClientAddr string
+	// User 是通过代理认证的用户名，重放时据此应用其个人规则。
+	User      string
+	StartTime time.Time
+	Request   CapturedRequest
+	// Response 为 nil 表示转发失败，原因见 Error。
+	Response *CapturedResponse
+	Error    string
+	Timings  CaptureTimings
+	// GRPC 是 gRPC 调用的解码结果，非 gRPC 请求为 nil。
+	GRPC *CapturedGRPC
+}
+
+// CaptureFilter 过滤抓包记录，零值字段不限制。
+type CaptureFilter struct {
+	// Host 主机名 glob（* 可跨越 .），大小写不敏感。
+	Host  string
+	Since time.Time
+	Until time.Time
+}
+
+func (f CaptureFilter) matches(e *CapturedExchange) bool {
+	if !f.Since.IsZero() && e.StartTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.StartTime.After(f.Until) {
+		return false
+	}
+	if f.Host != "" {
+		re, err := compilePattern(f.Host, true)
+		if err != nil {
+			return false
+		}
+		host := e.Request.URL
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		if i := strings.IndexAny(host, "/?"); i >= 0 {
+			host = host[:i]
+		}
+		h, _ := hostPort(host, false)
+		if !re.MatchString(h) {
+			return false
+		}
+	}
+	return true
+}
+
+// CaptureStore 在内存中保存最近的交换记录，可导出为 HAR。
+type CaptureStore struct {
+	mu      sync.Mutex
+	cfg     CaptureConfig
+	entries []*CapturedExchange
+	next    int
+	full    bool
+}
+
+// NewCaptureStore 创建抓包存储。
+func NewCaptureStore(cfg CaptureConfig) *CaptureStore {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultCaptureEntries
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultCaptureBody
+	}
+	return &CaptureStore{cfg: cfg, entries: make([]*CapturedExchange, cfg.MaxEntries)}
+}
+
+// Add 追加一条记录，存储已满时覆盖最早的记录。
+func (s *CaptureStore) Add(e *CapturedExchange) {
+	s.mu.Lock()
+	s.entries[s.next] = e
+	s.next++
+	if s.next == len(s.entries) {
+		s.next, s.full = 0, true
+	}
+	s.mu.Unlock()
+}
+
+// Entries 按开始时间顺序返回满足过滤条件的记录。
+func (s *CaptureStore) Entries(f CaptureFilter) []*CapturedExchange {
+	s.mu.Lock()
+	var ordered []*CapturedExchange
+	if s.full {
+		ordered = append(ordered, s.entries[s.next:]...)
+	}
+	ordered = append(ordered, s.entries[:s.next]...)
+	s.mu.Unlock()
+
+	out := make([]*CapturedExchange, 0, len(ordered))
+	for _, e := range ordered {
+		if e != nil && f.matches(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Clear 清空全部记录。
+func (s *CaptureStore) Clear() {
+	s.mu.Lock()
+	s.entries = make([]*CapturedExchange, len(s.entries))
+	s.next, s.full = 0, false
+	s.mu.Unlock()
+}
+
+// captureRecorder 跟踪一次正在进行的交换，在响应体写完后提交到存储。
+type captureRecorder struct {
+	store *CaptureStore
+	entry *CapturedExchange
+	start time.Time
+	once  sync.Once
+	// eventBytes 是已记录的 SSE 事件数据总量。
+	eventBytes int64
+	grpc       *grpcCall
+}
+
+// startCapture 在请求转发前记录请求快照；未启用抓包时返回 nil。
+func (m *MITM) startCapture(req *http.Request) *captureRecorder {
+	if m.capture == nil {
+		return nil
+	}
+	e := &CapturedExchange{
+		StartTime: time.Now(),
+		Request: CapturedRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Proto:  req.Proto,
+			Header: req.Header.Clone(),
+		},
+	}
+	if f := FlowFromRequest(req); f != nil {
+		e.FlowID, e.ClientAddr, e.User, e.StartTime = f.ID, f.ClientAddr, f.User, f.StartTime
+	}
+	if req.Host != "" && req.Host != req.URL.Host {
+		u := *req.URL
+		u.Host = req.Host
+		e.Request.URL = u.String()
+	}
+
+	limit := m.capture.cfg.MaxBodySize
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(io.LimitReader(body, limit+1))
+			body.Close()
+			e.Request.Body, e.Request.BodySize = data, int64(len(data))
+			if int64(len(data)) > limit {
+				e.Request.Body, e.Request.Truncated = data[:limit], true
+				e.Request.BodySize = req.ContentLength
+			}
+		}
+	} else if req.ContentLength > 0 {
+		// 大请求体以流式转发，只记录长度。
+		e.Request.BodySize, e.Request.Truncated = req.ContentLength, true
+	}
+	return &captureRecorder{store: m.capture, entry: e, start: time.Now()}
+}
+
+// fail 记录转发失败并立即提交。
+func (c *captureRecorder) fail(err error) {
+	if c == nil {
+		return
+	}
+	c.entry.Error = err.Error()
+	c.entry.Timings.Wait = time.Since(c.start)
+	c.finish()
+}
+
+// response 记录响应头并包装响应体，响应体读完或关闭时提交记录。
+func (c *captureRecorder) response(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.entry.Timings.Wait = now.Sub(c.start)
+	c.entry.Response = &CapturedResponse{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+		Header:     resp.Header.Clone(),
+	}
+	resp.Body = &captureBody{ReadCloser: resp.Body, rec: c, limit: c.store.cfg.MaxBodySize, start: now}
+}
+
+// trackGRPC 关联 gRPC 调用，提交记录时附带解码出的消息与状态。
+func (c *captureRecorder) trackGRPC(call *grpcCall) {
+	if c != nil {
+		c.grpc = call
+	}
+}
+
+// event 记录一个 SSE 事件。
+func (c *captureRecorder) event(ev SSEEvent) {
+	if c == nil || c.entry.Response == nil {
+		return
+	}
+	if c.eventBytes += int64(len(ev.Data)); c.eventBytes > c.store.cfg.MaxBodySize {
+		return
+	}
+	c.entry.Response.Events = append(c.entry.Response.Events, ev)
+}
+
+func (c *captureRecorder) finish() {
+	c.once.Do(func() {
+		c.entry.GRPC = c.grpc.snapshot()
+		c.store.Add(c.entry)
+	})
+}
+
+type captureBody struct {
+	io.ReadCloser
+	rec   *captureRecorder
+	limit int64
+	start time.Time
+	buf   []byte
+	n     int64
+	once  sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.n += int64(n)
+		if room := b.limit - int64(len(b.buf)); room > 0 {
+			b.buf = append(b.buf, p[:min(int64(n), room)]...)
+		}
+	}
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *captureBody) done() {
+	b.once.Do(func() {
+		r := b.rec.entry.Response
+		r.Body, r.BodySize, r.Truncated = b.buf, b.n, b.n > int64(len(b.buf))
+		b.rec.entry.Timings.Receive = time.Since(b.start)
+		b.rec.finish()
+	})
+}
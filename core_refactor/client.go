@@ -60,17 +60,38 @@ func (c *clientConn) Close() error {
 	return c.raw.Close()
 }
 
-func (c *clientConn) upgradeTLS(ca *CA, host string) error {
-	if _, err := c.raw.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
-		return err
+// reset 以 TCP RST 方式立即断开客户端连接（SO_LINGER=0），用于故障注入。
+func (c *clientConn) reset() error {
+	conn := c.raw
+	for {
+		u, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.Unwrap()
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
 	}
+	return c.raw.Close()
+}
 
-	hostname, _, err := net.SplitHostPort(host)
-	if err != nil {
-		hostname = host
+// setTarget 记录当前请求的目标主机，供弱网模拟按主机匹配规则。
+func (c *clientConn) setTarget(host string) {
+	if sc, ok := c.raw.(*shapedConn); ok {
+		h, _ := hostPort(host, false)
+		sc.setHost(h)
+	}
+}
+
+// upgradeTLS 应答 CONNECT 并以 sign 签发的证书与客户端完成 TLS 握手。
+func (c *clientConn) upgradeTLS(sign func(hostname string) (tls.Certificate, error), host string) error {
+	if _, err := c.raw.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return err
 	}
 
-	cert, err := ca.SignHost([]string{hostname})
+	hostname, _ := hostPort(host, true)
+	cert, err := sign(canonicalHost(hostname))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,242 @@
+package core_refactor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultAction 是故障注入规则执行的动作。
+type FaultAction string
+
+const (
+	// FaultStatus 不访问上游，直接返回指定状态码。
+	FaultStatus FaultAction = "status"
+	// FaultReset 不访问上游，以 TCP RST 方式断开客户端连接。
+	FaultReset FaultAction = "reset"
+	// FaultDelay 收到上游响应后延迟 DelayMs 再写出响应头。
+	FaultDelay FaultAction = "delay"
+	// FaultTruncate 响应体写出 TruncateAfter 字节后中断连接。
+	FaultTruncate FaultAction = "truncate"
+	// FaultCorrupt 翻转响应体第 CorruptOffset 个字节。
+	FaultCorrupt FaultAction = "corrupt"
+)
+
+// FaultRule 描述一条故障注入规则。Host/Path 为 path.Match 风格的 glob，空字段匹配全部。
+type FaultRule struct {
+	Name   string `json:"name,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Method string `json:"method,omitempty"`
+	// Probability 命中后实际触发的概率（0~1），0 视为 1。
+	Probability float64     `json:"probability,omitempty"`
+	Action      FaultAction `json:"action"`
+
+	Status        int    `json:"status,omitempty"`
+	Body          string `json:"body,omitempty"`
+	DelayMs       int    `json:"delayMs,omitempty"`
+	TruncateAfter int64  `json:"truncateAfter,omitempty"`
+	CorruptOffset int64  `json:"corruptOffset,omitempty"`
+}
+
+func (r FaultRule) validate() error {
+	switch r.Action {
+	case FaultStatus, FaultReset, FaultDelay, FaultTruncate, FaultCorrupt:
+	default:
+		return fmt.Errorf("unknown fault action %q", r.Action)
+	}
+	for _, p := range []string{r.Host, r.Path} {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func (r FaultRule) matches(req *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.Host != "" {
+		host, _ := hostPort(req.Host, false)
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// FaultInjector 按规则对匹配的请求注入故障，用于验证客户端的容错处理。
+type FaultInjector struct {
+	mu    sync.RWMutex
+	rules []FaultRule
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+}
+
+// NewFaultInjector 创建故障注入器。
+func NewFaultInjector(rules ...FaultRule) (*FaultInjector, error) {
+	f := &FaultInjector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if err := f.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetRules 替换全部规则。
+func (f *FaultInjector) SetRules(rules []FaultRule) error {
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("fault rule %d: %w", i, err)
+		}
+	}
+	f.mu.Lock()
+	f.rules = append([]FaultRule(nil), rules...)
+	f.mu.Unlock()
+	return nil
+}
+
+// Rules 返回当前规则副本。
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]FaultRule(nil), f.rules...)
+}
+
+// pick 返回本次请求实际触发的规则（按概率抽样后）。
+func (f *FaultInjector) pick(req *http.Request) []FaultRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var fired []FaultRule
+	for _, r := range f.rules {
+		if !r.matches(req) {
+			continue
+		}
+		if r.Probability > 0 && r.Probability < 1 {
+			f.rngMu.Lock()
+			hit := f.rng.Float64() < r.Probability
+			f.rngMu.Unlock()
+			if !hit {
+				continue
+			}
+		}
+		fired = append(fired, r)
+	}
+	return fired
+}
+
+// faultResponse 构造 FaultStatus 规则的短路响应。
+func faultResponse(req *http.Request, r FaultRule) *http.Response {
+	status := r.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	body := r.Body
+	if body == "" {
+		body = fmt.Sprintf("fault injected: %d %s", status, http.StatusText(status))
+	}
+	return textResponse(req, status, body)
+}
+
+// applyResponseFaults 对上游响应施加延迟、截断与字节损坏类故障。
+// 延迟期间请求被取消（客户端断开或 Shutdown 强制关闭）时立即返回 ctx 的错误。
+func applyResponseFaults(req *http.Request, resp *http.Response, rules []FaultRule) error {
+	for _, r := range rules {
+		switch r.Action {
+		case FaultDelay:
+			timer := time.NewTimer(time.Duration(r.DelayMs) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return req.Context().Err()
+			}
+		case FaultTruncate:
+			resp.Body = &truncatingBody{ReadCloser: resp.Body, remain: r.TruncateAfter}
+		case FaultCorrupt:
+			resp.Body = &corruptingBody{ReadCloser: resp.Body, offset: r.CorruptOffset}
+		}
+	}
+	return nil
+}
+
+var (
+	// errFaultTruncated 使响应写出中途失败，从而中断客户端连接。
+	errFaultTruncated = errors.New("fault injected: body truncated")
+	// errFaultReset 在写循环中结束会话，客户端连接已被重置。
+	errFaultReset = errors.New("fault injected: connection reset")
+)
+
+type truncatingBody struct {
+	io.ReadCloser
+	remain int64
+}
+
+func (b *truncatingBody) Read(p []byte) (int, error) {
+	if b.remain <= 0 {
+		return 0, errFaultTruncated
+	}
+	if int64(len(p)) > b.remain {
+		p = p[:b.remain]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remain -= int64(n)
+	return n, err
+}
+
+type corruptingBody struct {
+	io.ReadCloser
+	offset int64
+	pos    int64
+}
+
+func (b *corruptingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.offset >= b.pos && b.offset < b.pos+int64(n) {
+		p[b.offset-b.pos] ^= 0xff
+	}
+	b.pos += int64(n)
+	return n, err
+}
+
+// handleFaults 查询（GET）或替换（PUT/POST）故障注入规则。
+func (m *MITM) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, m.faults.Rules())
+	case http.MethodPut, http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var rules []FaultRule
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, &rules); err != nil {
+				http.Error(w, "decode fault rules: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := m.faults.SetRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.faults.Rules())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,120 @@
+package core_refactor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newFaultTestSetup(t *testing.T, rules ...FaultRule) (proxyAddr, upstreamHost string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	f, err := NewFaultInjector(rules...)
+	if err != nil {
+		t.Fatalf("NewFaultInjector: %v", err)
+	}
+	return startTestMITM(t, nil, WithFaultInjector(f)), upstream.Listener.Addr().String()
+}
+
+func TestFaultStatus(t *testing.T) {
+	addr, host := newFaultTestSetup(t, FaultRule{Path: "/api/*", Method: "GET", Action: FaultStatus, Status: 500})
+
+	resp, _ := doProxyRequest(t, addr, fmt.Sprintf("GET /api/users HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	if resp.StatusCode != 500 {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET /other HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	if resp.StatusCode != 200 || body != "0123456789" {
+		t.Fatalf("unmatched request: status %d body %q", resp.StatusCode, body)
+	}
+}
+
+func TestFaultCorrupt(t *testing.T) {
+	addr, host := newFaultTestSetup(t, FaultRule{Action: FaultCorrupt, CorruptOffset: 3})
+
+	_, body := doProxyRequest(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	want := []byte("0123456789")
+	want[3] ^= 0xff
+	if body != string(want) {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestFaultTruncateAndReset(t *testing.T) {
+	cases := []FaultRule{
+		{Action: FaultTruncate, TruncateAfter: 4},
+		{Action: FaultReset},
+	}
+	for _, rule := range cases {
+		t.Run(string(rule.Action), func(t *testing.T) {
+			addr, host := newFaultTestSetup(t, rule)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				if rule.Action == FaultReset {
+					return
+				}
+				t.Fatalf("read response: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err == nil {
+				t.Fatalf("expected body read error, got body %q", body)
+			}
+			if rule.Action == FaultTruncate && string(body) != "0123" {
+				t.Fatalf("truncated body = %q, want 0123", body)
+			}
+		})
+	}
+}
+
+func TestFaultDelayCancelled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	f, _ := NewFaultInjector(FaultRule{Action: FaultDelay, DelayMs: 10000})
+	addr, m := startShutdownMITM(t, WithFaultInjector(f))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Listener.Addr())
+	time.Sleep(100 * time.Millisecond)
+
+	// 强制关闭时延迟中的请求应立即结束，而不是等满 10 秒。
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m.Shutdown(ctx)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Shutdown took %v while a fault delay was pending", d)
+	}
+}
+
+func TestFaultRuleValidation(t *testing.T) {
+	if _, err := NewFaultInjector(FaultRule{Action: "explode"}); err == nil {
+		t.Fatal("expected error for unknown action")
+	}
+	if _, err := NewFaultInjector(FaultRule{Action: FaultStatus, Path: "["}); err == nil {
+		t.Fatal("expected error for bad pattern")
+	}
+}
@@ -0,0 +1,80 @@
+package core_refactor
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var flowSeq atomic.Uint64
+
+type flowKey struct{}
+
+// Flow 记录一次请求/响应交换的元数据，通过请求的 context 在各处理阶段间传递。
+// 钩子中可通过 FlowFromRequest 取得当前请求对应的 Flow。
+type Flow struct {
+	ID         uint64
+	ClientAddr string
+	StartTime  time.Time
+	// User 是通过代理认证的用户名；未启用 WithProxyAuth 时为空。
+	User string
+
+	mu      sync.Mutex
+	retries []RetryAttempt
+	rule    *RuleResult
+}
+
+func newFlow(clientAddr string) *Flow {
+	return &Flow{
+		ID:         flowSeq.Add(1),
+		ClientAddr: clientAddr,
+		StartTime:  time.Now(),
+	}
+}
+
+// FlowFromRequest 返回请求关联的 Flow；未经过代理管线的请求返回 nil。
+func FlowFromRequest(req *http.Request) *Flow {
+	if req == nil {
+		return nil
+	}
+	return FlowFromContext(req.Context())
+}
+
+// FlowFromContext 返回 context 中携带的 Flow。
+func FlowFromContext(ctx context.Context) *Flow {
+	f, _ := ctx.Value(flowKey{}).(*Flow)
+	return f
+}
+
+func contextWithFlow(ctx context.Context, f *Flow) context.Context {
+	return context.WithValue(ctx, flowKey{}, f)
+}
+
+// Retries 返回该请求发生过的上游重试记录。
+func (f *Flow) Retries() []RetryAttempt {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RetryAttempt(nil), f.retries...)
+}
+
+// MatchedRules 返回命中该请求的规则名。
+func (f *Flow) MatchedRules() []string {
+	if f == nil || f.rule == nil {
+		return nil
+	}
+	return append([]string(nil), f.rule.Matched...)
+}
+
+func (f *Flow) addRetry(a RetryAttempt) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.retries = append(f.retries, a)
+	f.mu.Unlock()
+}
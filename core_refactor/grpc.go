@@ -0,0 +1,440 @@
+package core_refactor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxGRPCMessageSize 是解析模式下单条 gRPC 消息的大小上限。
+const maxGRPCMessageSize = 64 << 20
+
+// grpcCompressedFlag 是长度前缀中表示消息已压缩的标志位。
+const grpcCompressedFlag = 0x01
+
+// GRPCStatus 是调用结束时服务器返回的 grpc-status 与 grpc-message。
+type GRPCStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// GRPCMessage 是一条 gRPC 消息：长度前缀已去除、压缩已解开。
+type GRPCMessage struct {
+	// Path 是 /package.Service/Method 形式的调用路径。
+	Path string `json:"path"`
+	// Response 为 true 表示服务器发往客户端的消息。
+	Response bool `json:"response"`
+	// Compressed 表示消息在线上是压缩的。
+	Compressed bool `json:"compressed,omitempty"`
+	// Data 是解压后的消息字节（protobuf 或 JSON 编码）；钩子替换 Data 后消息以未压缩形式转发。
+	Data []byte `json:"data"`
+	// Decoded 是按 WithProtoRegistry 中的描述符解码的结果（protojson 形式），JSON 编码的消息直接解析。
+	Decoded map[string]any `json:"decoded,omitempty"`
+	// Fields 是没有描述符时的无 schema 解码结果。
+	Fields []ProtoField `json:"fields,omitempty"`
+	// Error 记录解压或解码失败的原因，此时消息原样转发。
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// GRPCHook 在 gRPC 消息转发前调用，可检查消息或替换 Data，返回 nil 表示丢弃该消息
+// （Connect 一元调用没有消息边界，丢弃等同于发送空消息）。
+// Decoded 与 Fields 只用于查看，修改它们不会影响转发内容。
+type GRPCHook func(req *http.Request, msg *GRPCMessage) *GRPCMessage
+
+// CapturedGRPC 是一次 gRPC 调用中解码出的消息与最终状态。
+type CapturedGRPC struct {
+	Path string `json:"path"`
+	// Protocol 为 grpc、grpc-web、grpc-web-text 或 connect。
+	Protocol         string        `json:"protocol"`
+	RequestMessages  []GRPCMessage `json:"requestMessages"`
+	ResponseMessages []GRPCMessage `json:"responseMessages"`
+	// Status 为 nil 表示调用未正常结束（没有收到 grpc-status）。
+	Status *GRPCStatus `json:"status"`
+}
+
+// rpcProtocol 是 gRPC 系列协议的线上格式。
+type rpcProtocol int
+
+const (
+	rpcGRPC rpcProtocol = iota
+	rpcGRPCWeb
+	rpcGRPCWebText
+	rpcConnect      // Connect 流式调用：带信封的消息流，结束信封携带状态
+	rpcConnectUnary // Connect 一元调用：请求体与响应体就是消息本身
+)
+
+func (p rpcProtocol) String() string {
+	switch p {
+	case rpcGRPCWeb:
+		return "grpc-web"
+	case rpcGRPCWebText:
+		return "grpc-web-text"
+	case rpcConnect, rpcConnectUnary:
+		return "connect"
+	}
+	return "grpc"
+}
+
+// detectRPC 根据请求的 Content-Type 识别协议与消息编码（proto 或 json）。
+func detectRPC(req *http.Request) (p rpcProtocol, codec string, ok bool) {
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	base, codec, _ := strings.Cut(mt, "+")
+	if codec == "" {
+		codec = "proto"
+	}
+	switch base {
+	case "application/grpc":
+		return rpcGRPC, codec, true
+	case "application/grpc-web":
+		return rpcGRPCWeb, codec, true
+	case "application/grpc-web-text":
+		return rpcGRPCWebText, codec, true
+	case "application/connect":
+		return rpcConnect, codec, true
+	case "application/proto", "application/json":
+		// Connect 一元调用使用普通的媒体类型，以协议版本头区分。
+		if req.Header.Get("Connect-Protocol-Version") != "" && req.Method == http.MethodPost {
+			return rpcConnectUnary, strings.TrimPrefix(base, "application/"), true
+		}
+	}
+	return 0, "", false
+}
+
+// parseGRPCStatus 从响应头或 trailer 中读取 grpc-status；grpc-message 按规范做百分号解码。
+func parseGRPCStatus(h http.Header) *GRPCStatus {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		return nil
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return nil
+	}
+	msg := h.Get("Grpc-Message")
+	if u, err := url.PathUnescape(msg); err == nil {
+		msg = u
+	}
+	return &GRPCStatus{Code: code, Message: msg}
+}
+
+// grpcCall 跟踪一次被解析的 gRPC 调用。
+type grpcCall struct {
+	m     *MITM
+	req   *http.Request
+	proto rpcProtocol
+	codec string
+
+	mu   sync.Mutex
+	info CapturedGRPC
+}
+
+// startGRPC 在启用 gRPC 钩子或抓包时解析 gRPC 系列请求：已缓存的请求体立即逐条处理，
+// 流式请求体包装为逐消息读取器。其他请求返回 nil。
+func (m *MITM) startGRPC(req *http.Request) *grpcCall {
+	if m.grpcHook == nil && m.capture == nil {
+		return nil
+	}
+	proto, codec, ok := detectRPC(req)
+	if !ok {
+		return nil
+	}
+	c := &grpcCall{m: m, req: req, proto: proto, codec: codec, info: CapturedGRPC{Path: req.URL.Path, Protocol: proto.String()}}
+	if proto == rpcConnectUnary || req.GetBody != nil {
+		body, err := bufferBody(req.Body)
+		if err != nil {
+			m.flowLog(req).Warn("grpc: read request body failed", "error", err)
+		} else if proto == rpcConnectUnary {
+			body = c.processUnary(body, false, req.Header)
+		} else {
+			body = c.processAll(body, false, c.encoding(req.Header))
+		}
+		setRequestBody(req, body)
+		return c
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = c.wrap(req.Body, false, req.Header, nil)
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+	}
+	return c
+}
+
+// response 解析响应：Connect 一元响应整体读取，其余包装为逐消息读取器；
+// trailers-only 响应直接从响应头读取状态。
+func (c *grpcCall) response(resp *http.Response) {
+	if c == nil {
+		return
+	}
+	if st := parseGRPCStatus(resp.Header); st != nil {
+		c.setStatus(st)
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	if c.proto == rpcConnectUnary {
+		body, err := bufferBody(resp.Body)
+		switch {
+		case err != nil:
+			c.m.flowLog(c.req).Warn("grpc: read response body failed", "error", err)
+		case resp.StatusCode == http.StatusOK:
+			body = c.processUnary(body, true, resp.Header)
+			c.setStatus(&GRPCStatus{})
+		default:
+			c.setStatus(connectUnaryError(resp.StatusCode, resp.Header, body))
+		}
+		setResponseBody(resp, body)
+		return
+	}
+
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Body = c.wrap(resp.Body, true, resp.Header, func() {
+		if st := parseGRPCStatus(resp.Trailer); st != nil {
+			c.setStatus(st)
+		}
+	})
+}
+
+// encoding 返回消息级压缩算法。
+func (c *grpcCall) encoding(h http.Header) string {
+	if c.proto == rpcConnect {
+		return h.Get("Connect-Content-Encoding")
+	}
+	return h.Get("Grpc-Encoding")
+}
+
+func (c *grpcCall) wrap(body io.ReadCloser, response bool, h http.Header, onEOF func()) io.ReadCloser {
+	b := &grpcBody{ReadCloser: body, src: body, call: c, response: response, encoding: c.encoding(h), onEOF: onEOF}
+	if c.proto == rpcGRPCWebText {
+		b.src, b.text = &base64Reader{r: body}, true
+	}
+	return b
+}
+
+func (c *grpcCall) setStatus(st *GRPCStatus) {
+	c.mu.Lock()
+	c.info.Status = st
+	c.mu.Unlock()
+}
+
+// snapshot 返回当前已解析的消息与状态。
+func (c *grpcCall) snapshot() *CapturedGRPC {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.info
+	info.RequestMessages = append([]GRPCMessage(nil), c.info.RequestMessages...)
+	info.ResponseMessages = append([]GRPCMessage(nil), c.info.ResponseMessages...)
+	return &info
+}
+
+// processAll 处理一段完整的消息流，返回重新编码的输出；末尾不足一帧的数据原样保留。
+func (c *grpcCall) processAll(data []byte, response bool, encoding string) []byte {
+	if c.proto == rpcGRPCWebText {
+		decoded, err := io.ReadAll(&base64Reader{r: bytes.NewReader(data)})
+		if err != nil {
+			return data
+		}
+		data = decoded
+	}
+	var out []byte
+	for len(data) >= 5 {
+		n := binary.BigEndian.Uint32(data[1:5])
+		if uint64(len(data)-5) < uint64(n) {
+			break
+		}
+		out = append(out, c.process(data[0], data[5:5+n], response, encoding)...)
+		data = data[5+n:]
+	}
+	out = append(out, data...)
+	if c.proto == rpcGRPCWebText {
+		out = []byte(base64.StdEncoding.EncodeToString(out))
+	}
+	return out
+}
+
+// process 解码一条消息并交给钩子，返回需要转发的带长度前缀的帧（被丢弃时为 nil）。
+// gRPC-Web 的 trailer 帧与 Connect 的结束信封只用于读取状态，原样转发。
+func (c *grpcCall) process(flag byte, payload []byte, response bool, encoding string) []byte {
+	if c.endOfStream(flag, payload, encoding) {
+		return grpcFrame(flag, payload)
+	}
+	msg := &GRPCMessage{
+		Path:       c.info.Path,
+		Response:   response,
+		Compressed: flag&grpcCompressedFlag != 0,
+		Data:       payload,
+		Time:       time.Now(),
+	}
+	if msg.Compressed {
+		data, err := decodeGRPCPayload(encoding, payload)
+		if err != nil {
+			msg.Error = err.Error()
+		} else {
+			msg.Data = data
+		}
+	}
+	out, changed := c.inspect(msg)
+	switch {
+	case out == nil:
+		return nil
+	case !changed:
+		// 内容未变时保留原始帧（包括压缩形式）。
+		return grpcFrame(flag, payload)
+	default:
+		return grpcFrame(flag&^grpcCompressedFlag, out.Data)
+	}
+}
+
+// inspect 解码消息、交给钩子并记录实际转发的内容；changed 表示钩子替换了消息数据。
+func (c *grpcCall) inspect(msg *GRPCMessage) (out *GRPCMessage, changed bool) {
+	if msg.Error == "" {
+		c.decode(msg)
+	}
+	orig := msg.Data
+	out = msg
+	if c.m.grpcHook != nil {
+		out = c.m.grpcHook(c.req, msg)
+	}
+	if out == nil {
+		return nil, false
+	}
+	rec := *out
+	if changed = !bytes.Equal(out.Data, orig); changed {
+		rec.Decoded, rec.Fields, rec.Error = nil, nil, ""
+		c.decode(&rec)
+	}
+	c.mu.Lock()
+	if rec.Response {
+		c.info.ResponseMessages = append(c.info.ResponseMessages, rec)
+	} else {
+		c.info.RequestMessages = append(c.info.RequestMessages, rec)
+	}
+	c.mu.Unlock()
+	return out, changed
+}
+
+// decode 按编码与描述符填充消息的解码结果。
+func (c *grpcCall) decode(msg *GRPCMessage) {
+	if c.codec == "json" {
+		if err := json.Unmarshal(msg.Data, &msg.Decoded); err != nil {
+			msg.Error = err.Error()
+		}
+		return
+	}
+	reg := c.m.protoRegistry
+	if method, ok := reg.Method(msg.Path); ok {
+		typ := method.Input
+		if msg.Response {
+			typ = method.Output
+		}
+		decoded, err := reg.Decode(typ, msg.Data)
+		if err == nil {
+			msg.Decoded = decoded
+			return
+		}
+		msg.Error = err.Error()
+	}
+	if fields, err := DecodeProto(msg.Data); err == nil {
+		msg.Fields = fields
+	} else if msg.Error == "" {
+		msg.Error = err.Error()
+	}
+}
+
+func decodeGRPCPayload(encoding string, payload []byte) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "deflate":
+		return decodeContent(strings.ToLower(encoding), payload)
+	case "", "identity":
+		return nil, fmt.Errorf("grpc: compressed message without encoding")
+	}
+	return nil, fmt.Errorf("grpc: unsupported encoding %q", encoding)
+}
+
+func grpcFrame(flag byte, payload []byte) []byte {
+	out := make([]byte, 5+len(payload))
+	out[0] = flag
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(payload)))
+	copy(out[5:], payload)
+	return out
+}
+
+// grpcBody 逐条读取长度前缀消息，处理后作为独立的 Read 返回。
+type grpcBody struct {
+	io.ReadCloser
+	src      io.Reader // 帧数据来源；grpc-web-text 时为 base64 解码后的流
+	text     bool      // 输出是否需要 base64 编码
+	call     *grpcCall
+	response bool
+	encoding string
+	onEOF    func()
+
+	out []byte
+	err error
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.next()
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *grpcBody) next() {
+	var hdr [5]byte
+	n, err := io.ReadFull(b.src, hdr[:])
+	if err != nil {
+		// 不完整的帧头原样转发，由对端报告错误。
+		b.emit(hdr[:n])
+		if err == io.EOF && b.onEOF != nil {
+			b.onEOF()
+		}
+		b.err = err
+		return
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxGRPCMessageSize {
+		b.err = fmt.Errorf("grpc: message of %d bytes exceeds limit", size)
+		return
+	}
+	payload := make([]byte, size)
+	if n, err := io.ReadFull(b.src, payload); err != nil {
+		b.emit(append(hdr[:], payload[:n]...))
+		b.err = err
+		return
+	}
+	b.emit(b.call.process(hdr[0], payload, b.response, b.encoding))
+}
+
+func (b *grpcBody) emit(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if b.text {
+		// 每帧单独编码（带填充），grpc-web-text 允许拼接多段 base64。
+		p = []byte(base64.StdEncoding.EncodeToString(p))
+	}
+	b.out = append(b.out, p...)
+}
@@ -0,0 +1,117 @@
+package core_refactor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func gzipBytes(p []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(p)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestGRPCDecodeThroughProxy(t *testing.T) {
+	names := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		name := ""
+		if fields, _ := DecodeProto(body[5:]); len(fields) > 0 {
+			name = fields[0].String
+		}
+		names <- name
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Encoding", "gzip")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(grpcFrame(0, pb(nil).str(1, "hello")))
+		w.Write(grpcFrame(grpcCompressedFlag, gzipBytes(pb(nil).str(1, "again"))))
+		w.Header().Set("Grpc-Status", "3")
+		w.Header().Set("Grpc-Message", "bad%20name")
+	}))
+	t.Cleanup(upstream.Close)
+
+	reg := NewProtoRegistry()
+	if err := reg.LoadDescriptorSet(testDescriptorSet()); err != nil {
+		t.Fatalf("LoadDescriptorSet: %v", err)
+	}
+	var mu sync.Mutex
+	var seen []string
+	hook := func(req *http.Request, msg *GRPCMessage) *GRPCMessage {
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%v:%v", msg.Response, msg.Decoded))
+		mu.Unlock()
+		if !msg.Response {
+			msg.Data = pb(nil).str(1, "alice")
+		}
+		return msg
+	}
+	store := NewCaptureStore(CaptureConfig{})
+	addr := startTestMITM(t, nil, WithCapture(store), WithProtoRegistry(reg), WithGRPCHook(hook))
+
+	frame := grpcFrame(0, testHelloRequest())
+	raw := fmt.Sprintf("POST /greet.Greeter/SayHello HTTP/1.1\r\nHost: %s\r\nContent-Type: application/grpc\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", upstream.Listener.Addr(), len(frame), frame)
+	resp, body := doProxyRequest(t, addr, raw)
+
+	if name := <-names; name != "alice" {
+		t.Fatalf("upstream saw name %q, want rewritten request", name)
+	}
+	want := string(grpcFrame(0, pb(nil).str(1, "hello"))) + string(grpcFrame(grpcCompressedFlag, gzipBytes(pb(nil).str(1, "again"))))
+	if body != want {
+		t.Fatalf("response body = %x, want %x", body, want)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "3" {
+		t.Fatalf("trailer = %v", resp.Trailer)
+	}
+
+	mu.Lock()
+	got := strings.Join(seen, "|")
+	mu.Unlock()
+	if !strings.HasPrefix(got, "false:map[count:7 labels:map[env:prod] mood:SAD name:bob tags:[1 2 300]]|true:map[message:hello]|true:map[message:again]") {
+		t.Fatalf("hook saw %s", got)
+	}
+
+	var entries []*CapturedExchange
+	for i := 0; i < 100 && len(entries) == 0; i++ {
+		entries = store.Entries(CaptureFilter{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 1 || entries[0].GRPC == nil {
+		t.Fatalf("captured %+v", entries)
+	}
+	g := entries[0].GRPC
+	if g.Path != "/greet.Greeter/SayHello" || len(g.RequestMessages) != 1 || len(g.ResponseMessages) != 2 ||
+		!g.ResponseMessages[1].Compressed || g.Status == nil || g.Status.Code != 3 || g.Status.Message != "bad name" {
+		t.Fatalf("captured grpc = %+v (status %+v)", g, g.Status)
+	}
+}
+
+func TestGRPCSchemalessFallback(t *testing.T) {
+	c := &grpcCall{m: &MITM{}, codec: "proto", info: CapturedGRPC{Path: "/unknown.Svc/Call"}}
+	data := append(grpcFrame(0, pb(nil).varint(1, 42)), 0, 0, 0)
+	if out := c.processAll(data, true, ""); !bytes.Equal(out, data) {
+		t.Fatalf("out = %x, want %x", out, data)
+	}
+	msgs := c.snapshot().ResponseMessages
+	if len(msgs) != 1 || msgs[0].Decoded != nil || len(msgs[0].Fields) != 1 || msgs[0].Fields[0].Uint != 42 {
+		t.Fatalf("messages = %+v", msgs)
+	}
+
+	bad := grpcFrame(grpcCompressedFlag, []byte("x"))
+	if out := c.processAll(bad, true, ""); !bytes.Equal(out, bad) {
+		t.Fatalf("undecodable message must pass through: %x", out)
+	}
+	if msgs := c.snapshot().ResponseMessages; msgs[1].Error == "" {
+		t.Fatalf("expected decode error, got %+v", msgs[1])
+	}
+}
@@ -0,0 +1,185 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// grpcWebTrailerFlag 标记 gRPC-Web 响应末尾携带 trailer 的帧。
+	grpcWebTrailerFlag = 0x80
+	// connectEndStreamFlag 标记 Connect 流式响应的结束信封。
+	connectEndStreamFlag = 0x02
+)
+
+// connectCodes 是 Connect 错误码名称到 gRPC 状态码的映射。
+var connectCodes = map[string]int{
+	"canceled":            1,
+	"unknown":             2,
+	"invalid_argument":    3,
+	"deadline_exceeded":   4,
+	"not_found":           5,
+	"already_exists":      6,
+	"permission_denied":   7,
+	"resource_exhausted":  8,
+	"failed_precondition": 9,
+	"aborted":             10,
+	"out_of_range":        11,
+	"unimplemented":       12,
+	"internal":            13,
+	"unavailable":         14,
+	"data_loss":           15,
+	"unauthenticated":     16,
+}
+
+// connectError 是 Connect 协议的错误对象。
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *connectError) status() *GRPCStatus {
+	code, ok := connectCodes[e.Code]
+	if !ok {
+		code = connectCodes["unknown"]
+	}
+	return &GRPCStatus{Code: code, Message: e.Message}
+}
+
+// endOfStream 识别 gRPC-Web trailer 帧与 Connect 结束信封并记录其中的状态。
+func (c *grpcCall) endOfStream(flag byte, payload []byte, encoding string) bool {
+	switch {
+	case (c.proto == rpcGRPCWeb || c.proto == rpcGRPCWebText) && flag&grpcWebTrailerFlag != 0:
+		// trailer 帧的内容是 HTTP/1 风格的头部块。
+		r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(payload), strings.NewReader("\r\n\r\n"))))
+		h, err := r.ReadMIMEHeader()
+		if err == nil {
+			if st := parseGRPCStatus(http.Header(h)); st != nil {
+				c.setStatus(st)
+			}
+		}
+		return true
+	case c.proto == rpcConnect && flag&connectEndStreamFlag != 0:
+		if flag&grpcCompressedFlag != 0 {
+			data, err := decodeGRPCPayload(encoding, payload)
+			if err != nil {
+				return true
+			}
+			payload = data
+		}
+		var end struct {
+			Error *connectError `json:"error"`
+		}
+		if err := json.Unmarshal(payload, &end); err != nil {
+			return true
+		}
+		if end.Error != nil {
+			c.setStatus(end.Error.status())
+		} else {
+			c.setStatus(&GRPCStatus{})
+		}
+		return true
+	}
+	return false
+}
+
+// processUnary 处理 Connect 一元调用的完整消息体（整体压缩由 Content-Encoding 表示），
+// 返回需要转发的消息体；钩子替换了内容时以未压缩形式转发。
+func (c *grpcCall) processUnary(body []byte, response bool, h http.Header) []byte {
+	msg := &GRPCMessage{Path: c.info.Path, Response: response, Data: body, Time: time.Now()}
+	if enc := strings.ToLower(h.Get("Content-Encoding")); enc != "" && enc != "identity" {
+		msg.Compressed = true
+		data, err := decodeContent(enc, body)
+		if err != nil {
+			msg.Error = err.Error()
+		} else {
+			msg.Data = data
+		}
+	}
+	out, changed := c.inspect(msg)
+	if out != nil && !changed {
+		return body
+	}
+	h.Del("Content-Encoding")
+	if out == nil {
+		return []byte{}
+	}
+	return out.Data
+}
+
+// connectUnaryError 从 Connect 一元调用的错误响应中读取状态；无法解析时按 HTTP 状态码推断。
+func connectUnaryError(status int, h http.Header, body []byte) *GRPCStatus {
+	if enc := strings.ToLower(h.Get("Content-Encoding")); enc != "" && enc != "identity" {
+		if data, err := decodeContent(enc, body); err == nil {
+			body = data
+		}
+	}
+	var e connectError
+	if err := json.Unmarshal(body, &e); err == nil && e.Code != "" {
+		return e.status()
+	}
+	code := "unknown"
+	switch status {
+	case http.StatusBadRequest:
+		code = "internal"
+	case http.StatusUnauthorized:
+		code = "unauthenticated"
+	case http.StatusForbidden:
+		code = "permission_denied"
+	case http.StatusNotFound:
+		code = "unimplemented"
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = "unavailable"
+	}
+	return &GRPCStatus{Code: connectCodes[code], Message: http.StatusText(status)}
+}
+
+// base64Reader 解码 grpc-web-text 的消息体：由多段各自带填充的标准 base64 拼接而成，
+// 可能夹杂换行，因此按 4 字符一组逐组解码。
+type base64Reader struct {
+	r   io.Reader
+	in  []byte
+	out []byte
+	err error
+	buf [4096]byte
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && len(b.in) > 0 {
+				b.in, b.err = nil, io.ErrUnexpectedEOF
+			}
+			return 0, b.err
+		}
+		n, err := b.r.Read(b.buf[:])
+		for _, ch := range b.buf[:n] {
+			if ch == '\r' || ch == '\n' || ch == ' ' || ch == '\t' {
+				continue
+			}
+			b.in = append(b.in, ch)
+			if len(b.in) < 4 {
+				continue
+			}
+			var dst [3]byte
+			m, derr := base64.StdEncoding.Decode(dst[:], b.in)
+			if derr != nil {
+				err = derr
+				break
+			}
+			b.out = append(b.out, dst[:m]...)
+			b.in = b.in[:0]
+		}
+		b.err = err
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
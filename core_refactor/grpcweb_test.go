@@ -0,0 +1,110 @@
+package core_refactor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGRPCWebText(t *testing.T) {
+	reply := grpcFrame(0, pb(nil).str(1, "hi bob"))
+	trailer := grpcFrame(grpcWebTrailerFlag, []byte("grpc-status: 5\r\ngrpc-message: no%20such%20user\r\n"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc-web-text+proto")
+		// 两段各自带填充的 base64 拼接。
+		io.WriteString(w, base64.StdEncoding.EncodeToString(reply))
+		io.WriteString(w, base64.StdEncoding.EncodeToString(trailer))
+	}))
+	t.Cleanup(upstream.Close)
+
+	reg := NewProtoRegistry()
+	reg.LoadDescriptorSet(testDescriptorSet())
+	store := NewCaptureStore(CaptureConfig{})
+	addr := startTestMITM(t, nil, WithCapture(store), WithProtoRegistry(reg))
+
+	body := base64.StdEncoding.EncodeToString(grpcFrame(0, testHelloRequest()))
+	raw := fmt.Sprintf("POST /greet.Greeter/SayHello HTTP/1.1\r\nHost: %s\r\nContent-Type: application/grpc-web-text\r\n"+
+		"Content-Length: %d\r\n\r\n%s", upstream.Listener.Addr(), len(body), body)
+	_, got := doProxyRequest(t, addr, raw)
+	decoded, err := io.ReadAll(&base64Reader{r: strings.NewReader(got)})
+	if err != nil || !bytes.Equal(decoded, append(reply, trailer...)) {
+		t.Fatalf("client received %q (%v)", got, err)
+	}
+
+	g := waitCaptured(t, store, 1)[0].GRPC
+	if g == nil || g.Protocol != "grpc-web-text" || len(g.RequestMessages) != 1 || len(g.ResponseMessages) != 1 {
+		t.Fatalf("captured grpc = %+v", g)
+	}
+	if g.RequestMessages[0].Decoded["name"] != "bob" || g.ResponseMessages[0].Decoded["message"] != "hi bob" {
+		t.Fatalf("decoded = %v / %v", g.RequestMessages[0].Decoded, g.ResponseMessages[0].Decoded)
+	}
+	if g.Status == nil || g.Status.Code != 5 || g.Status.Message != "no such user" {
+		t.Fatalf("status = %+v", g.Status)
+	}
+}
+
+func TestConnectProtocol(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/greet.Greeter/SayHello":
+			var in struct{ Name string }
+			json.Unmarshal(body, &in)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"message":"echo %s"}`, in.Name)
+		case "/greet.Greeter/Missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code":"not_found","message":"gone"}`)
+		case "/greet.Greeter/Stream":
+			w.Header().Set("Content-Type", "application/connect+json")
+			w.Write(grpcFrame(0, []byte(`{"message":"one"}`)))
+			w.Write(grpcFrame(connectEndStreamFlag, []byte(`{"error":{"code":"resource_exhausted","message":"quota"}}`)))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	hook := func(req *http.Request, msg *GRPCMessage) *GRPCMessage {
+		if !msg.Response {
+			msg.Data = []byte(`{"name":"alice"}`)
+		}
+		return msg
+	}
+	store := NewCaptureStore(CaptureConfig{})
+	addr := startTestMITM(t, nil, WithCapture(store), WithGRPCHook(hook))
+	call := func(path, contentType, body string) string {
+		raw := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nContent-Type: %s\r\nConnect-Protocol-Version: 1\r\n"+
+			"Content-Length: %d\r\n\r\n%s", path, upstream.Listener.Addr(), contentType, len(body), body)
+		_, got := doProxyRequest(t, addr, raw)
+		return got
+	}
+
+	if got := call("/greet.Greeter/SayHello", "application/json", `{"name":"bob"}`); got != `{"message":"echo alice"}` {
+		t.Fatalf("unary response = %s", got)
+	}
+	call("/greet.Greeter/Missing", "application/json", `{}`)
+	stream := string(grpcFrame(0, []byte(`{"name":"bob"}`)))
+	if got := call("/greet.Greeter/Stream", "application/connect+json", stream); !strings.Contains(got, `{"message":"one"}`) {
+		t.Fatalf("stream response = %q", got)
+	}
+
+	entries := waitCaptured(t, store, 3)
+	unary, missing, streamed := entries[0].GRPC, entries[1].GRPC, entries[2].GRPC
+	if unary.Protocol != "connect" || unary.RequestMessages[0].Decoded["name"] != "alice" ||
+		unary.ResponseMessages[0].Decoded["message"] != "echo alice" || unary.Status.Code != 0 {
+		t.Fatalf("unary = %+v", unary)
+	}
+	if missing.Status == nil || missing.Status.Code != 5 || missing.Status.Message != "gone" || len(missing.ResponseMessages) != 0 {
+		t.Fatalf("missing = %+v", missing)
+	}
+	if len(streamed.ResponseMessages) != 1 || streamed.Status == nil || streamed.Status.Code != 8 || streamed.Status.Message != "quota" {
+		t.Fatalf("stream = %+v (status %+v)", streamed, streamed.Status)
+	}
+}
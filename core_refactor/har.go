@@ -0,0 +1,371 @@
+package core_refactor
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 是 HTTP Archive 1.2 文档的根对象。
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog 对应 HAR 的 log 对象。
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator 描述生成 HAR 的工具。
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry 对应一次请求/响应交换。
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	// GRPC 是 gRPC 调用的解码结果（HAR 自定义字段）。
+	GRPC *CapturedGRPC `json:"_grpc,omitempty"`
+}
+
+// HARRequest 对应 HAR 的 request 对象。
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse 对应 HAR 的 response 对象。
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	Comment     string         `json:"comment,omitempty"`
+	// Events 是 SSE 事件列表（HAR 自定义字段以下划线开头）。
+	Events []SSEEvent `json:"_events,omitempty"`
+}
+
+// HARNameValue 用于请求头、响应头与查询参数。
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARCookie 对应 HAR 的 cookie 对象。
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+// HARPostData 对应 HAR 的 postData 对象。
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []HARNameValue `json:"params,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+// HARContent 对应 HAR 的 content 对象：Text 为解码（解压）后的内容，
+// 非文本内容以 base64 编码并设置 Encoding。
+type HARContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// HARTimings 对应 HAR 的 timings 对象，单位为毫秒，-1 表示不可用。
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HAR 将满足过滤条件的抓包记录导出为 HAR 1.2 文档。
+func (s *CaptureStore) HAR(f CaptureFilter) *HAR {
+	return BuildHAR(s.Entries(f))
+}
+
+// BuildHAR 将抓包记录转换为 HAR 1.2 文档。
+func BuildHAR(entries []*CapturedExchange) *HAR {
+	h := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "mitm-proxy", Version: "1.0"},
+		Entries: make([]HAREntry, 0, len(entries)),
+	}}
+	for _, e := range entries {
+		h.Log.Entries = append(h.Log.Entries, harEntry(e))
+	}
+	return h
+}
+
+func harEntry(e *CapturedExchange) HAREntry {
+	wait, receive := durationMs(e.Timings.Wait), durationMs(e.Timings.Receive)
+	entry := HAREntry{
+		StartedDateTime: e.StartTime,
+		Time:            wait + receive,
+		Request:         harRequest(&e.Request),
+		Timings:         HARTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: wait, Receive: receive, SSL: -1},
+		Connection:      e.ClientAddr,
+		Comment:         e.Error,
+		GRPC:            e.GRPC,
+	}
+	if e.Response != nil {
+		entry.Response = harResponse(e.Response)
+	} else {
+		// 转发失败时按 HAR 惯例以状态 0 表示没有响应。
+		entry.Response = HARResponse{
+			Cookies:     []HARCookie{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+			Comment:     e.Error,
+		}
+	}
+	return entry
+}
+
+func harRequest(r *CapturedRequest) HARRequest {
+	out := HARRequest{
+		Method:      r.Method,
+		URL:         r.URL,
+		HTTPVersion: harProto(r.Proto),
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+	}
+	if u, err := url.Parse(r.URL); err == nil {
+		for k, vs := range u.Query() {
+			for _, v := range vs {
+				out.QueryString = append(out.QueryString, HARNameValue{Name: k, Value: v})
+			}
+		}
+	}
+	for _, c := range (&http.Request{Header: r.Header}).Cookies() {
+		out.Cookies = append(out.Cookies, HARCookie{Name: c.Name, Value: c.Value})
+	}
+
+	if r.BodySize > 0 || len(r.Body) > 0 {
+		mimeType := r.Header.Get("Content-Type")
+		pd := &HARPostData{MimeType: mimeType, Text: string(r.Body)}
+		if mt, _, _ := mime.ParseMediaType(mimeType); mt == "application/x-www-form-urlencoded" {
+			if form, err := url.ParseQuery(string(r.Body)); err == nil {
+				for k, vs := range form {
+					for _, v := range vs {
+						pd.Params = append(pd.Params, HARNameValue{Name: k, Value: v})
+					}
+				}
+			}
+		}
+		if r.Truncated {
+			pd.Comment = fmt.Sprintf("truncated: %d of %d bytes captured", len(r.Body), r.BodySize)
+		}
+		out.PostData = pd
+	}
+	return out
+}
+
+func harResponse(r *CapturedResponse) HARResponse {
+	out := HARResponse{
+		Status:      r.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(r.Status, fmt.Sprint(r.StatusCode))),
+		HTTPVersion: harProto(r.Proto),
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(r.Header),
+		RedirectURL: r.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+		Content:     harContent(r),
+		Events:      r.Events,
+	}
+	for _, c := range (&http.Response{Header: r.Header}).Cookies() {
+		hc := HARCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			exp := c.Expires
+			hc.Expires = &exp
+		}
+		out.Cookies = append(out.Cookies, hc)
+	}
+	return out
+}
+
+// harContent 解压响应体并按文本或 base64 填充 content，size 为解码后的长度，
+// compression 为节省的字节数。
+func harContent(r *CapturedResponse) HARContent {
+	c := HARContent{MimeType: r.Header.Get("Content-Type"), Size: r.BodySize}
+	body := r.Body
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" {
+		decoded, err := decodeContent(encoding, body)
+		switch {
+		case r.Truncated:
+			c.Comment = fmt.Sprintf("truncated: %d of %d bytes captured, content left %s-encoded", len(body), r.BodySize, encoding)
+			c.Text, c.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+			return c
+		case err != nil:
+			c.Comment = fmt.Sprintf("cannot decode %s content: %v", encoding, err)
+			c.Text, c.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+			return c
+		}
+		body = decoded
+		c.Size = int64(len(decoded))
+		c.Compression = c.Size - r.BodySize
+	} else if r.Truncated {
+		c.Comment = fmt.Sprintf("truncated: %d of %d bytes captured", len(body), r.BodySize)
+	}
+
+	if isTextContent(c.MimeType, body) {
+		c.Text = string(body)
+	} else if len(body) > 0 {
+		c.Text, c.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return c
+}
+
+// decodeContent 按 Content-Encoding 解压消息体，支持 gzip 与 deflate。
+func decodeContent(encoding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case "deflate":
+		// 兼容 zlib 封装与裸 deflate 两种常见实现。
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return io.ReadAll(r)
+}
+
+func isTextContent(mimeType string, body []byte) bool {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "json"), strings.HasSuffix(mt, "+json"),
+		strings.HasSuffix(mt, "xml"), strings.HasSuffix(mt, "javascript"),
+		mt == "application/x-www-form-urlencoded":
+		return true
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "audio/"),
+		strings.HasPrefix(mt, "video/"), mt == "application/octet-stream":
+		return false
+	}
+	return utf8.Valid(body)
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	out := make([]HARNameValue, 0, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			out = append(out, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return out
+}
+
+func harProto(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// handleHAR 导出 HAR（GET，可用 host、since、until 查询参数过滤，时间为 RFC3339）
+// 或清空抓包记录（DELETE）。
+func (m *MITM) handleHAR(w http.ResponseWriter, r *http.Request) {
+	if m.capture == nil {
+		http.Error(w, "capture is disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		f := CaptureFilter{Host: q.Get("host")}
+		for _, p := range []struct {
+			name string
+			dst  *time.Time
+		}{{"since", &f.Since}, {"until", &f.Until}} {
+			if v := q.Get(p.name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("bad %s: %v", p.name, err), http.StatusBadRequest)
+					return
+				}
+				*p.dst = t
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="capture.har"`)
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(m.capture.HAR(f))
+	case http.MethodDelete:
+		m.capture.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
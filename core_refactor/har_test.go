@@ -0,0 +1,120 @@
+package core_refactor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureHAR(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(`{"ok":true}`))
+		zw.Close()
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "abc", Path: "/", HttpOnly: true})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(upstream.Close)
+	host := upstream.Listener.Addr().String()
+
+	store := NewCaptureStore(CaptureConfig{})
+	addr := startTestMITM(t, nil, WithCapture(store))
+
+	form := "a=1&b=two"
+	doProxyRequest(t, addr, fmt.Sprintf("POST /submit?x=1 HTTP/1.1\r\nHost: %s\r\nCookie: k=v\r\n"+
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\n\r\n%s", host, len(form), form))
+
+	var entries []*CapturedExchange
+	for i := 0; i < 100 && len(entries) == 0; i++ {
+		entries = store.Entries(CaptureFilter{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	h := BuildHAR(entries)
+	if len(h.Log.Entries) != 1 || h.Log.Version != "1.2" {
+		t.Fatalf("har = %+v", h.Log)
+	}
+	e := h.Log.Entries[0]
+
+	req := e.Request
+	if req.Method != "POST" || req.URL != fmt.Sprintf("http://%s/submit?x=1", host) || req.BodySize != int64(len(form)) {
+		t.Fatalf("request = %+v", req)
+	}
+	if len(req.QueryString) != 1 || req.QueryString[0] != (HARNameValue{"x", "1"}) {
+		t.Fatalf("query = %+v", req.QueryString)
+	}
+	if len(req.Cookies) != 1 || req.Cookies[0].Name != "k" {
+		t.Fatalf("request cookies = %+v", req.Cookies)
+	}
+	if req.PostData == nil || req.PostData.Text != form || len(req.PostData.Params) != 2 {
+		t.Fatalf("post data = %+v", req.PostData)
+	}
+
+	resp := e.Response
+	if resp.Status != 200 || resp.StatusText != "OK" || len(resp.Cookies) != 1 || !resp.Cookies[0].HTTPOnly {
+		t.Fatalf("response = %+v", resp)
+	}
+	c := resp.Content
+	if c.Text != `{"ok":true}` || c.Size != 11 || c.Compression != 11-resp.BodySize || c.Encoding != "" {
+		t.Fatalf("content = %+v (bodySize %d)", c, resp.BodySize)
+	}
+	if e.Timings.Wait < 0 || e.Timings.DNS != -1 || e.Time != e.Timings.Wait+e.Timings.Receive {
+		t.Fatalf("timings = %+v", e.Timings)
+	}
+
+	if got := store.Entries(CaptureFilter{Host: "example.*"}); len(got) != 0 {
+		t.Fatalf("host filter matched %d entries", len(got))
+	}
+	if got := store.Entries(CaptureFilter{Since: time.Now().Add(time.Minute)}); len(got) != 0 {
+		t.Fatalf("since filter matched %d entries", len(got))
+	}
+
+	hresp, body := doProxyRequest(t, addr, fmt.Sprintf("GET %s?host=127.0.0.1 HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", RouteHAR, managePort(addr)))
+	var doc HAR
+	if err := json.Unmarshal([]byte(body), &doc); err != nil || hresp.StatusCode != 200 || len(doc.Log.Entries) != 1 {
+		t.Fatalf("management har: %d %v %s", hresp.StatusCode, err, body)
+	}
+}
+
+func TestCaptureStoreRing(t *testing.T) {
+	s := NewCaptureStore(CaptureConfig{MaxEntries: 2})
+	for i := 1; i <= 3; i++ {
+		s.Add(&CapturedExchange{FlowID: uint64(i), Request: CapturedRequest{URL: "http://a.test/"}})
+	}
+	got := s.Entries(CaptureFilter{Host: "A.TEST"})
+	if len(got) != 2 || got[0].FlowID != 2 || got[1].FlowID != 3 {
+		t.Fatalf("entries = %+v", got)
+	}
+	s.Clear()
+	if len(s.Entries(CaptureFilter{})) != 0 {
+		t.Fatal("Clear did not remove entries")
+	}
+}
+
+func TestHARContentBinaryAndTruncated(t *testing.T) {
+	c := harContent(&CapturedResponse{
+		Header: http.Header{"Content-Type": {"image/png"}},
+		Body:   []byte{0x89, 'P', 'N', 'G'},
+	})
+	if c.Encoding != "base64" || c.Text != "iVBORw==" {
+		t.Fatalf("binary content = %+v", c)
+	}
+
+	c = harContent(&CapturedResponse{
+		Header:    http.Header{"Content-Type": {"text/plain"}},
+		Body:      []byte("abc"),
+		BodySize:  10,
+		Truncated: true,
+	})
+	if c.Text != "abc" || c.Size != 10 || !strings.Contains(c.Comment, "truncated") {
+		t.Fatalf("truncated content = %+v", c)
+	}
+}
@@ -0,0 +1,205 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostsResolver 是 hosts 文件风格的 DNS 覆盖表，支持精确域名与 "*.example.com" 通配条目，
+// 可从文件加载并通过 Watch 热重载。通配条目匹配所有子域名（不含根域名本身），
+// 多个通配条目同时命中时取后缀最长者。
+type HostsResolver struct {
+	mu       sync.RWMutex
+	exact    map[string]string
+	wildcard map[string]string // 后缀（含前导点） -> IP
+	path     string
+	modTime  time.Time
+}
+
+// NewHostsResolver 创建一个空的解析表。
+func NewHostsResolver() *HostsResolver {
+	return &HostsResolver{
+		exact:    make(map[string]string),
+		wildcard: make(map[string]string),
+	}
+}
+
+// LoadHostsFile 从 hosts 格式的文件加载解析表：每行 "IP 域名 [域名...]"，# 之后为注释。
+func LoadHostsFile(path string) (*HostsResolver, error) {
+	r := NewHostsResolver()
+	r.path = path
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload 重新读取关联的 hosts 文件，整体替换现有条目。
+func (r *HostsResolver) Reload() error {
+	r.mu.RLock()
+	path := r.path
+	r.mu.RUnlock()
+	if path == "" {
+		return fmt.Errorf("hosts resolver has no file")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat hosts %q: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read hosts %q: %w", path, err)
+	}
+	exact, wildcard, err := parseHosts(data)
+	if err != nil {
+		return fmt.Errorf("parse hosts %q: %w", path, err)
+	}
+
+	r.mu.Lock()
+	r.exact = exact
+	r.wildcard = wildcard
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch 以轮询方式监听 hosts 文件变更，变更时调用 Reload；关闭 stop 后退出。
+func (r *HostsResolver) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.mu.RLock()
+			path, modTime := r.path, r.modTime
+			r.mu.RUnlock()
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(modTime) {
+				continue
+			}
+			// 解析失败时保留旧条目，等待下一次修改。
+			_ = r.Reload()
+		}
+	}
+}
+
+func parseHosts(data []byte) (map[string]string, map[string]string, error) {
+	exact := make(map[string]string)
+	wildcard := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, nil, fmt.Errorf("line %d: missing host name", lineNo)
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return nil, nil, fmt.Errorf("line %d: invalid ip %q", lineNo, fields[0])
+		}
+		for _, host := range fields[1:] {
+			addHostsEntry(exact, wildcard, host, fields[0])
+		}
+	}
+	return exact, wildcard, sc.Err()
+}
+
+func addHostsEntry(exact, wildcard map[string]string, host, ip string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(host, "*.") {
+		wildcard[host[1:]] = ip
+		return
+	}
+	exact[host] = ip
+}
+
+// Set 添加或替换一条覆盖记录；host 可以是 "*.example.com" 形式的通配条目。
+func (r *HostsResolver) Set(host, ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	r.mu.Lock()
+	addHostsEntry(r.exact, r.wildcard, host, ip)
+	r.mu.Unlock()
+	return nil
+}
+
+// Remove 删除一条覆盖记录。
+func (r *HostsResolver) Remove(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	if strings.HasPrefix(host, "*.") {
+		delete(r.wildcard, host[1:])
+	} else {
+		delete(r.exact, host)
+	}
+	r.mu.Unlock()
+}
+
+// Lookup 返回 host 的覆盖 IP；未命中时 ok 为 false。
+func (r *HostsResolver) Lookup(host string) (ip string, ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if ip, ok := r.exact[host]; ok {
+		return ip, true
+	}
+	best := ""
+	for suffix, v := range r.wildcard {
+		if strings.HasSuffix(host, suffix) && len(suffix) > len(best) {
+			best, ip = suffix, v
+		}
+	}
+	return ip, best != ""
+}
+
+// Entries 返回当前所有条目（通配条目以 "*." 开头），按域名排序。
+func (r *HostsResolver) Entries() [][2]string {
+	r.mu.RLock()
+	out := make([][2]string, 0, len(r.exact)+len(r.wildcard))
+	for h, ip := range r.exact {
+		out = append(out, [2]string{h, ip})
+	}
+	for s, ip := range r.wildcard {
+		out = append(out, [2]string{"*" + s, ip})
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// Dialer 返回一个包装 next 的拨号函数：命中覆盖表的域名改为拨号到对应 IP，端口保持不变。
+func (r *HostsResolver) Dialer(next DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := r.Lookup(host); ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return next(ctx, network, addr)
+	}
+}
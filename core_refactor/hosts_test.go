@@ -0,0 +1,101 @@
+package core_refactor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostsResolverLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := "# staging\n10.0.0.1 api.example.com\n10.0.0.2 *.example.com\n10.0.0.3 *.cdn.example.com other.test # trailing\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write hosts: %v", err)
+	}
+	r, err := LoadHostsFile(path)
+	if err != nil {
+		t.Fatalf("LoadHostsFile: %v", err)
+	}
+
+	cases := map[string]string{
+		"api.example.com":     "10.0.0.1",
+		"www.example.com":     "10.0.0.2",
+		"img.cdn.example.com": "10.0.0.3",
+		"OTHER.test.":         "10.0.0.3",
+		"example.com":         "",
+		"unrelated.org":       "",
+	}
+	for host, want := range cases {
+		got, ok := r.Lookup(host)
+		if ok != (want != "") || got != want {
+			t.Fatalf("Lookup(%q) = %q, %v; want %q", host, got, ok, want)
+		}
+	}
+
+	if _, _, err := parseHosts([]byte("not-an-ip host\n")); err == nil {
+		t.Fatal("expected parse error for invalid ip")
+	}
+}
+
+func TestHostsResolverWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(path, []byte("10.0.0.1 a.test\n"), 0644)
+	r, err := LoadHostsFile(path)
+	if err != nil {
+		t.Fatalf("LoadHostsFile: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(10*time.Millisecond, stop)
+
+	os.WriteFile(path, []byte("10.0.0.9 a.test\n"), 0644)
+	future := time.Now().Add(time.Second)
+	os.Chtimes(path, future, future)
+
+	for i := 0; i < 100; i++ {
+		if ip, _ := r.Lookup("a.test"); ip == "10.0.0.9" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("hosts file change was not reloaded")
+}
+
+// TestWithHostsKeepsHostHeader 验证 DNS 覆盖只改变拨号地址，转发的 Host 头保持原始域名。
+func TestWithHostsKeepsHostHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	hosts := NewHostsResolver()
+	hosts.Set("*.staging.test", "127.0.0.1")
+
+	var dials atomic.Int32
+	base := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	addr := startTestMITM(t, nil, WithDialer(base), WithHosts(hosts))
+
+	host := net.JoinHostPort("api.staging.test", port)
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body = %q", resp.StatusCode, body)
+	}
+	if body != host {
+		t.Fatalf("upstream saw Host %q, want %q", body, host)
+	}
+	if dials.Load() != 1 {
+		t.Fatalf("custom dialer calls = %d, want 1", dials.Load())
+	}
+}
@@ -0,0 +1,123 @@
+package core_refactor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostPortIPv6(t *testing.T) {
+	for _, c := range []struct {
+		in, host, port string
+	}{
+		{"[::1]:8080", "::1", "8080"},
+		{"[::1]", "::1", "80"},
+		{"example.com", "example.com", "80"},
+		{"10.0.0.1:81", "10.0.0.1", "81"},
+	} {
+		if h, p := hostPort(c.in, false); h != c.host || p != c.port {
+			t.Errorf("hostPort(%q) = %q, %q", c.in, h, p)
+		}
+	}
+	for in, want := range map[string]string{
+		"[::1]":        "[::1]:443",
+		"::1":          "[::1]:443",
+		"[::1]:8443":   "[::1]:8443",
+		"example.com":  "example.com:443",
+		"1.2.3.4:8443": "1.2.3.4:8443",
+	} {
+		if got := withPort(in, "443"); got != want {
+			t.Errorf("withPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for in, want := range map[string]string{
+		"[0:0:0:0:0:0:0:1]": "::1",
+		"fe80::1%eth0":      "fe80::1",
+		"::ffff:127.0.0.1":  "127.0.0.1",
+		"LocalHost":         "localhost",
+	} {
+		if got := canonicalHost(in); got != want {
+			t.Errorf("canonicalHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	ips, err := localIPs()
+	if err != nil {
+		t.Fatalf("localIPs: %v", err)
+	}
+	if _, ok := ips["::1"]; !ok {
+		t.Fatal("localIPs must include ::1")
+	}
+}
+
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	return ln
+}
+
+func TestIPv6EndToEnd(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v6 "+r.Host)
+	}))
+	upstream.Listener = listenIPv6(t)
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	plain := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain")
+	}))
+	plain.Listener = listenIPv6(t)
+	plain.Start()
+	t.Cleanup(plain.Close)
+
+	addr := startTestMITMAt(t, "[::1]:0", nil)
+
+	// 明文请求：绝对 URL 中的 IPv6 字面量。
+	target := plain.Listener.Addr().String()
+	if _, body := doProxyRequest(t, addr, fmt.Sprintf("GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)); body != "plain" {
+		t.Fatalf("plain body = %q", body)
+	}
+
+	// 管理请求：发往 [::1]:<监听端口> 的请求由代理自身处理。
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: [::1]:%s\r\n\r\n", RouteProfiles, managePort(addr)))
+	if resp.StatusCode != http.StatusOK || body != "[]" {
+		t.Fatalf("manage over ::1 = %d %q", resp.StatusCode, body)
+	}
+
+	// CONNECT 到带方括号的 IPv6 字面量，叶子证书以 IP SAN 签发。
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	target = upstream.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	leaf := tc.ConnectionState().PeerCertificates[0]
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.IPv6loopback) || len(leaf.DNSNames) != 0 {
+		t.Fatalf("leaf SANs: ip=%v dns=%v", leaf.IPAddresses, leaf.DNSNames)
+	}
+	fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", target)
+	resp, err = http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatalf("tunnelled request: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if string(got) != "v6 "+target {
+		t.Fatalf("tunnelled body = %q", got)
+	}
+}
@@ -0,0 +1,342 @@
+package core_refactor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat 是访问日志的行格式。
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon 为 NCSA Common Log Format。
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined 在 Common 基础上追加 Referer 与 User-Agent。
+	AccessLogCombined
+	// AccessLogJSON 每行输出一个 AccessLogEntry 的 JSON 对象。
+	AccessLogJSON
+)
+
+// ParseAccessLogFormat 解析 common、combined、json（不区分大小写）。
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch strings.ToLower(s) {
+	case "common", "clf":
+		return AccessLogCommon, nil
+	case "combined":
+		return AccessLogCombined, nil
+	case "json":
+		return AccessLogJSON, nil
+	}
+	return 0, fmt.Errorf("unknown access log format %q", s)
+}
+
+// AccessLogEntry 是一次已写回客户端的请求的访问日志记录。
+type AccessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	FlowID    uint64        `json:"flow_id"`
+	Client    string        `json:"client"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	Host      string        `json:"host"`
+	URL       string        `json:"url"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// MarshalJSON 将耗时输出为毫秒数。
+func (e AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type plain AccessLogEntry
+	return json.Marshal(struct {
+		plain
+		DurationMS float64 `json:"duration_ms"`
+	}{plain(e), float64(e.Duration) / float64(time.Millisecond)})
+}
+
+// accessLogger 按指定格式逐行写出访问日志，写入串行化。
+type accessLogger struct {
+	w      io.Writer
+	format AccessLogFormat
+	mu     sync.Mutex
+}
+
+func (a *accessLogger) log(e *AccessLogEntry) {
+	if a == nil {
+		return
+	}
+	var line []byte
+	switch a.format {
+	case AccessLogJSON:
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(data, '\n')
+	default:
+		line = appendCommonLog(nil, e, a.format == AccessLogCombined)
+	}
+	a.mu.Lock()
+	a.w.Write(line)
+	a.mu.Unlock()
+}
+
+// appendCommonLog 追加一行 Common / Combined 格式日志；代理场景下请求行使用绝对 URL。
+func appendCommonLog(b []byte, e *AccessLogEntry, combined bool) []byte {
+	host, _, err := net.SplitHostPort(e.Client)
+	if err != nil {
+		host = e.Client
+	}
+	b = append(b, clfField(host)...)
+	b = append(b, " - "...)
+	b = append(b, clfField(e.User)...)
+	b = append(b, " ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, e.Method+" "+e.URL+" "+e.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.Bytes > 0 {
+		b = strconv.AppendInt(b, e.Bytes, 10)
+	} else {
+		b = append(b, '-')
+	}
+	if combined {
+		b = append(b, ' ')
+		b = strconv.AppendQuote(b, e.Referer)
+		b = append(b, ' ')
+		b = strconv.AppendQuote(b, e.UserAgent)
+	}
+	return append(b, '\n')
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "_")
+}
+
+// RotatingFile 是按大小滚动的日志文件：写入将超过 MaxSize 时，当前文件依次重命名为
+// path.1、path.2……（最多保留 maxBackups 个），再重新创建 path。可安全并发写入。
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile 以追加方式打开 path。maxSize<=0 表示不按大小滚动（仍可调用 Rotate），
+// maxBackups<=0 时保留 5 个历史文件。
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxBackups <= 0 {
+		maxBackups = 5
+	}
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write 写入 p；p 不会跨文件拆分。
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate 立即滚动当前文件，可用于响应 SIGHUP 等外部信号。
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	return r.rotate()
+}
+
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(r.backup(r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(r.backup(i), r.backup(i+1))
+	}
+	if err := os.Rename(r.path, r.backup(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) backup(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// Close 关闭当前文件。
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// stdLogWriter 将 slog 文本输出逐行转交给 *log.Logger，保留其前缀与时间格式。
+type stdLogWriter struct {
+	l *log.Logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.Print(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// slogFromStd 把传统 *log.Logger 包装为 Info 级别的 slog.Logger；nil 表示关闭日志。
+func slogFromStd(l *log.Logger) *slog.Logger {
+	if l == nil {
+		return slog.New(discardHandler{})
+	}
+	return slog.New(slog.NewTextHandler(stdLogWriter{l}, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{} // 时间由 *log.Logger 输出
+			}
+			return a
+		},
+	}))
+}
+
+// discardHandler 丢弃所有日志记录。
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
+
+// flowLog 返回附带请求 Flow 属性（flow、client、host）的日志器。
+func (m *MITM) flowLog(req *http.Request) *slog.Logger {
+	l := m.logger
+	if f := FlowFromRequest(req); f != nil {
+		l = l.With("flow", f.ID, "client", f.ClientAddr)
+		if f.User != "" {
+			l = l.With("user", f.User)
+		}
+	}
+	return l.With("host", req.Host)
+}
+
+// finishRequest 在响应写回客户端后记录指标、结构化日志与访问日志。
+func (m *MITM) finishRequest(req *http.Request, status int, bytes int64, err error) {
+	m.metrics.request(req, status)
+	f := FlowFromRequest(req)
+	var (
+		start        = time.Now()
+		dur          time.Duration
+		client, user string
+		id           uint64
+	)
+	if f != nil {
+		start, client, user, id = f.StartTime, f.ClientAddr, f.User, f.ID
+		dur = time.Since(start)
+	}
+	if m.logger.Enabled(req.Context(), slog.LevelInfo) {
+		attrs := []slog.Attr{
+			slog.Uint64("flow", id),
+			slog.String("client", client),
+			slog.String("host", req.Host),
+			slog.String("method", req.Method),
+			slog.String("url", req.URL.String()),
+			slog.Int("status", status),
+			slog.Duration("duration", dur),
+			slog.Int64("bytes", bytes),
+		}
+		if user != "" {
+			attrs = append(attrs, slog.String("user", user))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		m.logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+	}
+	if m.accessLog == nil {
+		return
+	}
+	e := &AccessLogEntry{
+		Time:      start,
+		FlowID:    id,
+		Client:    client,
+		User:      user,
+		Method:    req.Method,
+		Host:      req.Host,
+		URL:       req.URL.String(),
+		Proto:     req.Proto,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  dur,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	m.accessLog.log(e)
+}
+
+// countingBody 统计经过的响应体字节数。
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
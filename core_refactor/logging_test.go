@@ -0,0 +1,117 @@
+package core_refactor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer 是可并发写入的 bytes.Buffer。
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitLines 等待 b 中出现至少 n 行。
+func waitLines(t *testing.T, b *syncBuffer, n int) []string {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if lines := strings.Split(strings.TrimSpace(b.String()), "\n"); b.String() != "" && len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d lines, got %q", n, b.String())
+	return nil
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(upstream.Close)
+
+	var combined, jsonl, structured syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&structured, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	addr := startTestMITM(t, nil, WithSlog(logger), WithAccessLog(&combined, AccessLogCombined))
+	raw := fmt.Sprintf("GET http://%s/path?q=1 HTTP/1.1\r\nHost: %s\r\nReferer: http://ref/\r\nUser-Agent: test-agent\r\n\r\n",
+		upstream.Listener.Addr(), upstream.Listener.Addr())
+	doProxyRequest(t, addr, raw)
+
+	line := waitLines(t, &combined, 1)[0]
+	pattern := `^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET http://` + regexp.QuoteMeta(upstream.Listener.Addr().String()) +
+		`/path\?q=1 HTTP/1\.1" 200 5 "http://ref/" "test-agent"$`
+	if !regexp.MustCompile(pattern).MatchString(line) {
+		t.Fatalf("combined line = %q", line)
+	}
+
+	var rec map[string]interface{}
+	for _, l := range waitLines(t, &structured, 1) {
+		json.Unmarshal([]byte(l), &rec)
+		if rec["msg"] == "request" {
+			break
+		}
+	}
+	if rec["msg"] != "request" || rec["status"] != float64(200) || rec["bytes"] != float64(5) || rec["flow"] == nil || rec["client"] == "" {
+		t.Fatalf("structured record = %v", rec)
+	}
+
+	a := &accessLogger{w: &jsonl, format: AccessLogJSON}
+	a.log(&AccessLogEntry{FlowID: 7, Client: "10.0.0.1:5", Method: "GET", URL: "http://x/", Status: 404, Duration: 1500 * time.Microsecond})
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonl.String()), &entry); err != nil {
+		t.Fatalf("json line %q: %v", jsonl.String(), err)
+	}
+	if entry["flow_id"] != float64(7) || entry["status"] != float64(404) || entry["duration_ms"] != 1.5 {
+		t.Fatalf("json entry = %v", entry)
+	}
+
+	if f, err := ParseAccessLogFormat("JSON"); err != nil || f != AccessLogJSON {
+		t.Fatalf("ParseAccessLogFormat = %v, %v", f, err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+	defer r.Close()
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := io.WriteString(r, s); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for name, want := range map[string]string{path: "dddddd\n", path + ".1": "cccccc\n", path + ".2": "bbbbbb\n"} {
+		if got, _ := os.ReadFile(name); string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups")
+	}
+}
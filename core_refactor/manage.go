@@ -0,0 +1,60 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// 内置管理接口路径，均以 /mitm/ 为前缀；调用方通过 HandleFunc 注册同名路径即可覆盖。
+const (
+	RouteUpstreams   = "/mitm/upstreams"
+	RouteNetsim      = "/mitm/netsim"
+	RouteFaults      = "/mitm/faults"
+	RouteRules       = "/mitm/rules"
+	RouteBreakpoints = "/mitm/breakpoints"
+	RouteHAR         = "/mitm/har"
+	RouteReplay      = "/mitm/replay"
+	RouteRecorder    = "/mitm/recorder"
+	RouteWebSockets  = "/mitm/websockets"
+	RouteMetrics     = "/mitm/metrics"
+	RouteProfile     = "/mitm/profile"
+	RouteProfiles    = "/mitm/profiles"
+	RouteACL         = "/mitm/acl"
+)
+
+// registerBuiltinRoutes 注册核心内置的管理接口。
+func (m *MITM) registerBuiltinRoutes() {
+	m.manageRouter[RouteUpstreams] = m.handleUpstreams
+	m.manageRouter[RouteNetsim] = m.handleNetsim
+	m.manageRouter[RouteFaults] = m.handleFaults
+	m.manageRouter[RouteRules] = m.handleRules
+	m.manageRouter[RouteBreakpoints] = m.handleBreakpoints
+	m.manageRouter[RouteHAR] = m.handleHAR
+	m.manageRouter[RouteReplay] = m.handleReplay
+	m.manageRouter[RouteRecorder] = m.handleRecorder
+	m.manageRouter[RouteWebSockets] = m.handleWebSockets
+	m.manageRouter[RouteMetrics] = m.handleMetrics
+	m.manageRouter[RouteProfile] = m.handleProfile
+	m.manageRouter[RouteProfiles] = m.handleProfiles
+	m.manageRouter[RouteACL] = m.handleACL
+}
+
+// handleUpstreams 返回上游健康状况与连接池统计。
+func (m *MITM) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"upstreams": m.UpstreamHealth(),
+		"pool":      m.PoolStats(),
+	})
+}
+
+// writeJSON 以 JSON 格式写出响应。
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
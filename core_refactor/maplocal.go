@@ -0,0 +1,219 @@
+package core_refactor
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MapLocalRule 将匹配的 URL 前缀映射到本地目录，由代理直接以本地文件响应。
+type MapLocalRule struct {
+	// Host 主机名 glob（path.Match 语法），空表示匹配全部主机。
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// Prefix URL 路径前缀（按路径段匹配，/static 不命中 /staticfoo），去掉前缀后的剩余部分拼接到 Dir 下；空表示 "/"。
+	Prefix string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Dir 本地根目录；也可以是单个文件，此时所有匹配的请求都返回该文件。
+	Dir string `json:"dir" yaml:"dir"`
+	// Index 访问目录时依次尝试的索引文件，默认 index.html。
+	Index []string `json:"index,omitempty" yaml:"index,omitempty"`
+	// NoCache 为 true 时忽略请求中的条件/缓存头并禁止浏览器缓存，保证每次拿到最新的本地文件。
+	NoCache bool `json:"noCache,omitempty" yaml:"noCache,omitempty"`
+}
+
+// Match 判断请求是否命中该规则。
+func (r MapLocalRule) Match(req *http.Request) bool {
+	if r.Host != "" {
+		host, _ := hostPort(req.Host, false)
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	// 前缀按路径段匹配：/static 命中 /static 与 /static/...，不命中 /staticfoo。
+	prefix := r.prefix()
+	rest, ok := strings.CutPrefix(req.URL.Path, prefix)
+	return ok && (rest == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/')
+}
+
+func (r MapLocalRule) prefix() string {
+	if r.Prefix == "" {
+		return "/"
+	}
+	return r.Prefix
+}
+
+// Serve 以本地文件响应请求；文件不存在时返回 404 响应。
+func (r MapLocalRule) Serve(req *http.Request) *http.Response {
+	rest := strings.TrimPrefix(req.URL.Path, r.prefix())
+	return serveLocal(req, r.Dir, rest, r.Index, r.NoCache, nil)
+}
+
+// ServeLocalFile 以单个本地文件响应请求，支持 MIME 推断、Range 与条件请求。
+// header 中的字段会附加到响应头，可用于覆盖 Content-Type 等。
+func ServeLocalFile(req *http.Request, file string, header http.Header) *http.Response {
+	return serveLocal(req, file, "", nil, false, header)
+}
+
+// ServeLocalDir 将请求路径映射到本地目录 dir 下并以对应文件响应。
+func ServeLocalDir(req *http.Request, dir string, header http.Header) *http.Response {
+	return serveLocal(req, dir, req.URL.Path, nil, false, header)
+}
+
+func serveLocal(req *http.Request, root, rest string, index []string, noCache bool, header http.Header) *http.Response {
+	name, info, err := resolveLocal(root, rest, index)
+	if err != nil {
+		return textResponse(req, http.StatusNotFound, fmt.Sprintf("map local: %s not found", req.URL.Path))
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return textResponse(req, http.StatusNotFound, fmt.Sprintf("map local: %v", err))
+	}
+
+	r := req
+	if noCache {
+		r = req.Clone(req.Context())
+		for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+			r.Header.Del(h)
+		}
+	}
+
+	w := newPipeResponseWriter()
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	modTime := info.ModTime()
+	if noCache {
+		w.Header().Set("Cache-Control", "no-store")
+		// 零值时间使 ServeContent 不输出 Last-Modified，也不处理 If-Modified-Since。
+		modTime = time.Time{}
+	} else {
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	}
+	// ServeContent 在后台写入管道，响应体边读边发，不在内存中缓存整个文件；
+	// 下游关闭响应体后写入失败，goroutine 随之退出并关闭文件。
+	go func() {
+		defer f.Close()
+		http.ServeContent(w, r, info.Name(), modTime, f)
+		w.commit()
+		w.pw.Close()
+	}()
+	return w.response(req)
+}
+
+// resolveLocal 将请求的剩余路径安全地解析到 root 下的文件，目录则尝试索引文件。
+func resolveLocal(root, rest string, index []string) (string, os.FileInfo, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", nil, err
+	}
+	name := root
+	if info.IsDir() {
+		// 先按 URL 语义清理，确保无法通过 ../ 逃逸出根目录。
+		clean := path.Clean("/" + rest)
+		name = filepath.Join(root, filepath.FromSlash(clean))
+		info, err = os.Stat(name)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if !info.IsDir() {
+		return name, info, nil
+	}
+
+	if len(index) == 0 {
+		index = []string{"index.html"}
+	}
+	for _, idx := range index {
+		p := filepath.Join(name, idx)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, fi, nil
+		}
+	}
+	return "", nil, os.ErrNotExist
+}
+
+// textResponse 构造一个纯文本短路响应。
+func textResponse(req *http.Request, code int, msg string) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+	}
+}
+
+// pipeResponseWriter 是一个通过管道输出响应体的 http.ResponseWriter，
+// 用于把标准 handler 的输出以流式 *http.Response 的形式返回。
+type pipeResponseWriter struct {
+	header http.Header
+	status int
+	pr     *io.PipeReader
+	pw     *io.PipeWriter
+
+	once   sync.Once
+	ready  chan struct{}
+	frozen http.Header
+}
+
+func newPipeResponseWriter() *pipeResponseWriter {
+	pr, pw := io.Pipe()
+	return &pipeResponseWriter{header: make(http.Header), pr: pr, pw: pw, ready: make(chan struct{})}
+}
+
+func (w *pipeResponseWriter) Header() http.Header { return w.header }
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.commit()
+	return w.pw.Write(p)
+}
+
+// commit 固定状态码与响应头并通知 response 返回，仅首次调用生效。
+func (w *pipeResponseWriter) commit() {
+	w.once.Do(func() {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.frozen = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+// response 等待 handler 给出响应头后构造 *http.Response，响应体为管道的读端。
+func (w *pipeResponseWriter) response(req *http.Request) *http.Response {
+	<-w.ready
+	header := w.frozen
+	length := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		length, _ = strconv.ParseInt(cl, 10, 64)
+	}
+	if w.status == http.StatusNotModified || w.status == http.StatusNoContent {
+		length = 0
+	}
+	header.Del("Content-Length")
+	return &http.Response{
+		StatusCode:    w.status,
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          w.pr,
+		ContentLength: length,
+	}
+}
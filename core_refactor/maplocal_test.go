@@ -0,0 +1,146 @@
+package core_refactor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newMapLocalDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<html>docs</html>"), 0644)
+	return dir
+}
+
+func serveMapLocal(t *testing.T, rule MapLocalRule, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if !rule.Match(req) {
+		t.Fatalf("rule does not match %s", path)
+	}
+	resp := rule.Serve(req)
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestMapLocalServe(t *testing.T) {
+	rule := MapLocalRule{Prefix: "/static/", Dir: newMapLocalDir(t)}
+
+	resp, body := serveMapLocal(t, rule, "/static/app.js", nil)
+	if resp.StatusCode != http.StatusOK || body != "console.log(1)" {
+		t.Fatalf("app.js: %d %q", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/javascript; charset=utf-8" {
+		t.Fatalf("content type = %q", ct)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+
+	resp, _ = serveMapLocal(t, rule, "/static/app.js", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional status = %d, want 304", resp.StatusCode)
+	}
+
+	resp, body = serveMapLocal(t, rule, "/static/app.js", http.Header{"Range": {"bytes=0-6"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "console" {
+		t.Fatalf("range: %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = serveMapLocal(t, rule, "/static/docs/", nil)
+	if resp.StatusCode != http.StatusOK || body != "<html>docs</html>" {
+		t.Fatalf("index: %d %q", resp.StatusCode, body)
+	}
+
+	for _, p := range []string{"/static/missing.js", "/static/../../etc/passwd"} {
+		if resp, _ := serveMapLocal(t, rule, p, nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s status = %d, want 404", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestMapLocalPrefixBoundary(t *testing.T) {
+	rule := MapLocalRule{Prefix: "/static", Dir: newMapLocalDir(t)}
+	for path, want := range map[string]bool{
+		"/static":           true,
+		"/static/app.js":    true,
+		"/staticfoo/app.js": false,
+		"/stat":             false,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		if got := rule.Match(req); got != want {
+			t.Errorf("Match(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if resp, body := serveMapLocal(t, rule, "/static/app.js", nil); resp.StatusCode != http.StatusOK || body != "console.log(1)" {
+		t.Fatalf("/static/app.js: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestMapLocalNoCache(t *testing.T) {
+	rule := MapLocalRule{Dir: newMapLocalDir(t), NoCache: true}
+	resp, body := serveMapLocal(t, rule, "/app.js", http.Header{"If-None-Match": {"*"}})
+	if resp.StatusCode != http.StatusOK || body != "console.log(1)" {
+		t.Fatalf("status = %d body = %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" {
+		t.Fatalf("unexpected caching headers: %v", resp.Header)
+	}
+}
+
+func TestWithMapLocal(t *testing.T) {
+	addr := startTestMITM(t, nil, WithMapLocal(MapLocalRule{Host: "cdn.test", Prefix: "/assets/", Dir: newMapLocalDir(t)}))
+
+	resp, body := doProxyRequest(t, addr, "GET /assets/app.js HTTP/1.1\r\nHost: cdn.test\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "console.log(1)" {
+		t.Fatalf("status = %d body = %q", resp.StatusCode, body)
+	}
+}
+
+func TestMapLocalHead(t *testing.T) {
+	rule := MapLocalRule{Dir: newMapLocalDir(t)}
+	req, _ := http.NewRequest(http.MethodHead, "http://example.com/app.js", nil)
+	resp := rule.Serve(req)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len("console.log(1)")) {
+		t.Fatalf("HEAD status = %d, content length = %d", resp.StatusCode, resp.ContentLength)
+	}
+}
+
+func TestMapLocalStreamsBody(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "big.bin")
+	data := bytes.Repeat([]byte("a"), 1<<20)
+	os.WriteFile(name, data, 0644)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/big.bin", nil)
+	resp := ServeLocalFile(req, name, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(data)) {
+		t.Fatalf("status = %d, content length = %d", resp.StatusCode, resp.ContentLength)
+	}
+	// 响应体按需从文件读取：返回响应后再修改文件尾部，读到的是修改后的内容。
+	f, _ := os.OpenFile(name, os.O_WRONLY, 0)
+	f.WriteAt([]byte("tail"), int64(len(data)-4))
+	f.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) != len(data) || string(body[len(body)-4:]) != "tail" {
+		t.Fatalf("body length = %d, tail = %q", len(body), body[len(body)-4:])
+	}
+
+	// 提前关闭响应体不会阻塞。
+	req.Header.Set("Range", "bytes=100-")
+	resp = ServeLocalFile(req, name, nil)
+	if resp.StatusCode != http.StatusPartialContent || resp.ContentLength != int64(len(data)-100) {
+		t.Fatalf("range status = %d, content length = %d", resp.StatusCode, resp.ContentLength)
+	}
+	io.ReadFull(resp.Body, make([]byte, 10))
+	resp.Body.Close()
+}
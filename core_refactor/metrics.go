@@ -0,0 +1,334 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLatencyBuckets 是耗时直方图的默认桶边界（秒），与 Prometheus 客户端默认值一致。
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics 汇总代理运行指标，可按 Prometheus 文本格式导出。
+// 零值不可用，请使用 NewMetrics；nil 指针上的所有记录方法均为空操作。
+type Metrics struct {
+	connsTotal    atomic.Uint64
+	connsActive   atomic.Int64
+	connsRejected atomic.Uint64
+
+	clientRecv   atomic.Uint64
+	clientSent   atomic.Uint64
+	upstreamRecv atomic.Uint64
+	upstreamSent atomic.Uint64
+
+	certHits   atomic.Uint64
+	certMisses atomic.Uint64
+
+	requests  *metricVec
+	dial      *metricVec
+	tls       *metricVec
+	ttfb      *metricVec
+	lua       *metricVec
+	luaErrors *metricVec
+}
+
+// NewMetrics 创建一组空指标。
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  newMetricVec("mitm_requests_total", "Requests handled, by target host and response status.", "counter", nil, "host", "status"),
+		dial:      newMetricVec("mitm_upstream_dial_seconds", "Time to establish upstream TCP connections (including upstream proxy CONNECT).", "histogram", defaultLatencyBuckets),
+		tls:       newMetricVec("mitm_upstream_tls_seconds", "Time spent in upstream TLS handshakes.", "histogram", defaultLatencyBuckets),
+		ttfb:      newMetricVec("mitm_upstream_ttfb_seconds", "Time from writing a request upstream to reading the response headers.", "histogram", defaultLatencyBuckets),
+		lua:       newMetricVec("mitm_lua_duration_seconds", "Lua callback execution time, by function.", "histogram", defaultLatencyBuckets, "function"),
+		luaErrors: newMetricVec("mitm_lua_errors_total", "Lua callback errors, by function.", "counter", nil, "function"),
+	}
+}
+
+// ObserveLua 记录一次 Lua 回调的执行耗时；err 非 nil 时同时计入错误数。
+// 核心本身不执行脚本，由嵌入 Lua 的调用方在每次回调后上报。
+func (mt *Metrics) ObserveLua(function string, d time.Duration, err error) {
+	if mt == nil {
+		return
+	}
+	mt.lua.observe(d.Seconds(), function)
+	if err != nil {
+		mt.luaErrors.add(1, function)
+	}
+}
+
+// WritePrometheus 以 Prometheus 文本格式（0.0.4）写出全部指标。
+func (mt *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeScalar(bw, "mitm_connections_total", "Client connections accepted.", "counter", float64(mt.connsTotal.Load()))
+	writeScalar(bw, "mitm_connections_rejected_total", "Client connections rejected by the listener ACL.", "counter", float64(mt.connsRejected.Load()))
+	writeScalar(bw, "mitm_connections_active", "Client connections currently open.", "gauge", float64(mt.connsActive.Load()))
+	mt.requests.write(bw)
+	writeHeader(bw, "mitm_bytes_total", "Bytes transferred on the wire, by peer and direction relative to the proxy.", "counter")
+	for _, s := range []struct {
+		peer, dir string
+		v         *atomic.Uint64
+	}{
+		{"client", "received", &mt.clientRecv},
+		{"client", "sent", &mt.clientSent},
+		{"upstream", "received", &mt.upstreamRecv},
+		{"upstream", "sent", &mt.upstreamSent},
+	} {
+		writeSample(bw, "mitm_bytes_total", []string{"peer", "direction"}, []string{s.peer, s.dir}, "", float64(s.v.Load()))
+	}
+	mt.dial.write(bw)
+	mt.tls.write(bw)
+	mt.ttfb.write(bw)
+	writeHeader(bw, "mitm_cert_cache_total", "Leaf certificate lookups, by cache result.", "counter")
+	writeSample(bw, "mitm_cert_cache_total", []string{"result"}, []string{"hit"}, "", float64(mt.certHits.Load()))
+	writeSample(bw, "mitm_cert_cache_total", []string{"result"}, []string{"miss"}, "", float64(mt.certMisses.Load()))
+	mt.lua.write(bw)
+	mt.luaErrors.write(bw)
+	return bw.Flush()
+}
+
+// connOpened / connClosed 维护客户端连接计数。
+func (mt *Metrics) connOpened() {
+	if mt != nil {
+		mt.connsTotal.Add(1)
+		mt.connsActive.Add(1)
+	}
+}
+
+func (mt *Metrics) connRejected() {
+	if mt != nil {
+		mt.connsRejected.Add(1)
+	}
+}
+
+func (mt *Metrics) connClosed() {
+	if mt != nil {
+		mt.connsActive.Add(-1)
+	}
+}
+
+// request 记录一次已回写客户端的请求。
+func (mt *Metrics) request(req *http.Request, status int) {
+	if mt == nil {
+		return
+	}
+	host, _ := hostPort(req.Host, false)
+	mt.requests.add(1, host, strconv.Itoa(status))
+}
+
+// certLookup 记录一次证书缓存查询结果。
+func (mt *Metrics) certLookup(cached bool) {
+	if mt == nil {
+		return
+	}
+	if cached {
+		mt.certHits.Add(1)
+	} else {
+		mt.certMisses.Add(1)
+	}
+}
+
+func (mt *Metrics) observeDial(d time.Duration) {
+	if mt != nil {
+		mt.dial.observe(d.Seconds())
+	}
+}
+
+func (mt *Metrics) observeTLS(d time.Duration) {
+	if mt != nil {
+		mt.tls.observe(d.Seconds())
+	}
+}
+
+func (mt *Metrics) observeTTFB(d time.Duration) {
+	if mt != nil {
+		mt.ttfb.observe(d.Seconds())
+	}
+}
+
+// countClient 包装客户端连接以统计收发字节数。
+func (mt *Metrics) countClient(conn net.Conn) net.Conn {
+	if mt == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, recv: &mt.clientRecv, sent: &mt.clientSent}
+}
+
+// countDial 包装拨号函数，使上游连接的收发字节计入指标。
+func (mt *Metrics) countDial(dial DialFunc) DialFunc {
+	if mt == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, recv: &mt.upstreamRecv, sent: &mt.upstreamSent}, nil
+	}
+}
+
+// countingConn 在读写时累加字节计数。
+type countingConn struct {
+	net.Conn
+	recv, sent *atomic.Uint64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recv.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(uint64(n))
+	return n, err
+}
+
+// Unwrap 返回被包装的原始连接。
+func (c *countingConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// metricVec 是一组共享名称与标签名的计数器或直方图序列。
+type metricVec struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values []string
+	value  float64  // counter 的值或 histogram 的总和
+	counts []uint64 // histogram 各桶（非累计）计数，最后一项为 +Inf
+	count  uint64
+}
+
+func newMetricVec(name, help, typ string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		if v.typ == "histogram" {
+			s.counts = make([]uint64, len(v.buckets)+1)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+func (v *metricVec) observe(x float64, values ...string) {
+	i := sort.SearchFloat64s(v.buckets, x)
+	v.mu.Lock()
+	s := v.get(values)
+	s.counts[i]++
+	s.count++
+	s.value += x
+	v.mu.Unlock()
+}
+
+// write 按标签值排序输出全部序列；histogram 的桶输出为累计值。
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	writeHeader(w, v.name, v.help, v.typ)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.typ != "histogram" {
+			writeSample(w, v.name, v.labels, s.values, "", s.value)
+			continue
+		}
+		labels := append(append([]string(nil), v.labels...), "le")
+		var cum uint64
+		for i, b := range v.buckets {
+			cum += s.counts[i]
+			writeSample(w, v.name, labels, append(append([]string(nil), s.values...), formatFloat(b)), "_bucket", float64(cum))
+		}
+		writeSample(w, v.name, labels, append(append([]string(nil), s.values...), "+Inf"), "_bucket", float64(s.count))
+		writeSample(w, v.name, v.labels, s.values, "_sum", s.value)
+		writeSample(w, v.name, v.labels, s.values, "_count", float64(s.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeScalar(w *bufio.Writer, name, help, typ string, v float64) {
+	writeHeader(w, name, help, typ)
+	writeSample(w, name, nil, nil, "", v)
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, suffix string, v float64) {
+	w.WriteString(name)
+	w.WriteString(suffix)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics 返回代理的运行指标。
+func (m *MITM) Metrics() *Metrics {
+	return m.metrics
+}
+
+// handleMetrics 以 Prometheus 文本格式导出运行指标。
+func (m *MITM) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// 管理接口按首次 Write 的长度设置 Content-Length，需一次性写出。
+	var buf bytes.Buffer
+	m.metrics.WritePrometheus(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
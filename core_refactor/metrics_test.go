@@ -0,0 +1,85 @@
+package core_refactor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	mt := NewMetrics()
+	addr := startTestMITM(t, nil, WithMetrics(mt))
+	target := upstream.Listener.Addr().String()
+
+	// 同一主机两次 CONNECT：第一次签发证书，第二次命中缓存。
+	for _, path := range []string{"/", "/missing"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		br := bufio.NewReader(conn)
+		if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %v %v", resp, err)
+		}
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		fmt.Fprintf(tc, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, target)
+		resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+	}
+	mt.ObserveLua("GoRequest", 3*time.Millisecond, nil)
+	mt.ObserveLua("GoRequest", 2*time.Second, errors.New("boom"))
+
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\n\r\n", RouteMetrics, managePort(addr)))
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("content type = %q", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE mitm_connections_total counter\nmitm_connections_total 3\n",
+		"# TYPE mitm_connections_active gauge\n",
+		`mitm_requests_total{host="127.0.0.1",status="200"} 1`,
+		`mitm_requests_total{host="127.0.0.1",status="404"} 1`,
+		`mitm_cert_cache_total{result="hit"} 1`,
+		`mitm_cert_cache_total{result="miss"} 1`,
+		"mitm_upstream_dial_seconds_count 1\n",
+		"mitm_upstream_tls_seconds_count 1\n",
+		"mitm_upstream_ttfb_seconds_count 2\n",
+		`mitm_lua_duration_seconds_bucket{function="GoRequest",le="0.005"} 1`,
+		`mitm_lua_duration_seconds_bucket{function="GoRequest",le="2.5"} 2`,
+		`mitm_lua_duration_seconds_count{function="GoRequest"} 2`,
+		`mitm_lua_errors_total{function="GoRequest"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	for _, dir := range []string{`peer="client",direction="received"`, `peer="upstream",direction="sent"`} {
+		if strings.Contains(body, "mitm_bytes_total{"+dir+"} 0\n") {
+			t.Errorf("bytes %s not counted", dir)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
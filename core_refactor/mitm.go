@@ -2,14 +2,17 @@ package core_refactor
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,23 +31,55 @@ type MITM struct {
 	requestHandler  func(*http.Request) *http.Response
 	responseHandler func(*http.Response) *http.Response
 	htmlInjector    *HTMLInjector
+	wsHook          WebSocketHook
+	wsTunnels       *wsRegistry
+	sseHook         SSEHook
+	grpcHook        GRPCHook
+	protoRegistry   *ProtoRegistry
 
 	manageRouter map[string]http.HandlerFunc
-	logger       *log.Logger
+	logger       *slog.Logger
+	accessLog    *accessLogger
 
 	dialTimeout time.Duration
 	idleTimeout time.Duration
 	certPath    string
 	keyPath     string
-
-	listener   net.Listener
-	listenPort string
-	mu         sync.Mutex
-	closed     bool
-	conns      sync.WaitGroup
-	clients    map[net.Conn]struct{}
-	clientsMu  sync.Mutex
-	localIPs   map[string]struct{}
+	poolConfig  PoolConfig
+	pool        *connPool
+	retryPolicy RetryPolicy
+	breaker     *BreakerConfig
+	dial        DialFunc
+	hosts       *HostsResolver
+	netsim      *NetworkSimulator
+	faults      *FaultInjector
+	mapLocal    []MapLocalRule
+	rules       *RuleEngine
+	profiles    *Profiles
+	breakpoints *Breakpoints
+	capture     *CaptureStore
+	recorder    *Recorder
+	health      *healthTracker
+	metrics     *Metrics
+	auth        *proxyAuthenticator
+	aclConfig   *ACLConfig
+	acl         atomic.Pointer[compiledACL]
+	admin       *AdminConfig
+	adminRoutes []adminRoute
+	adminMux    atomic.Pointer[http.ServeMux]
+
+	listener      net.Listener
+	listenPort    string
+	adminListener net.Listener
+	adminServer   *http.Server
+	mu            sync.Mutex
+	closed        bool
+	draining      atomic.Bool
+	conns         sync.WaitGroup
+	clients       map[net.Conn]struct{}
+	sessions      map[*session]struct{}
+	clientsMu     sync.Mutex
+	localIPs      map[string]struct{}
 }
 
 // New 构造并初始化 MITM 代理。若未指定 CA，会尝试从默认路径加载。
@@ -56,15 +91,55 @@ func New(opts ...Option) (*MITM, error) {
 		idleTimeout:  defaultIdleTimeout,
 		certPath:     defaultCertPath,
 		keyPath:      defaultKeyPath,
+		retryPolicy:  DefaultRetryPolicy,
 		clients:      make(map[net.Conn]struct{}),
+		sessions:     make(map[*session]struct{}),
 	}
 	for _, opt := range opts {
 		opt(m)
 	}
 
 	if m.logger == nil {
-		m.logger = log.New(io.Discard, "", 0)
+		m.logger = slogFromStd(nil)
+	}
+	if m.dial == nil {
+		m.dial = (&net.Dialer{}).DialContext
+	}
+	if m.hosts != nil {
+		m.dial = m.hosts.Dialer(m.dial)
+	}
+	if m.metrics == nil {
+		m.metrics = NewMetrics()
+	}
+	m.dial = m.metrics.countDial(m.dial)
+	if m.netsim == nil {
+		// 默认创建一个关闭状态的模拟器，便于通过管理接口在运行时开启。
+		m.netsim, _ = NewNetworkSimulator(false)
+	}
+	if m.faults == nil {
+		m.faults, _ = NewFaultInjector()
+	}
+	if m.rules == nil {
+		m.rules, _ = NewRuleEngine(RuleSet{})
+	}
+	if m.profiles == nil {
+		m.profiles, _ = NewProfiles("")
+	}
+	if m.breakpoints == nil {
+		m.breakpoints, _ = NewBreakpoints(0)
+	}
+	if m.aclConfig != nil {
+		if err := m.SetACL(*m.aclConfig); err != nil {
+			return nil, fmt.Errorf("acl: %w", err)
+		}
 	}
+	if m.auth != nil && m.auth.store == nil {
+		return nil, errors.New("proxy auth: credential store is required")
+	}
+	m.pool = newConnPool(m.poolConfig)
+	m.health = newHealthTracker(m.breaker)
+	m.registerBuiltinRoutes()
+	m.adminMux.Store(m.buildAdminMux(nil))
 
 	if m.ca == nil {
 		ca, err := LoadCA(m.certPath, m.keyPath)
@@ -82,11 +157,15 @@ func New(opts ...Option) (*MITM, error) {
 	return m, nil
 }
 
-// HandleFunc 注册本地管理接口，仅对监听地址生效。
+// HandleFunc 注册本地管理接口，对代理端口上的带内管理请求与独立管理监听器（见 WithAdmin）均生效。
 func (m *MITM) HandleFunc(pattern string, h http.HandlerFunc) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	_, exists := m.manageRouter[pattern]
 	m.manageRouter[pattern] = h
+	if !exists {
+		m.adminMux.Store(m.buildAdminMux(m.adminRoutes))
+	}
 }
 
 // Start 阻塞地启动代理监听。
@@ -106,7 +185,12 @@ func (m *MITM) Start(addr string) error {
 	_, m.listenPort, _ = net.SplitHostPort(ln.Addr().String())
 	m.mu.Unlock()
 
-	m.logger.Printf("mitm-proxy listening on %s", ln.Addr())
+	if err := m.startAdmin(); err != nil {
+		ln.Close()
+		return err
+	}
+
+	m.logger.Info("mitm-proxy listening", "addr", ln.Addr().String())
 
 	for {
 		conn, err := ln.Accept()
@@ -114,7 +198,13 @@ func (m *MITM) Start(addr string) error {
 			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			m.logger.Printf("accept error: %v", err)
+			m.logger.Error("accept failed", "error", err)
+			continue
+		}
+		if !m.acl.Load().allowListener(addrIP(conn.RemoteAddr())) {
+			m.logger.Warn("connection rejected by listener acl", "client", conn.RemoteAddr().String())
+			m.metrics.connRejected()
+			conn.Close()
 			continue
 		}
 		m.conns.Add(1)
@@ -133,52 +223,41 @@ func (m *MITM) Start(addr string) error {
 	}
 }
 
-// Stop 停止监听并等待所有连接处理完毕。
+// Stop 停止监听并立即关闭所有客户端连接，等待处理协程退出。
+// 需要等待进行中的请求完成时使用 Shutdown。
 func (m *MITM) Stop() error {
-	m.mu.Lock()
-	if m.closed {
-		m.mu.Unlock()
-		return nil
-	}
-	m.closed = true
-	ln := m.listener
-	m.mu.Unlock()
-
-	if ln != nil {
-		if err := ln.Close(); err != nil {
-			return err
-		}
-	}
-
-	// 强制关闭所有活跃客户端连接，避免 goroutine 在 I/O 上阻塞导致程序无法退出。
-	m.clientsMu.Lock()
-	for c := range m.clients {
-		c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
 	}
-	m.clientsMu.Unlock()
-
-	m.conns.Wait()
 	return nil
 }
 
 func (m *MITM) serve(conn net.Conn) {
 	defer conn.Close()
+	m.metrics.connOpened()
+	defer m.metrics.connClosed()
 
-	client := newClientConn(conn)
+	// 弱网模拟只作用于客户端连接，见 NetworkSimulator。
+	client := newClientConn(newShapedConn(m.metrics.countClient(conn), m.netsim))
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sess := &session{
 		mitm:    m,
 		client:  client,
-		servers: make(map[string]*serverConn),
 		writeCh: make(chan func() error, 8),
 		ctx:     ctx,
 		cancel:  cancel,
+
+		intercept: m.acl.Load().allowIntercept(addrIP(conn.RemoteAddr())),
 	}
 
 	go sess.writeLoop()
 	defer sess.close()
+	m.trackSession(sess, true)
+	defer m.trackSession(sess, false)
 
 	for {
 		select {
@@ -188,31 +267,50 @@ func (m *MITM) serve(conn net.Conn) {
 		}
 
 		if err := client.SetDeadline(time.Now().Add(m.idleTimeout)); err != nil {
-			m.logf("set deadline error: %v", err)
+			m.logger.Debug("set client deadline failed", "client", conn.RemoteAddr().String(), "error", err)
 			return
 		}
 
-		req, err := client.ReadRequest()
+		// 收到首字节即视为处理中，避免关闭过程把正在读取请求的连接当作空闲关闭。
+		_, err := client.reader.Peek(1)
+		var req *http.Request
+		if err == nil {
+			sess.begin()
+			req, err = client.ReadRequest()
+		}
 		if err != nil {
 			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 				var netErr net.Error
 				if !(errors.As(err, &netErr) && netErr.Timeout()) {
-					m.logf("read request error: %v", err)
+					m.logger.Debug("read request failed", "client", conn.RemoteAddr().String(), "error", err)
 				}
 			}
 			return
 		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		if !sess.authorize(req) {
+			sess.end()
+			continue
+		}
 
 		if req.Method == http.MethodConnect {
-			if err := client.upgradeTLS(m.ca, req.Host); err != nil {
-				m.logf("upgrade client tls error: %v", err)
+			if !sess.intercept {
+				m.blindTunnel(ctx, client, req)
+				return
+			}
+			client.setTarget(req.Host)
+			if err := client.upgradeTLS(m.signHost, req.Host); err != nil {
+				m.logger.Warn("client tls handshake failed", "client", conn.RemoteAddr().String(), "host", req.Host, "error", err)
 				return
 			}
+			sess.end()
 			continue
 		}
 
 		isWS := isWebSocketRequest(req)
 		sess.handleRequest(req, isWS)
+		sess.end()
 
 		if isWS {
 			// WebSocket 升级为隧道后不再复用该连接读取后续请求
@@ -221,18 +319,19 @@ func (m *MITM) serve(conn net.Conn) {
 	}
 }
 
-func (m *MITM) logf(format string, v ...interface{}) {
-	m.logger.Printf(format, v...)
-}
-
-func (m *MITM) logln(v ...interface{}) {
-	m.logger.Println(v...)
+// signHost 为客户端侧 TLS 签发证书，并统计证书缓存命中情况。
+func (m *MITM) signHost(hostname string) (tls.Certificate, error) {
+	cert, cached, err := m.ca.signHost([]string{hostname})
+	if err == nil {
+		m.metrics.certLookup(cached)
+	}
+	return cert, err
 }
 
 // mustManageRequest 判断请求是否应路由到本地管理接口。
 func (m *MITM) mustManageRequest(req *http.Request) bool {
 	host, port := hostPort(req.Host, false)
-	_, ok := m.localIPs[host]
+	_, ok := m.localIPs[canonicalHost(host)]
 	if !ok {
 		return false
 	}
@@ -252,11 +351,16 @@ func (m *MITM) ListenAddr() net.Addr {
 	return m.listener.Addr()
 }
 
-// SetLogOutput 兼容旧接口：设置日志输出到指定 writer；传入 nil 关闭日志。
-func (m *MITM) SetLogOutput(w *os.File) {
-	if w == nil {
-		m.logger = log.New(io.Discard, "", 0)
+// SetLogOutput 兼容旧接口：以带 "[mitm] " 前缀的文本格式把日志写到 w；传入 nil 关闭日志。
+func (m *MITM) SetLogOutput(w io.Writer) {
+	if f, ok := w.(*os.File); w == nil || ok && f == nil {
+		m.logger = slogFromStd(nil)
 	} else {
-		m.logger = log.New(w, "[mitm] ", log.LstdFlags)
+		m.logger = slogFromStd(log.New(w, "[mitm] ", log.LstdFlags))
 	}
 }
+
+// Capture 返回抓包存储；未通过 WithCapture 启用时返回 nil。
+func (m *MITM) Capture() *CaptureStore {
+	return m.capture
+}
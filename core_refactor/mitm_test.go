@@ -13,6 +13,12 @@ import (
 )
 
 func startTestMITM(t *testing.T, setup func(*MITM), opts ...Option) string {
+	t.Helper()
+	return startTestMITMAt(t, "127.0.0.1:0", setup, opts...)
+}
+
+// startTestMITMAt 同 startTestMITM，但监听指定地址。
+func startTestMITMAt(t *testing.T, listen string, setup func(*MITM), opts ...Option) string {
 	t.Helper()
 	certPath, keyPath := writeTestCAFiles(t)
 	opts = append([]Option{WithCAPath(certPath, keyPath), WithLogger(nil)}, opts...)
@@ -26,7 +32,7 @@ func startTestMITM(t *testing.T, setup func(*MITM), opts ...Option) string {
 	}
 
 	go func() {
-		if err := m.Start("127.0.0.1:0"); err != nil {
+		if err := m.Start(listen); err != nil {
 			t.Logf("Start returned: %v", err)
 		}
 	}()
@@ -0,0 +1,324 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NetworkProfile 描述一种弱网条件。带宽单位为字节/秒，0 表示不限速。
+type NetworkProfile struct {
+	Name string `json:"name,omitempty"`
+	// DownloadBps 代理写往客户端方向的带宽（响应下载）。
+	DownloadBps int64 `json:"downloadBps,omitempty"`
+	// UploadBps 代理从客户端读取方向的带宽（请求上传）；上游连接不限速。
+	UploadBps int64 `json:"uploadBps,omitempty"`
+	// LatencyMs 在写往客户端的响应首字节之前附加的固定延迟，叠加在上游实际首字节耗时之上。
+	LatencyMs int `json:"latencyMs,omitempty"`
+	// JitterMs 在 LatencyMs 基础上附加的随机抖动上限。
+	JitterMs int `json:"jitterMs,omitempty"`
+	// StallProbability 每写出一个数据块时发生卡顿的概率（0~1），模拟丢包重传造成的停顿。
+	StallProbability float64 `json:"stallProbability,omitempty"`
+	// StallMs 单次卡顿持续时间。
+	StallMs int `json:"stallMs,omitempty"`
+}
+
+// NetworkPresets 是内置的常用弱网预设，规则中可以通过名称引用。
+var NetworkPresets = map[string]NetworkProfile{
+	"slow-3g":    {Name: "slow-3g", DownloadBps: 50 * 1024, UploadBps: 50 * 1024, LatencyMs: 2000, JitterMs: 200},
+	"fast-3g":    {Name: "fast-3g", DownloadBps: 180 * 1024, UploadBps: 90 * 1024, LatencyMs: 560, JitterMs: 100},
+	"regular-4g": {Name: "regular-4g", DownloadBps: 512 * 1024, UploadBps: 384 * 1024, LatencyMs: 170, JitterMs: 30},
+	"flaky":      {Name: "flaky", DownloadBps: 256 * 1024, UploadBps: 128 * 1024, LatencyMs: 300, JitterMs: 300, StallProbability: 0.05, StallMs: 3000},
+}
+
+// NetworkRule 将弱网配置绑定到匹配的主机和客户端上；空字段表示匹配全部。
+type NetworkRule struct {
+	// Host 主机名 glob（path.Match 语法），例如 "*.example.com"。
+	Host string `json:"host,omitempty"`
+	// Client 客户端 IP 或 CIDR。
+	Client string `json:"client,omitempty"`
+	// Preset 引用 NetworkPresets 中的预设名；与 Profile 同时存在时 Profile 优先。
+	Preset  string          `json:"preset,omitempty"`
+	Profile *NetworkProfile `json:"profile,omitempty"`
+}
+
+// NetworkSimulator 按规则对客户端连接的读写进行限速、加延迟与随机卡顿。
+// 只整形代理与客户端之间的连接：上游连接由连接池在多个客户端之间复用，不做整形，
+// 因此 UploadBps 限制的是代理读取客户端请求的速度，延迟与卡顿叠加在上游真实耗时之上。
+// 规则按顺序匹配，第一条命中的规则生效；可在运行时通过管理接口开关与替换。
+type NetworkSimulator struct {
+	mu      sync.RWMutex
+	enabled bool
+	rules   []NetworkRule
+	nets    []*net.IPNet // 与 rules 一一对应的已解析 Client
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+}
+
+// NewNetworkSimulator 创建一个弱网模拟器；enabled 为 false 时规则保留但不生效。
+func NewNetworkSimulator(enabled bool, rules ...NetworkRule) (*NetworkSimulator, error) {
+	s := &NetworkSimulator{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if err := s.SetRules(rules); err != nil {
+		return nil, err
+	}
+	s.SetEnabled(enabled)
+	return s, nil
+}
+
+// SetEnabled 开启或关闭模拟。
+func (s *NetworkSimulator) SetEnabled(enabled bool) {
+	s.mu.Lock()
+	s.enabled = enabled
+	s.mu.Unlock()
+}
+
+// Enabled 返回模拟是否开启。
+func (s *NetworkSimulator) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled
+}
+
+// SetRules 替换全部规则。
+func (s *NetworkSimulator) SetRules(rules []NetworkRule) error {
+	nets := make([]*net.IPNet, len(rules))
+	for i, r := range rules {
+		if r.Profile == nil && r.Preset != "" {
+			if _, ok := NetworkPresets[r.Preset]; !ok {
+				return fmt.Errorf("rule %d: unknown preset %q", i, r.Preset)
+			}
+		}
+		if r.Host != "" {
+			if _, err := path.Match(r.Host, ""); err != nil {
+				return fmt.Errorf("rule %d: bad host pattern %q: %w", i, r.Host, err)
+			}
+		}
+		if r.Client != "" {
+			n, err := parseCIDROrIP(r.Client)
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+			nets[i] = n
+		}
+	}
+
+	s.mu.Lock()
+	s.rules = append([]NetworkRule(nil), rules...)
+	s.nets = nets
+	s.mu.Unlock()
+	return nil
+}
+
+// Rules 返回当前规则副本。
+func (s *NetworkSimulator) Rules() []NetworkRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]NetworkRule(nil), s.rules...)
+}
+
+// match 返回 host 与客户端 IP 命中的弱网配置。
+func (s *NetworkSimulator) match(host string, clientIP net.IP) (NetworkProfile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.enabled {
+		return NetworkProfile{}, false
+	}
+	for i, r := range s.rules {
+		if r.Host != "" {
+			if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+				continue
+			}
+		}
+		if s.nets[i] != nil && (clientIP == nil || !s.nets[i].Contains(clientIP)) {
+			continue
+		}
+		if r.Profile != nil {
+			return *r.Profile, true
+		}
+		p, ok := NetworkPresets[r.Preset]
+		return p, ok
+	}
+	return NetworkProfile{}, false
+}
+
+func (s *NetworkSimulator) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	return s.rng.Float64() < p
+}
+
+func (s *NetworkSimulator) jitter(max int) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	return time.Duration(s.rng.Intn(max+1)) * time.Millisecond
+}
+
+// parseCIDROrIP 将单个 IP 或 CIDR 解析为网段。
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse cidr %q: %w", s, err)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// shapedConn 包装客户端原始连接，在 I/O 路径上施加弱网效果（上游连接不经过它）。
+// 由于 TLS 建立在原始连接之上，握手与加密流量同样受影响。
+type shapedConn struct {
+	net.Conn
+	sim      *NetworkSimulator
+	clientIP net.IP
+	host     atomic.Value // string，当前正在处理的请求主机
+	waiting  atomic.Bool  // 已读取请求数据、尚未写出响应首字节
+}
+
+func newShapedConn(conn net.Conn, sim *NetworkSimulator) *shapedConn {
+	c := &shapedConn{Conn: conn, sim: sim}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		c.clientIP = net.ParseIP(host)
+	}
+	c.host.Store("")
+	return c
+}
+
+// setHost 记录当前请求的目标主机，用于匹配按主机配置的规则。
+func (c *shapedConn) setHost(host string) {
+	c.host.Store(host)
+}
+
+func (c *shapedConn) profile() (NetworkProfile, bool) {
+	return c.sim.match(c.host.Load().(string), c.clientIP)
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	prof, ok := c.profile()
+	if !ok {
+		n, err := c.Conn.Read(p)
+		c.waiting.Store(n > 0)
+		return n, err
+	}
+	if chunk := chunkSize(prof.UploadBps); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.waiting.Store(true)
+		throttle(n, prof.UploadBps)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	prof, ok := c.profile()
+	if !ok {
+		c.waiting.Store(false)
+		return c.Conn.Write(p)
+	}
+	if c.waiting.Swap(false) && prof.LatencyMs+prof.JitterMs > 0 {
+		time.Sleep(time.Duration(prof.LatencyMs)*time.Millisecond + c.sim.jitter(prof.JitterMs))
+	}
+
+	chunk := chunkSize(prof.DownloadBps)
+	if chunk <= 0 {
+		chunk = len(p)
+	}
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		if prof.StallMs > 0 && c.sim.chance(prof.StallProbability) {
+			time.Sleep(time.Duration(prof.StallMs) * time.Millisecond)
+		}
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		throttle(n, prof.DownloadBps)
+	}
+	return written, nil
+}
+
+// Unwrap 返回被包装的原始连接。
+func (c *shapedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// chunkSize 返回限速时单次读写的数据块大小（约 100ms 的流量）。
+func chunkSize(bps int64) int {
+	if bps <= 0 {
+		return 0
+	}
+	n := int(bps / 10)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func throttle(n int, bps int64) {
+	if bps <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(int64(n) * int64(time.Second) / bps))
+}
+
+// netsimConfig 是管理接口读写的弱网配置。
+type netsimConfig struct {
+	Enabled bool                      `json:"enabled"`
+	Rules   []NetworkRule             `json:"rules"`
+	Presets map[string]NetworkProfile `json:"presets,omitempty"`
+}
+
+// handleNetsim 查询（GET）或替换（PUT/POST）弱网模拟配置。
+func (m *MITM) handleNetsim(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, netsimConfig{
+			Enabled: m.netsim.Enabled(),
+			Rules:   m.netsim.Rules(),
+			Presets: NetworkPresets,
+		})
+	case http.MethodPut, http.MethodPost:
+		var cfg netsimConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "decode netsim config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.netsim.SetRules(cfg.Rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.netsim.SetEnabled(cfg.Enabled)
+		writeJSON(w, http.StatusOK, netsimConfig{Enabled: cfg.Enabled, Rules: m.netsim.Rules()})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,95 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNetworkSimulatorMatch(t *testing.T) {
+	sim, err := NewNetworkSimulator(true,
+		NetworkRule{Host: "*.slow.test", Preset: "slow-3g"},
+		NetworkRule{Client: "10.0.0.0/8", Profile: &NetworkProfile{Name: "lan", LatencyMs: 5}},
+	)
+	if err != nil {
+		t.Fatalf("NewNetworkSimulator: %v", err)
+	}
+
+	if p, ok := sim.match("api.slow.test", net.ParseIP("192.168.1.2")); !ok || p.Name != "slow-3g" {
+		t.Fatalf("host rule: got %+v, %v", p, ok)
+	}
+	if p, ok := sim.match("example.com", net.ParseIP("10.1.2.3")); !ok || p.Name != "lan" {
+		t.Fatalf("client rule: got %+v, %v", p, ok)
+	}
+	if _, ok := sim.match("example.com", net.ParseIP("192.168.1.2")); ok {
+		t.Fatal("unexpected match")
+	}
+
+	sim.SetEnabled(false)
+	if _, ok := sim.match("api.slow.test", nil); ok {
+		t.Fatal("disabled simulator must not match")
+	}
+
+	if _, err := NewNetworkSimulator(true, NetworkRule{Preset: "nope"}); err == nil {
+		t.Fatal("expected error for unknown preset")
+	}
+}
+
+func TestShapedConnThrottlesDownload(t *testing.T) {
+	sim, _ := NewNetworkSimulator(true, NetworkRule{Profile: &NetworkProfile{DownloadBps: 10000}})
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newShapedConn(a, sim)
+	defer c.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 3000)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("3000 bytes at 10000 B/s took %v, want >= 250ms", elapsed)
+	}
+}
+
+// TestNetsimManageAPI 验证通过管理接口开启弱网后，请求的首字节被延迟。
+func TestNetsimManageAPI(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	addr := startTestMITM(t, nil)
+	port := managePort(addr)
+
+	cfg := `{"enabled":true,"rules":[{"host":"127.0.0.1","profile":{"latencyMs":300}}]}`
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n\r\n%s", RouteNetsim, port, len(cfg), cfg))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put netsim status = %d, body = %q", resp.StatusCode, body)
+	}
+	var got netsimConfig
+	if err := json.Unmarshal([]byte(body), &got); err != nil || !got.Enabled || len(got.Rules) != 1 {
+		t.Fatalf("put netsim response = %q (%v)", body, err)
+	}
+
+	start := time.Now()
+	resp, _ = doProxyRequest(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Listener.Addr()))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("request took %v, want >= 300ms latency", elapsed)
+	}
+}
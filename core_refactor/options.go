@@ -1,7 +1,9 @@
 package core_refactor
 
 import (
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"time"
 )
@@ -10,12 +12,32 @@ import (
 type Option func(*MITM)
 
 // WithLogger 设置日志输出器；nil 表示关闭日志。
+// 日志以 Info 级别、key=value 文本形式经 l 输出，需要级别控制或 JSON 输出时使用 WithSlog。
 func WithLogger(l *log.Logger) Option {
 	return func(m *MITM) {
+		m.logger = slogFromStd(l)
+	}
+}
+
+// WithSlog 使用结构化日志器；级别与输出格式由其 Handler 决定。请求相关的记录附带
+// flow、client、host 属性，每个写回的响应记录一条 "request"（含 status、duration、bytes）。
+func WithSlog(l *slog.Logger) Option {
+	return func(m *MITM) {
+		if l == nil {
+			l = slogFromStd(nil)
+		}
 		m.logger = l
 	}
 }
 
+// WithAccessLog 将每个写回客户端的请求按 format 写入 w 作为访问日志，
+// 可配合 OpenRotatingFile 按大小滚动。
+func WithAccessLog(w io.Writer, format AccessLogFormat) Option {
+	return func(m *MITM) {
+		m.accessLog = &accessLogger{w: w, format: format}
+	}
+}
+
 // WithCA 指定根证书签名器；不指定时 MITM 启动会从默认路径加载。
 func WithCA(ca *CA) Option {
 	return func(m *MITM) {
@@ -30,6 +52,48 @@ func WithRequestHandler(fn func(*http.Request) *http.Response) Option {
 	}
 }
 
+// WithWebSocketHook 设置 WebSocket 消息钩子。设置后代理会解析 RFC 6455 帧
+// （分片、掩码、控制帧与 permessage-deflate），逐条消息交给钩子检查、改写、丢弃或注入；
+// 未设置时升级后的连接按字节原样透传。
+func WithWebSocketHook(fn WebSocketHook) Option {
+	return func(m *MITM) {
+		m.wsHook = fn
+	}
+}
+
+// WithWebSocketLog 跟踪经过代理的 WebSocket 连接，为每条连接保留最近 limit 条消息
+// （<=0 时为 500），并通过 /mitm/websockets 提供列出、读取、注入与关闭接口。
+// 启用后即使未设置 WithWebSocketHook 也会解析帧。
+func WithWebSocketLog(limit int) Option {
+	return func(m *MITM) {
+		m.wsTunnels = newWSRegistry(limit)
+	}
+}
+
+// WithSSEHook 设置 Server-Sent Events 钩子。text/event-stream 响应总会被逐事件解析并立即刷给客户端，
+// 钩子可检查、改写或丢弃每个事件；启用抓包时事件连同接收时间记录在 CapturedResponse.Events 中。
+func WithSSEHook(fn SSEHook) Option {
+	return func(m *MITM) {
+		m.sseHook = fn
+	}
+}
+
+// WithGRPCHook 设置 gRPC 消息钩子。设置钩子或启用抓包后，application/grpc 请求与响应按长度前缀
+// 拆分为消息、解开压缩并解码 protobuf，逐条交给钩子；抓包记录中包含解码后的消息与 grpc-status。
+func WithGRPCHook(fn GRPCHook) Option {
+	return func(m *MITM) {
+		m.grpcHook = fn
+	}
+}
+
+// WithProtoRegistry 设置 protobuf 描述符注册表，gRPC 消息按对应方法的类型解码；
+// 未注册的方法按无 schema 方式解码。
+func WithProtoRegistry(r *ProtoRegistry) Option {
+	return func(m *MITM) {
+		m.protoRegistry = r
+	}
+}
+
 // WithResponseHandler 设置响应后处理钩子。
 func WithResponseHandler(fn func(*http.Response) *http.Response) Option {
 	return func(m *MITM) {
@@ -72,3 +136,138 @@ func WithCAPath(certPath, keyPath string) Option {
 		m.keyPath = keyPath
 	}
 }
+
+// WithPool 配置跨会话共享的上游连接池（空闲超时、每主机空闲/总连接上限）。
+func WithPool(cfg PoolConfig) Option {
+	return func(m *MITM) {
+		m.poolConfig = cfg
+	}
+}
+
+// WithRetryPolicy 设置上游失败时的重试策略，默认使用 DefaultRetryPolicy。
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(m *MITM) {
+		m.retryPolicy = p
+	}
+}
+
+// WithCircuitBreaker 为每个上游主机启用熔断：连续失败达到阈值后快速返回 503，
+// 直到 OpenTimeout 后放行探测请求。
+func WithCircuitBreaker(cfg BreakerConfig) Option {
+	return func(m *MITM) {
+		m.breaker = &cfg
+	}
+}
+
+// WithDialer 替换默认的上游拨号器，可用于网络命名空间、测试桩等场景。
+// 拨号超时仍由 WithDialTimeout 通过 ctx 控制。
+func WithDialer(fn DialFunc) Option {
+	return func(m *MITM) {
+		m.dial = fn
+	}
+}
+
+// WithHosts 使用 hosts 风格的解析表覆盖指定域名的 DNS 结果；
+// 只改变拨号地址，请求的 Host 头与 TLS SNI 保持原始域名。
+func WithHosts(r *HostsResolver) Option {
+	return func(m *MITM) {
+		m.hosts = r
+	}
+}
+
+// WithNetworkSimulator 设置弱网模拟器；未设置时默认创建一个关闭状态的模拟器，
+// 可通过管理接口 /mitm/netsim 在运行时开启。
+func WithNetworkSimulator(sim *NetworkSimulator) Option {
+	return func(m *MITM) {
+		m.netsim = sim
+	}
+}
+
+// WithFaultInjector 设置故障注入器；未设置时默认创建一个空规则的注入器，
+// 可通过管理接口 /mitm/faults 在运行时替换规则。
+func WithFaultInjector(f *FaultInjector) Option {
+	return func(m *MITM) {
+		m.faults = f
+	}
+}
+
+// WithMapLocal 添加 map local 规则：命中的请求直接以本地目录中的文件响应，不再访问上游。
+// 规则按添加顺序匹配，在请求钩子之后、转发之前生效。
+func WithMapLocal(rules ...MapLocalRule) Option {
+	return func(m *MITM) {
+		m.mapLocal = append(m.mapLocal, rules...)
+	}
+}
+
+// WithRules 设置声明式规则引擎；规则在请求钩子之前求值，可改写请求、直接响应或选择上游代理。
+// 未设置时默认创建一个空规则集的引擎，可通过管理接口 /mitm/rules 在运行时替换。
+func WithRules(e *RuleEngine) Option {
+	return func(m *MITM) {
+		m.rules = e
+	}
+}
+
+// WithBreakpoints 设置断点管理器：命中规则的请求在转发前、响应在写回前暂停，
+// 通过管理接口 /mitm/breakpoints 修改后放行、丢弃或直接返回自定义响应。
+func WithBreakpoints(b *Breakpoints) Option {
+	return func(m *MITM) {
+		m.breakpoints = b
+	}
+}
+
+// WithCapture 启用抓包：转发到上游的请求与写回的响应记录到 store 中，
+// 可通过 CaptureStore.HAR 或管理接口 /mitm/har 导出为 HAR 1.2。
+func WithCapture(store *CaptureStore) Option {
+	return func(m *MITM) {
+		m.capture = store
+	}
+}
+
+// WithRecorder 设置录制回放器：record 模式把上游响应保存到磁盘，playback 模式离线回放，
+// 可通过管理接口 /mitm/recorder 在运行时切换模式。
+func WithRecorder(r *Recorder) Option {
+	return func(m *MITM) {
+		m.recorder = r
+	}
+}
+
+// WithMetrics 使用调用方提供的指标集，便于与代理外部的组件（如 Lua 回调）共享；
+// 未设置时自动创建。指标可通过 MITM.Metrics 或管理接口 /mitm/metrics（Prometheus 文本格式）读取。
+func WithMetrics(mt *Metrics) Option {
+	return func(m *MITM) {
+		m.metrics = mt
+	}
+}
+
+// WithProxyAuth 要求代理客户端通过 Proxy-Authorization 认证（Basic，可选 Digest），未认证的请求返回 407 质询。
+// CONNECT 隧道在建立时认证一次；认证用户名记录在 Flow.User 与访问日志中。
+func WithProxyAuth(a ProxyAuth) Option {
+	return func(m *MITM) {
+		m.auth = newProxyAuthenticator(a)
+	}
+}
+
+// WithProfiles 设置按身份划分的个人规则（见 Profiles）；未设置时默认创建内存存储，
+// 每个使用者可通过管理接口 /mitm/profile 维护自己的规则。
+func WithProfiles(p *Profiles) Option {
+	return func(m *MITM) {
+		m.profiles = p
+	}
+}
+
+// WithACL 按客户端 IP（CIDR）限制代理的使用：Listener 在 Accept 时拒绝连接，
+// Intercept 控制是否解密与执行钩子，不允许的客户端仅获得盲隧道/直接转发。
+// 规则非法时 New 返回错误；运行时可通过 MITM.SetACL 或管理接口 /mitm/acl 替换。
+func WithACL(c ACLConfig) Option {
+	return func(m *MITM) {
+		m.aclConfig = &c
+	}
+}
+
+// WithAdmin 在独立的 TCP 地址或 Unix socket 上提供管理接口（http.ServeMux 路由，可选 Bearer token 认证），
+// 随 Start 启动、Stop 关闭。启用后代理端口上的带内管理接口默认关闭，AdminConfig.InBand 为 true 时保留。
+func WithAdmin(c AdminConfig) Option {
+	return func(m *MITM) {
+		m.admin = &c
+	}
+}
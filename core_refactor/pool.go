@@ -0,0 +1,343 @@
+package core_refactor
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPoolIdleTimeout     = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 8
+)
+
+// poolKey 唯一标识一类可复用的上游连接：协议、目标地址与所经由的上游代理。
+type poolKey struct {
+	scheme string
+	addr   string // host:port
+	proxy  string
+}
+
+func (k poolKey) String() string {
+	s := k.scheme + "://" + k.addr
+	if k.proxy != "" {
+		s += " via " + k.proxy
+	}
+	return s
+}
+
+// newPoolKey 根据协议、目标地址与代理构造连接池键。
+func newPoolKey(scheme, addr string, proxy Proxy) poolKey {
+	k := poolKey{scheme: scheme, addr: addr}
+	if !proxy.IsDirect() {
+		k.proxy = proxy.Scheme + "://" + proxy.Username + "@" + proxy.Host
+	}
+	return k
+}
+
+// PoolConfig 描述全局上游连接池的行为。零值字段使用默认值。
+type PoolConfig struct {
+	// IdleTimeout 空闲连接在池中保留的最长时间。
+	IdleTimeout time.Duration
+	// MaxIdlePerHost 每个键最多保留的空闲连接数。
+	MaxIdlePerHost int
+	// MaxConnsPerHost 每个键同时存在（空闲+使用中）的最大连接数，0 表示不限制。
+	MaxConnsPerHost int
+}
+
+// PoolStats 是连接池的统计快照。
+type PoolStats struct {
+	Idle      int             `json:"idle"`
+	Active    int             `json:"active"`
+	Hits      int64           `json:"hits"`
+	Misses    int64           `json:"misses"`
+	Dials     int64           `json:"dials"`
+	Evictions int64           `json:"evictions"`
+	Hosts     []HostPoolStats `json:"hosts"`
+}
+
+// HostPoolStats 是单个连接池键的统计信息。
+type HostPoolStats struct {
+	Key    string `json:"key"`
+	Idle   int    `json:"idle"`
+	Active int    `json:"active"`
+}
+
+// connPool 是跨客户端会话共享的上游 keep-alive 连接池。
+type connPool struct {
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	idle   map[poolKey][]*serverConn
+	active map[poolKey]int
+	slots  map[poolKey]chan struct{}
+	closed bool
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	dials     atomic.Int64
+	evictions atomic.Int64
+}
+
+func newConnPool(cfg PoolConfig) *connPool {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultPoolIdleTimeout
+	}
+	if cfg.MaxIdlePerHost <= 0 {
+		cfg.MaxIdlePerHost = defaultMaxIdleConnsPerHost
+	}
+	return &connPool{
+		cfg:    cfg,
+		idle:   make(map[poolKey][]*serverConn),
+		active: make(map[poolKey]int),
+		slots:  make(map[poolKey]chan struct{}),
+	}
+}
+
+// get 取出一个空闲连接；没有可用连接时调用 dial 新建。
+// 返回的连接在使用完毕后必须通过 put 归还或通过 discard 丢弃。
+func (p *connPool) get(ctx context.Context, key poolKey, dial func() (*serverConn, error)) (*serverConn, error) {
+	var expired []*serverConn
+	p.mu.Lock()
+	now := time.Now()
+	conns := p.idle[key]
+	var srv *serverConn
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if now.Sub(c.idleSince) > p.cfg.IdleTimeout {
+			expired = append(expired, c)
+			continue
+		}
+		srv = c
+		break
+	}
+	if len(conns) > 0 {
+		p.idle[key] = conns
+	} else {
+		delete(p.idle, key)
+	}
+	if srv != nil {
+		p.active[key]++
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		p.evictions.Add(1)
+		c.Close()
+		p.freeSlot(key)
+	}
+	if srv != nil {
+		p.hits.Add(1)
+		srv.reused = true
+		return srv, nil
+	}
+
+	p.misses.Add(1)
+	return p.dialNew(ctx, key, dial)
+}
+
+// dialNew 不复用空闲连接，直接占用名额并新建连接；用于失效连接的重放，
+// 此时同一主机的其他空闲连接很可能也已被对端关闭。
+func (p *connPool) dialNew(ctx context.Context, key poolKey, dial func() (*serverConn, error)) (*serverConn, error) {
+	if err := p.acquireSlot(ctx, key); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.active[key]++
+	p.mu.Unlock()
+
+	p.dials.Add(1)
+	srv, err := dial()
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+	srv.key = key
+	return srv, nil
+}
+
+// put 将连接归还池中；超过上限或池已关闭时直接关闭连接。
+func (p *connPool) put(srv *serverConn) {
+	key := srv.key
+	p.mu.Lock()
+	p.decActive(key)
+	if p.closed || len(p.idle[key]) >= p.cfg.MaxIdlePerHost {
+		p.mu.Unlock()
+		p.freeSlot(key)
+		p.evictions.Add(1)
+		srv.Close()
+		return
+	}
+	srv.idleSince = time.Now()
+	p.idle[key] = append(p.idle[key], srv)
+	p.mu.Unlock()
+}
+
+// discard 关闭一个使用中的连接，不再放回池中。
+func (p *connPool) discard(srv *serverConn) {
+	srv.Close()
+	p.release(srv.key)
+}
+
+// detach 将连接移出池的管理（例如升级为 WebSocket 隧道），调用方负责关闭。
+func (p *connPool) detach(srv *serverConn) {
+	p.release(srv.key)
+}
+
+func (p *connPool) release(key poolKey) {
+	p.mu.Lock()
+	p.decActive(key)
+	p.mu.Unlock()
+	p.freeSlot(key)
+}
+
+func (p *connPool) decActive(key poolKey) {
+	if p.active[key] <= 1 {
+		delete(p.active, key)
+		return
+	}
+	p.active[key]--
+}
+
+// acquireSlot 在设置了 MaxConnsPerHost 时占用一个连接名额，空闲连接同样占用名额。
+func (p *connPool) acquireSlot(ctx context.Context, key poolKey) error {
+	if p.cfg.MaxConnsPerHost <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	sem := p.slots[key]
+	if sem == nil {
+		sem = make(chan struct{}, p.cfg.MaxConnsPerHost)
+		p.slots[key] = sem
+	}
+	p.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	// 名额已满时优先淘汰一个空闲连接，再等待使用中的连接释放。
+	p.mu.Lock()
+	if conns := p.idle[key]; len(conns) > 0 {
+		srv := conns[0]
+		p.idle[key] = conns[1:]
+		p.mu.Unlock()
+		p.evictions.Add(1)
+		srv.Close()
+		p.freeSlot(key)
+	} else {
+		p.mu.Unlock()
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *connPool) freeSlot(key poolKey) {
+	if p.cfg.MaxConnsPerHost <= 0 {
+		return
+	}
+	p.mu.Lock()
+	sem := p.slots[key]
+	p.mu.Unlock()
+	if sem == nil {
+		return
+	}
+	select {
+	case <-sem:
+	default:
+	}
+}
+
+// closeIdle 关闭所有空闲连接；closeForever 为 true 时之后归还的连接也会被关闭。
+func (p *connPool) closeIdle(closeForever bool) {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[poolKey][]*serverConn)
+	if closeForever {
+		p.closed = true
+	}
+	p.mu.Unlock()
+
+	for key, conns := range idle {
+		for _, srv := range conns {
+			srv.Close()
+			p.freeSlot(key)
+		}
+	}
+}
+
+func (p *connPool) stats() PoolStats {
+	p.mu.Lock()
+	keys := make(map[poolKey]struct{})
+	for k := range p.idle {
+		keys[k] = struct{}{}
+	}
+	for k := range p.active {
+		keys[k] = struct{}{}
+	}
+	st := PoolStats{
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		Dials:     p.dials.Load(),
+		Evictions: p.evictions.Load(),
+	}
+	for k := range keys {
+		h := HostPoolStats{Key: k.String(), Idle: len(p.idle[k]), Active: p.active[k]}
+		st.Idle += h.Idle
+		st.Active += h.Active
+		st.Hosts = append(st.Hosts, h)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(st.Hosts, func(i, j int) bool { return st.Hosts[i].Key < st.Hosts[j].Key })
+	return st
+}
+
+// pooledBody 包装上游响应体：读到 EOF 后将连接归还连接池，
+// 提前关闭或读取出错则丢弃连接，避免残留数据污染后续请求。
+type pooledBody struct {
+	body     io.ReadCloser
+	pool     *connPool
+	srv      *serverConn
+	reusable bool
+	once     sync.Once
+	eof      bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.eof = true
+		b.finish()
+	} else if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	// 未读完就关闭时先丢弃连接，避免底层 body.Close 为排空数据而阻塞在长连接流上。
+	b.finish()
+	return b.body.Close()
+}
+
+func (b *pooledBody) finish() {
+	b.once.Do(func() {
+		if b.eof && b.reusable {
+			b.pool.put(b.srv)
+			return
+		}
+		b.pool.discard(b.srv)
+	})
+}
@@ -0,0 +1,100 @@
+package core_refactor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPoolSharedAcrossSessions 验证不同客户端连接访问同一上游时复用同一条 keep-alive 连接。
+func TestPoolSharedAcrossSessions(t *testing.T) {
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(c net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	var m *MITM
+	addr := startTestMITM(t, func(mm *MITM) { m = mm })
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstreamHost)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		if string(body) != "ok" {
+			t.Fatalf("body = %q, want ok", body)
+		}
+		// 等待写协程读完响应体并归还连接。
+		for j := 0; j < 50 && m.PoolStats().Idle == 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("upstream connections = %d, want 1", n)
+	}
+	st := m.PoolStats()
+	if st.Hits != 2 || st.Dials != 1 {
+		t.Fatalf("stats = %+v, want 2 hits and 1 dial", st)
+	}
+}
+
+func TestPoolKeyIncludesProxy(t *testing.T) {
+	direct := newPoolKey("https", "example.com:443", Proxy{})
+	viaProxy := newPoolKey("https", "example.com:443", Proxy{Scheme: "http", Host: "127.0.0.1:8080"})
+	plain := newPoolKey("http", "example.com:443", Proxy{})
+	if direct == viaProxy || direct == plain {
+		t.Fatal("pool keys must differ by scheme and proxy")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := newConnPool(PoolConfig{IdleTimeout: time.Millisecond})
+	key := poolKey{scheme: "http", addr: "a:80"}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	dials := 0
+	dial := func() (*serverConn, error) {
+		dials++
+		return &serverConn{raw: c1, reader: bufio.NewReader(c1)}, nil
+	}
+
+	srv, err := p.get(context.Background(), key, dial)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	p.put(srv)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := p.get(context.Background(), key, dial); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if dials != 2 {
+		t.Fatalf("dials = %d, want 2 (expired idle conn must not be reused)", dials)
+	}
+	if p.stats().Evictions != 1 {
+		t.Fatalf("evictions = %d, want 1", p.stats().Evictions)
+	}
+}
@@ -0,0 +1,262 @@
+package core_refactor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Profiles 按身份保存各自的规则集，使共享同一代理的多个使用者互不影响。
+// 身份是通过代理认证的用户名，未启用认证时为客户端 IP（见 Flow.Identity）。
+// 某身份的规则命中请求时不再应用全局规则；未命中时按全局规则处理。
+type Profiles struct {
+	dir string
+
+	mu      sync.RWMutex
+	engines map[string]*RuleEngine
+}
+
+// NewProfiles 创建个人规则存储。dir 非空时从该目录加载 <身份>.json，
+// 并在修改后写回；为空时仅保存在内存中。
+func NewProfiles(dir string) (*Profiles, error) {
+	p := &Profiles{dir: dir, engines: make(map[string]*RuleEngine)}
+	if dir == "" {
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create profile dir: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		identity, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read profile %q: %w", f, err)
+		}
+		rs, err := ParseRuleSet(data, false)
+		if err != nil {
+			return nil, fmt.Errorf("parse profile %q: %w", f, err)
+		}
+		e, err := NewRuleEngine(rs)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", identity, err)
+		}
+		p.engines[identity] = e
+	}
+	return p, nil
+}
+
+// Identities 返回已有个人规则的身份列表（按字典序）。
+func (p *Profiles) Identities() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ids := make([]string, 0, len(p.engines))
+	for id := range p.engines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get 返回身份的规则集。
+func (p *Profiles) Get(identity string) (RuleSet, bool) {
+	p.mu.RLock()
+	e, ok := p.engines[identity]
+	p.mu.RUnlock()
+	if !ok {
+		return RuleSet{}, false
+	}
+	return e.Rules(), true
+}
+
+// Set 替换身份的规则集。
+func (p *Profiles) Set(identity string, rs RuleSet) error {
+	if identity == "" {
+		return fmt.Errorf("empty identity")
+	}
+	e, err := NewRuleEngine(rs)
+	if err != nil {
+		return err
+	}
+	if p.dir != "" {
+		data, err := json.MarshalIndent(rs, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(p.file(identity), data, 0o644); err != nil {
+			return fmt.Errorf("save profile: %w", err)
+		}
+	}
+	p.mu.Lock()
+	p.engines[identity] = e
+	p.mu.Unlock()
+	return nil
+}
+
+// Delete 删除身份的规则集。
+func (p *Profiles) Delete(identity string) error {
+	p.mu.Lock()
+	delete(p.engines, identity)
+	p.mu.Unlock()
+	if p.dir != "" {
+		if err := os.Remove(p.file(identity)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("delete profile: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *Profiles) file(identity string) string {
+	return filepath.Join(p.dir, url.PathEscape(identity)+".json")
+}
+
+// apply 对请求求值其身份的规则；没有个人规则或未命中时返回 nil。
+func (p *Profiles) apply(req *http.Request) *RuleResult {
+	if p == nil {
+		return nil
+	}
+	f := FlowFromRequest(req)
+	if f == nil {
+		return nil
+	}
+	p.mu.RLock()
+	e := p.engines[f.Identity()]
+	p.mu.RUnlock()
+	if e == nil {
+		return nil
+	}
+	return e.Apply(req)
+}
+
+// Identity 返回请求方身份：认证用户名，未认证时为客户端 IP。
+func (f *Flow) Identity() string {
+	if f.User != "" {
+		return f.User
+	}
+	host, _, err := net.SplitHostPort(f.ClientAddr)
+	if err != nil {
+		return f.ClientAddr
+	}
+	return host
+}
+
+// applyRules 先求值个人规则，未命中时再求值全局规则。
+func (m *MITM) applyRules(req *http.Request) *RuleResult {
+	if res := m.profiles.apply(req); res != nil {
+		return res
+	}
+	return m.rules.Apply(req)
+}
+
+// manageIdentity 确定管理请求的调用方身份。启用代理认证时必须携带有效的 Basic 凭据
+// （Authorization 或 Proxy-Authorization），身份即用户名；否则身份为客户端 IP。
+// 两种情况下 ?identity= 都只能指向调用方自己，否则返回 403。
+func (m *MITM) manageIdentity(r *http.Request) (string, int, error) {
+	if m.auth != nil {
+		for _, h := range []string{"Authorization", "Proxy-Authorization"} {
+			scheme, cred, _ := strings.Cut(r.Header.Get(h), " ")
+			if !strings.EqualFold(scheme, "Basic") {
+				continue
+			}
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+			if err != nil {
+				break
+			}
+			user, pass, _ := strings.Cut(string(raw), ":")
+			if !m.auth.store.Verify(user, pass) {
+				break
+			}
+			if id := r.URL.Query().Get("identity"); id != "" && id != user {
+				return "", http.StatusForbidden, fmt.Errorf("cannot manage profile of %q", id)
+			}
+			return user, 0, nil
+		}
+		return "", http.StatusUnauthorized, fmt.Errorf("valid Basic credentials required")
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if id := r.URL.Query().Get("identity"); id != "" && id != host {
+		return "", http.StatusForbidden, fmt.Errorf("cannot manage profile of %q without proxy authentication", id)
+	}
+	return host, 0, nil
+}
+
+// localCaller 报告管理请求是否来自本机：回环客户端或 Unix socket（RemoteAddr 不是 IP:port）。
+func localCaller(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleProfile 查询（GET）、替换（PUT/POST）或删除（DELETE）调用方自己的规则集。
+func (m *MITM) handleProfile(w http.ResponseWriter, r *http.Request) {
+	identity, status, err := m.manageIdentity(r)
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, m.auth.realm))
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rs, _ := m.profiles.Get(identity)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"identity": identity, "rules": rs})
+	case http.MethodPut, http.MethodPost:
+		var rs RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			http.Error(w, "decode rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// mapLocal 会以代理主机上的文件响应，只允许本机调用方设置，避免局域网使用者借此读取任意文件。
+		if !localCaller(r) {
+			for _, rule := range rs.Rules {
+				if rule.MapLocal != nil {
+					http.Error(w, "mapLocal rules can only be set from the proxy host", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		if err := m.profiles.Set(identity, rs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"identity": identity, "rules": rs})
+	case http.MethodDelete:
+		if err := m.profiles.Delete(identity); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleProfiles 列出已有个人规则的身份。
+func (m *MITM) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, m.profiles.Identities())
+}
@@ -0,0 +1,159 @@
+package core_refactor
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfilesScopedByUser(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	t.Cleanup(upstream.Close)
+
+	global, _ := NewRuleEngine(RuleSet{Rules: []Rule{{Name: "global", Match: RuleMatch{Path: "/global"}, Block: &BlockAction{Status: 403}}}})
+	addr := startTestMITM(t, nil, WithRules(global),
+		WithProxyAuth(ProxyAuth{Store: StaticCredentials{"alice": "a", "bob": "b"}}))
+	target := upstream.Listener.Addr().String()
+	port := managePort(addr)
+
+	manage := func(method, path, auth, body string) (*http.Response, string) {
+		raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n", method, path, port, len(body))
+		if auth != "" {
+			raw += "Authorization: " + auth + "\r\n"
+		}
+		return doProxyRequest(t, addr, raw+"\r\n"+body)
+	}
+	proxied := func(user, pass, path string) (int, string) {
+		resp, body := doProxyRequest(t, addr, fmt.Sprintf("GET http://%s%s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: %s\r\n\r\n",
+			target, path, target, basicAuth(user, pass)))
+		return resp.StatusCode, body
+	}
+
+	rules := `{"rules":[{"name":"mock","match":{"path":"/api"},"block":{"status":418,"body":"alice mock"}}]}`
+	if resp, body := manage("PUT", RouteProfile, basicAuth("alice", "a"), rules); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"identity":"alice"`) {
+		t.Fatalf("PUT profile: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := manage("PUT", RouteProfile, "", rules); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated PUT status = %d", resp.StatusCode)
+	}
+	if resp, _ := manage("PUT", RouteProfile+"?identity=alice", basicAuth("bob", "b"), `{"rules":[]}`); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-user PUT status = %d", resp.StatusCode)
+	}
+	if _, body := manage("GET", RouteProfiles, "", ""); body != `["alice"]` {
+		t.Fatalf("profiles = %s", body)
+	}
+
+	if status, body := proxied("alice", "a", "/api"); status != 418 || body != "alice mock" {
+		t.Fatalf("alice /api = %d %q", status, body)
+	}
+	if status, body := proxied("bob", "b", "/api"); status != 200 || body != "upstream" {
+		t.Fatalf("bob /api = %d %q", status, body)
+	}
+	// 个人规则未命中时仍按全局规则处理。
+	if status, _ := proxied("alice", "a", "/global"); status != 403 {
+		t.Fatalf("alice /global = %d", status)
+	}
+
+	if resp, _ := manage("DELETE", RouteProfile, basicAuth("alice", "a"), ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d", resp.StatusCode)
+	}
+	if status, _ := proxied("alice", "a", "/api"); status != 200 {
+		t.Fatalf("alice /api after delete = %d", status)
+	}
+}
+
+func TestProfilesScopedByIPWithoutAuth(t *testing.T) {
+	addr := startTestMITM(t, nil)
+	manage := func(method, path, body string) (*http.Response, string) {
+		return doProxyRequest(t, addr, fmt.Sprintf("%s %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n\r\n%s",
+			method, path, managePort(addr), len(body), body))
+	}
+	rules := `{"rules":[{"name":"mock","match":{"path":"/api"},"block":{"status":418}}]}`
+
+	// 未启用认证时 ?identity= 不能指向他人。
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		if resp, _ := manage(method, RouteProfile+"?identity=10.0.0.9", rules); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("cross-identity %s status = %d", method, resp.StatusCode)
+		}
+	}
+	if resp, body := manage("PUT", RouteProfile+"?identity=127.0.0.1", rules); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"identity":"127.0.0.1"`) {
+		t.Fatalf("own PUT: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := manage("PUT", RouteProfile, `{"rules":[{"match":{"host":"x"},"mapLocal":{"dir":"/"}}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("loopback mapLocal PUT status = %d", resp.StatusCode)
+	}
+	if _, body := manage("GET", RouteProfiles, ""); body != `["127.0.0.1"]` {
+		t.Fatalf("profiles = %s", body)
+	}
+}
+
+func TestProfileManageFromLAN(t *testing.T) {
+	var lan string
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil && !ipn.IP.IsLoopback() {
+			lan = ipn.IP.String()
+			break
+		}
+	}
+	if lan == "" {
+		t.Skip("no non-loopback IPv4 address")
+	}
+	addr := startTestMITMAt(t, net.JoinHostPort(lan, "0"), nil)
+	manage := func(method, path, body string) (*http.Response, string) {
+		return doProxyRequest(t, addr, fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s",
+			method, path, addr, len(body), body))
+	}
+
+	// 局域网客户端可以管理自己的规则，但不能访问其他管理接口。
+	if resp, body := manage("PUT", RouteProfile, `{"rules":[]}`); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"identity":"`+lan+`"`) {
+		t.Fatalf("LAN PUT profile: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := manage("PUT", RouteProfile+"?identity=127.0.0.1", `{"rules":[]}`); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("LAN cross-identity PUT status = %d", resp.StatusCode)
+	}
+	if resp, _ := manage("GET", RouteProfiles, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("LAN GET profiles status = %d", resp.StatusCode)
+	}
+	// 局域网客户端不能设置 mapLocal，否则可借此读取代理主机上的任意文件。
+	mapLocal := `{"rules":[{"match":{"host":"x"},"mapLocal":{"dir":"/"}}]}`
+	if resp, _ := manage("PUT", RouteProfile, mapLocal); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("LAN mapLocal PUT status = %d", resp.StatusCode)
+	}
+	if resp, body := manage("GET", RouteProfile, ""); strings.Contains(body, "mapLocal") {
+		t.Fatalf("LAN profile after refused PUT: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestProfilesPersistence(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewProfiles(dir)
+	if err != nil {
+		t.Fatalf("NewProfiles: %v", err)
+	}
+	rs := RuleSet{Rules: []Rule{{Name: "r", Match: RuleMatch{Host: "*.example.com"}, Proxy: "direct"}}}
+	if err := p.Set("10.0.0.1", rs); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := p.Set("x", RuleSet{Mode: "bogus"}); err == nil {
+		t.Fatal("expected invalid rule set to be rejected")
+	}
+
+	reloaded, err := NewProfiles(dir)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	got, ok := reloaded.Get("10.0.0.1")
+	if !ok || len(got.Rules) != 1 || got.Rules[0].Proxy != "direct" {
+		t.Fatalf("reloaded profile = %+v, %v", got, ok)
+	}
+	if ids := reloaded.Identities(); len(ids) != 1 {
+		t.Fatalf("identities = %v", ids)
+	}
+}
@@ -0,0 +1,596 @@
+package core_refactor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ProtoWireType 是 protobuf 编码中的线上类型。
+type ProtoWireType int
+
+const (
+	ProtoVarint     ProtoWireType = 0
+	ProtoFixed64    ProtoWireType = 1
+	ProtoBytes      ProtoWireType = 2
+	ProtoStartGroup ProtoWireType = 3
+	ProtoEndGroup   ProtoWireType = 4
+	ProtoFixed32    ProtoWireType = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// ProtoField 是无 schema 解码得到的一个字段，等价于 protoc --decode_raw 的输出。
+type ProtoField struct {
+	Number   int           `json:"number"`
+	WireType ProtoWireType `json:"wireType"`
+	// Uint 是 varint、fixed64 与 fixed32 字段的原始数值。
+	Uint uint64 `json:"uint,omitempty"`
+	// Bytes 是长度分隔字段的原始字节。
+	Bytes []byte `json:"bytes,omitempty"`
+	// String 在 Bytes 是合法 UTF-8 文本时填充。
+	String string `json:"string,omitempty"`
+	// Message 在 Bytes 可解析为嵌套消息（或字段为 group）时填充；短文本也可能恰好能被解析，需结合上下文判断。
+	Message []ProtoField `json:"message,omitempty"`
+}
+
+// DecodeProto 在没有 schema 的情况下解码 protobuf 消息，只依据字段号与线上类型。
+func DecodeProto(data []byte) ([]ProtoField, error) {
+	fields, rest, err := decodeProtoFields(data, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("protobuf: unexpected end group")
+	}
+	return fields, nil
+}
+
+// decodeProtoFields 解码字段直到数据结束；group 非 0 时遇到对应的 end group 返回剩余数据。
+func decodeProtoFields(data []byte, group, depth int) ([]ProtoField, []byte, error) {
+	if depth > 64 {
+		return nil, nil, errors.New("protobuf: nesting too deep")
+	}
+	fields := []ProtoField{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, errProtoTruncated
+		}
+		data = data[n:]
+		f := ProtoField{Number: int(tag >> 3), WireType: ProtoWireType(tag & 7)}
+		if f.Number <= 0 || tag>>3 > math.MaxInt32 {
+			return nil, nil, fmt.Errorf("protobuf: invalid field number %d", tag>>3)
+		}
+		switch f.WireType {
+		case ProtoVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, nil, errProtoTruncated
+			}
+			f.Uint, data = v, data[n:]
+		case ProtoFixed64:
+			if len(data) < 8 {
+				return nil, nil, errProtoTruncated
+			}
+			f.Uint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case ProtoFixed32:
+			if len(data) < 4 {
+				return nil, nil, errProtoTruncated
+			}
+			f.Uint, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case ProtoBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return nil, nil, errProtoTruncated
+			}
+			f.Bytes, data = data[n:n+int(l)], data[n+int(l):]
+			if utf8.Valid(f.Bytes) {
+				f.String = string(f.Bytes)
+			}
+			if len(f.Bytes) > 0 {
+				if msg, rest, err := decodeProtoFields(f.Bytes, 0, depth+1); err == nil && len(rest) == 0 {
+					f.Message = msg
+				}
+			}
+		case ProtoStartGroup:
+			msg, rest, err := decodeProtoFields(data, f.Number, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			f.Message, data = msg, rest
+		case ProtoEndGroup:
+			if f.Number != group {
+				return nil, nil, fmt.Errorf("protobuf: unexpected end group %d", f.Number)
+			}
+			return fields, data, nil
+		default:
+			return nil, nil, fmt.Errorf("protobuf: invalid wire type %d", f.WireType)
+		}
+		fields = append(fields, f)
+	}
+	if group != 0 {
+		return nil, nil, errProtoTruncated
+	}
+	return fields, nil, nil
+}
+
+// protobuf 字段类型，对应 google.protobuf.FieldDescriptorProto.Type。
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+type protoFieldDesc struct {
+	name     string
+	jsonName string
+	number   int
+	label    int
+	typ      int
+	typeName string // 消息或枚举的全限定名（不含前导点）
+}
+
+type protoMessageDesc struct {
+	name     string
+	fields   map[int]*protoFieldDesc
+	mapEntry bool
+}
+
+// ProtoMethod 描述一个 gRPC 方法的请求与响应消息类型（全限定名）。
+type ProtoMethod struct {
+	Input  string
+	Output string
+}
+
+// ProtoRegistry 保存从 FileDescriptorSet（protoc --descriptor_set_out 的输出）加载的消息、枚举与服务定义，
+// 用于按 schema 解码 gRPC 消息。
+type ProtoRegistry struct {
+	mu       sync.RWMutex
+	messages map[string]*protoMessageDesc
+	enums    map[string]map[int32]string
+	methods  map[string]ProtoMethod // "/pkg.Service/Method" -> 类型
+}
+
+// NewProtoRegistry 创建空的描述符注册表。
+func NewProtoRegistry() *ProtoRegistry {
+	return &ProtoRegistry{
+		messages: make(map[string]*protoMessageDesc),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]ProtoMethod),
+	}
+}
+
+// LoadDescriptorSetFile 从文件加载二进制 FileDescriptorSet。
+func (r *ProtoRegistry) LoadDescriptorSetFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read descriptor set %q: %w", path, err)
+	}
+	if err := r.LoadDescriptorSet(data); err != nil {
+		return fmt.Errorf("load descriptor set %q: %w", path, err)
+	}
+	return nil
+}
+
+// LoadDescriptorSet 加载二进制 FileDescriptorSet，与已有定义合并。
+func (r *ProtoRegistry) LoadDescriptorSet(data []byte) error {
+	set, err := DecodeProto(data)
+	if err != nil {
+		return err
+	}
+	messages := make(map[string]*protoMessageDesc)
+	enums := make(map[string]map[int32]string)
+	methods := make(map[string]ProtoMethod)
+	for _, f := range set {
+		if f.Number != 1 || f.WireType != ProtoBytes {
+			continue
+		}
+		file, err := DecodeProto(f.Bytes)
+		if err != nil {
+			return fmt.Errorf("decode file descriptor: %w", err)
+		}
+		pkg := ""
+		for _, ff := range file {
+			if ff.Number == 2 {
+				pkg = string(ff.Bytes)
+			}
+		}
+		for _, ff := range file {
+			if ff.WireType != ProtoBytes {
+				continue
+			}
+			switch ff.Number {
+			case 4:
+				if err := loadProtoMessage(ff.Bytes, pkg, messages, enums); err != nil {
+					return err
+				}
+			case 5:
+				if err := loadProtoEnum(ff.Bytes, pkg, enums); err != nil {
+					return err
+				}
+			case 6:
+				if err := loadProtoService(ff.Bytes, pkg, methods); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, v := range messages {
+		r.messages[k] = v
+	}
+	for k, v := range enums {
+		r.enums[k] = v
+	}
+	for k, v := range methods {
+		r.methods[k] = v
+	}
+	return nil
+}
+
+func protoQualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func loadProtoMessage(data []byte, scope string, messages map[string]*protoMessageDesc, enums map[string]map[int32]string) error {
+	fields, err := DecodeProto(data)
+	if err != nil {
+		return fmt.Errorf("decode message descriptor: %w", err)
+	}
+	msg := &protoMessageDesc{fields: make(map[int]*protoFieldDesc)}
+	for _, f := range fields {
+		if f.Number == 1 {
+			msg.name = protoQualify(scope, string(f.Bytes))
+		}
+	}
+	for _, f := range fields {
+		switch f.Number {
+		case 2:
+			fd, err := loadProtoField(f.Bytes)
+			if err != nil {
+				return err
+			}
+			msg.fields[fd.number] = fd
+		case 3:
+			if err := loadProtoMessage(f.Bytes, msg.name, messages, enums); err != nil {
+				return err
+			}
+		case 4:
+			if err := loadProtoEnum(f.Bytes, msg.name, enums); err != nil {
+				return err
+			}
+		case 7: // MessageOptions
+			opts, _ := DecodeProto(f.Bytes)
+			for _, o := range opts {
+				if o.Number == 7 && o.Uint != 0 {
+					msg.mapEntry = true
+				}
+			}
+		}
+	}
+	messages[msg.name] = msg
+	return nil
+}
+
+func loadProtoField(data []byte) (*protoFieldDesc, error) {
+	fields, err := DecodeProto(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode field descriptor: %w", err)
+	}
+	fd := &protoFieldDesc{}
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			fd.name = string(f.Bytes)
+		case 3:
+			fd.number = int(f.Uint)
+		case 4:
+			fd.label = int(f.Uint)
+		case 5:
+			fd.typ = int(f.Uint)
+		case 6:
+			fd.typeName = strings.TrimPrefix(string(f.Bytes), ".")
+		case 10:
+			fd.jsonName = string(f.Bytes)
+		}
+	}
+	if fd.jsonName == "" {
+		fd.jsonName = fd.name
+	}
+	return fd, nil
+}
+
+func loadProtoEnum(data []byte, scope string, enums map[string]map[int32]string) error {
+	fields, err := DecodeProto(data)
+	if err != nil {
+		return fmt.Errorf("decode enum descriptor: %w", err)
+	}
+	var name string
+	values := make(map[int32]string)
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			name = protoQualify(scope, string(f.Bytes))
+		case 2:
+			vf, err := DecodeProto(f.Bytes)
+			if err != nil {
+				return fmt.Errorf("decode enum value: %w", err)
+			}
+			var vname string
+			var num int32
+			for _, v := range vf {
+				switch v.Number {
+				case 1:
+					vname = string(v.Bytes)
+				case 2:
+					num = int32(v.Uint)
+				}
+			}
+			values[num] = vname
+		}
+	}
+	enums[name] = values
+	return nil
+}
+
+func loadProtoService(data []byte, pkg string, methods map[string]ProtoMethod) error {
+	fields, err := DecodeProto(data)
+	if err != nil {
+		return fmt.Errorf("decode service descriptor: %w", err)
+	}
+	var svc string
+	for _, f := range fields {
+		if f.Number == 1 {
+			svc = protoQualify(pkg, string(f.Bytes))
+		}
+	}
+	for _, f := range fields {
+		if f.Number != 2 {
+			continue
+		}
+		mf, err := DecodeProto(f.Bytes)
+		if err != nil {
+			return fmt.Errorf("decode method descriptor: %w", err)
+		}
+		var name string
+		var m ProtoMethod
+		for _, v := range mf {
+			switch v.Number {
+			case 1:
+				name = string(v.Bytes)
+			case 2:
+				m.Input = strings.TrimPrefix(string(v.Bytes), ".")
+			case 3:
+				m.Output = strings.TrimPrefix(string(v.Bytes), ".")
+			}
+		}
+		methods["/"+svc+"/"+name] = m
+	}
+	return nil
+}
+
+// Method 按 gRPC 调用路径（如 /helloworld.Greeter/SayHello）查找方法的消息类型。
+func (r *ProtoRegistry) Method(path string) (ProtoMethod, bool) {
+	if r == nil {
+		return ProtoMethod{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.methods[path]
+	return m, ok
+}
+
+// Decode 按消息类型（全限定名）解码 protobuf 数据，结果的形式与 protojson 一致：
+// 键为 JSON 字段名，64 位整数为字符串，bytes 为 base64，枚举为名称；未知字段以字段号为键。
+func (r *ProtoRegistry) Decode(typeName string, data []byte) (map[string]any, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	msg, ok := r.messages[strings.TrimPrefix(typeName, ".")]
+	if !ok {
+		return nil, fmt.Errorf("protobuf: unknown message type %q", typeName)
+	}
+	fields, err := DecodeProto(data)
+	if err != nil {
+		return nil, err
+	}
+	return r.decodeMessage(msg, fields, 0)
+}
+
+func (r *ProtoRegistry) decodeMessage(msg *protoMessageDesc, fields []ProtoField, depth int) (map[string]any, error) {
+	if depth > 64 {
+		return nil, errors.New("protobuf: nesting too deep")
+	}
+	out := make(map[string]any)
+	for _, f := range fields {
+		fd, ok := msg.fields[f.Number]
+		if !ok {
+			out[strconv.Itoa(f.Number)] = protoRawValue(f)
+			continue
+		}
+		if entry, ok := r.messages[fd.typeName]; ok && entry.mapEntry && fd.label == protoLabelRepeated {
+			m, _ := out[fd.jsonName].(map[string]any)
+			if m == nil {
+				m = make(map[string]any)
+				out[fd.jsonName] = m
+			}
+			kv, err := r.decodeMessage(entry, f.Message, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			key := ""
+			if k, ok := entry.fields[1]; ok {
+				if v, ok := kv[k.jsonName]; ok {
+					key = fmt.Sprint(v)
+				}
+			}
+			if v, ok := entry.fields[2]; ok {
+				m[key] = kv[v.jsonName]
+			}
+			continue
+		}
+
+		var values []any
+		if f.WireType == ProtoBytes && fd.typ != protoTypeString && fd.typ != protoTypeBytes && fd.typ != protoTypeMessage {
+			// packed 编码的重复标量字段。
+			vs, err := r.unpack(fd, f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			values = vs
+		} else {
+			v, err := r.decodeValue(fd, f, depth)
+			if err != nil {
+				return nil, err
+			}
+			values = []any{v}
+		}
+		if fd.label == protoLabelRepeated {
+			prev, _ := out[fd.jsonName].([]any)
+			out[fd.jsonName] = append(prev, values...)
+		} else if len(values) > 0 {
+			out[fd.jsonName] = values[len(values)-1]
+		}
+	}
+	return out, nil
+}
+
+func (r *ProtoRegistry) unpack(fd *protoFieldDesc, data []byte) ([]any, error) {
+	var out []any
+	for len(data) > 0 {
+		f := ProtoField{Number: fd.number}
+		switch fd.typ {
+		case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+			if len(data) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.WireType, f.Uint, data = ProtoFixed64, binary.LittleEndian.Uint64(data), data[8:]
+		case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+			if len(data) < 4 {
+				return nil, errProtoTruncated
+			}
+			f.WireType, f.Uint, data = ProtoFixed32, uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+			f.WireType, f.Uint, data = ProtoVarint, v, data[n:]
+		}
+		v, err := r.decodeValue(fd, f, 0)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (r *ProtoRegistry) decodeValue(fd *protoFieldDesc, f ProtoField, depth int) (any, error) {
+	switch fd.typ {
+	case protoTypeDouble:
+		return protoFloat(math.Float64frombits(f.Uint), 64), nil
+	case protoTypeFloat:
+		return protoFloat(float64(math.Float32frombits(uint32(f.Uint))), 32), nil
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(f.Uint), 10), nil
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(f.Uint, 10), nil
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(f.Uint>>1)^-int64(f.Uint&1), 10), nil
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(f.Uint), nil
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(f.Uint), nil
+	case protoTypeSint32:
+		return int32(uint32(f.Uint)>>1) ^ -int32(f.Uint&1), nil
+	case protoTypeBool:
+		return f.Uint != 0, nil
+	case protoTypeString:
+		return string(f.Bytes), nil
+	case protoTypeBytes:
+		return f.Bytes, nil
+	case protoTypeEnum:
+		if name, ok := r.enums[fd.typeName][int32(f.Uint)]; ok {
+			return name, nil
+		}
+		return int32(f.Uint), nil
+	case protoTypeMessage, protoTypeGroup:
+		msg, ok := r.messages[fd.typeName]
+		if !ok {
+			return protoRawValue(f), nil
+		}
+		fields := f.Message
+		if f.WireType == ProtoBytes && fields == nil {
+			// 空消息或无法解析的内容：交给 DecodeProto 报告具体错误。
+			var err error
+			if fields, err = DecodeProto(f.Bytes); err != nil {
+				return nil, err
+			}
+		}
+		return r.decodeMessage(msg, fields, depth+1)
+	}
+	return protoRawValue(f), nil
+}
+
+// protoFloat 返回浮点字段的展示值。encoding/json 无法编码 NaN 与 ±Inf，
+// 与 protojson 一样以字符串 "NaN"、"Infinity"、"-Infinity" 表示。
+func protoFloat(v float64, bits int) any {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	if bits == 32 {
+		return float32(v)
+	}
+	return v
+}
+
+// protoRawValue 返回无 schema 字段的展示值。
+func protoRawValue(f ProtoField) any {
+	switch f.WireType {
+	case ProtoBytes:
+		if f.Message != nil && f.String == "" {
+			return f.Message
+		}
+		if f.String != "" || len(f.Bytes) == 0 {
+			return f.String
+		}
+		return f.Bytes
+	case ProtoStartGroup:
+		return f.Message
+	}
+	return f.Uint
+}
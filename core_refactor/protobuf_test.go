@@ -0,0 +1,152 @@
+package core_refactor
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// pb 是测试用的最小 protobuf 编码器。
+type pb []byte
+
+func (b pb) tag(num int, wt ProtoWireType) pb {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wt))
+}
+
+func (b pb) varint(num int, v uint64) pb {
+	return binary.AppendUvarint(b.tag(num, ProtoVarint), v)
+}
+
+func (b pb) bytes(num int, v []byte) pb {
+	b = binary.AppendUvarint(b.tag(num, ProtoBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func (b pb) str(num int, s string) pb { return b.bytes(num, []byte(s)) }
+
+// testDescriptorSet 构造 greet.proto 的 FileDescriptorSet：
+//
+//	enum Mood { HAPPY = 0; SAD = 1; }
+//	message HelloRequest { string name = 1; int64 count = 2; Mood mood = 3; repeated int32 tags = 4; map<string, string> labels = 5; }
+//	message HelloReply { string message = 1; }
+//	service Greeter { rpc SayHello(HelloRequest) returns (HelloReply); }
+func testDescriptorSet() []byte {
+	field := func(name string, num, label, typ int, typeName, jsonName string) []byte {
+		f := pb(nil).str(1, name).varint(3, uint64(num)).varint(4, uint64(label)).varint(5, uint64(typ))
+		if typeName != "" {
+			f = f.str(6, typeName)
+		}
+		return f.str(10, jsonName)
+	}
+	entry := pb(nil).str(1, "LabelsEntry").
+		bytes(2, field("key", 1, 1, protoTypeString, "", "key")).
+		bytes(2, field("value", 2, 1, protoTypeString, "", "value")).
+		bytes(7, pb(nil).varint(7, 1))
+	req := pb(nil).str(1, "HelloRequest").
+		bytes(2, field("name", 1, 1, protoTypeString, "", "name")).
+		bytes(2, field("count", 2, 1, protoTypeInt64, "", "count")).
+		bytes(2, field("mood", 3, 1, protoTypeEnum, ".greet.Mood", "mood")).
+		bytes(2, field("tags", 4, 3, protoTypeInt32, "", "tags")).
+		bytes(2, field("labels", 5, 3, protoTypeMessage, ".greet.HelloRequest.LabelsEntry", "labels")).
+		bytes(3, entry)
+	reply := pb(nil).str(1, "HelloReply").bytes(2, field("message", 1, 1, protoTypeString, "", "message"))
+	mood := pb(nil).str(1, "Mood").
+		bytes(2, pb(nil).str(1, "HAPPY").varint(2, 0)).
+		bytes(2, pb(nil).str(1, "SAD").varint(2, 1))
+	svc := pb(nil).str(1, "Greeter").
+		bytes(2, pb(nil).str(1, "SayHello").str(2, ".greet.HelloRequest").str(3, ".greet.HelloReply"))
+	file := pb(nil).str(1, "greet.proto").str(2, "greet").bytes(4, req).bytes(4, reply).bytes(5, mood).bytes(6, svc)
+	return pb(nil).bytes(1, file)
+}
+
+// testHelloRequest 编码 {name: "bob", count: 7, mood: SAD, tags: [1, 2, 300], labels: {env: prod}}。
+func testHelloRequest() []byte {
+	return pb(nil).str(1, "bob").varint(2, 7).varint(3, 1).
+		bytes(4, pb(nil).packed(1, 2, 300)).
+		bytes(5, pb(nil).str(1, "env").str(2, "prod"))
+}
+
+// packed 追加 packed 编码的 varint 序列。
+func (b pb) packed(vs ...uint64) pb {
+	for _, v := range vs {
+		b = binary.AppendUvarint(b, v)
+	}
+	return b
+}
+
+func TestDecodeProtoSchemaless(t *testing.T) {
+	data := pb(nil).varint(1, 150).str(2, "testing").bytes(3, pb(nil).varint(1, 1))
+	data = binary.LittleEndian.AppendUint32(data.tag(4, ProtoFixed32), 42)
+	fields, err := DecodeProto(data)
+	if err != nil {
+		t.Fatalf("DecodeProto: %v", err)
+	}
+	if len(fields) != 4 || fields[0].Uint != 150 || fields[1].String != "testing" ||
+		len(fields[2].Message) != 1 || fields[2].Message[0].Uint != 1 || fields[3].Uint != 42 {
+		t.Fatalf("fields = %+v", fields)
+	}
+
+	for _, bad := range [][]byte{{0x0a, 0x05, 'a'}, {0x08}, {0x0f}, {0x00, 0x01}} {
+		if _, err := DecodeProto(bad); err == nil {
+			t.Fatalf("DecodeProto(%x) succeeded", bad)
+		}
+	}
+}
+
+func TestProtoRegistryDecodeNonFiniteFloats(t *testing.T) {
+	field := func(name string, num, label, typ int) []byte {
+		return pb(nil).str(1, name).varint(3, uint64(num)).varint(4, uint64(label)).varint(5, uint64(typ)).str(10, name)
+	}
+	msg := pb(nil).str(1, "Sample").
+		bytes(2, field("d", 1, 1, protoTypeDouble)).
+		bytes(2, field("f", 2, 1, protoTypeFloat)).
+		bytes(2, field("r", 3, 3, protoTypeDouble))
+	r := NewProtoRegistry()
+	if err := r.LoadDescriptorSet(pb(nil).bytes(1, pb(nil).str(1, "m.proto").str(2, "m").bytes(4, msg))); err != nil {
+		t.Fatalf("LoadDescriptorSet: %v", err)
+	}
+
+	data := binary.LittleEndian.AppendUint64(pb(nil).tag(1, ProtoFixed64), math.Float64bits(math.NaN()))
+	data = binary.LittleEndian.AppendUint32(pb(data).tag(2, ProtoFixed32), math.Float32bits(float32(math.Inf(-1))))
+	var packed []byte
+	for _, v := range []float64{math.Inf(1), 1.5} {
+		packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(v))
+	}
+	got, err := r.Decode("m.Sample", pb(data).bytes(3, packed))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	out, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if want := `{"d":"NaN","f":"-Infinity","r":["Infinity",1.5]}`; string(out) != want {
+		t.Fatalf("decoded = %s, want %s", out, want)
+	}
+}
+
+func TestProtoRegistryDecode(t *testing.T) {
+	r := NewProtoRegistry()
+	if err := r.LoadDescriptorSet(testDescriptorSet()); err != nil {
+		t.Fatalf("LoadDescriptorSet: %v", err)
+	}
+	m, ok := r.Method("/greet.Greeter/SayHello")
+	if !ok || m.Input != "greet.HelloRequest" || m.Output != "greet.HelloReply" {
+		t.Fatalf("method = %+v, %v", m, ok)
+	}
+
+	got, err := r.Decode(m.Input, append(testHelloRequest(), pb(nil).varint(99, 5)...))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	out, _ := json.Marshal(got)
+	want := `{"99":5,"count":"7","labels":{"env":"prod"},"mood":"SAD","name":"bob","tags":[1,2,300]}`
+	if string(out) != want {
+		t.Fatalf("decoded = %s, want %s", out, want)
+	}
+
+	if _, err := r.Decode("greet.Missing", nil); err == nil {
+		t.Fatal("expected error for unknown type")
+	}
+}
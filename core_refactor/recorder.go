@@ -0,0 +1,418 @@
+package core_refactor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordMode 是录制回放器的工作模式。
+type RecordMode string
+
+const (
+	// RecordOff 不录制也不回放。
+	RecordOff RecordMode = "off"
+	// RecordRecord 转发到上游并把每个响应保存到磁盘。
+	RecordRecord RecordMode = "record"
+	// RecordPlayback 只从磁盘回放，不访问上游（未命中按 UnmatchedPolicy 处理）。
+	RecordPlayback RecordMode = "playback"
+)
+
+// UnmatchedPolicy 决定回放模式下没有录制记录的请求如何处理。
+type UnmatchedPolicy string
+
+const (
+	// UnmatchedNotFound 返回 404。
+	UnmatchedNotFound UnmatchedPolicy = "404"
+	// UnmatchedPassthrough 照常转发到上游。
+	UnmatchedPassthrough UnmatchedPolicy = "passthrough"
+	// UnmatchedError 返回 502，便于在 CI 中发现遗漏的录制。
+	UnmatchedError UnmatchedPolicy = "error"
+)
+
+// RecorderConfig 配置录制回放器。
+type RecorderConfig struct {
+	// Dir 录制文件目录，按主机分子目录保存。
+	Dir  string
+	Mode RecordMode
+	// Unmatched 回放未命中的处理方式，默认 UnmatchedNotFound。
+	Unmatched UnmatchedPolicy
+	// KeyHeaders 参与请求匹配的请求头（如 Accept、Authorization）。
+	KeyHeaders []string
+	// IgnoreQuery 匹配时忽略的查询参数（如时间戳形式的防缓存参数）。
+	IgnoreQuery []string
+	// MaxBodySize 单条录制的响应体上限，<= 0 时使用 DefaultRecordMaxBody；
+	// 超过上限的响应照常转发，但不保存并记录警告。
+	MaxBodySize int64
+}
+
+// DefaultRecordMaxBody 是默认的单条录制响应体上限。
+const DefaultRecordMaxBody = 32 << 20
+
+// Recording 是一条保存在磁盘上的录制记录。
+type Recording struct {
+	Key        string      `json:"key"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	KeyHeaders http.Header `json:"keyHeaders,omitempty"`
+	BodyHash   string      `json:"bodyHash,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	RecordedAt time.Time   `json:"recordedAt"`
+}
+
+// Recorder 以规范化请求为键录制响应，并可离线回放。
+type Recorder struct {
+	mu  sync.RWMutex
+	cfg RecorderConfig
+}
+
+// NewRecorder 创建录制回放器。
+func NewRecorder(cfg RecorderConfig) (*Recorder, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("recorder dir is required")
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = RecordOff
+	}
+	if cfg.Unmatched == "" {
+		cfg.Unmatched = UnmatchedNotFound
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultRecordMaxBody
+	}
+	r := &Recorder{cfg: cfg}
+	if err := r.SetMode(cfg.Mode); err != nil {
+		return nil, err
+	}
+	switch cfg.Unmatched {
+	case UnmatchedNotFound, UnmatchedPassthrough, UnmatchedError:
+	default:
+		return nil, fmt.Errorf("unknown unmatched policy %q", cfg.Unmatched)
+	}
+	return r, nil
+}
+
+// SetMode 切换工作模式。
+func (r *Recorder) SetMode(mode RecordMode) error {
+	switch mode {
+	case RecordOff, RecordPlayback:
+	case RecordRecord:
+		if err := os.MkdirAll(r.cfg.Dir, 0755); err != nil {
+			return fmt.Errorf("create recorder dir: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown record mode %q", mode)
+	}
+	r.mu.Lock()
+	r.cfg.Mode = mode
+	r.mu.Unlock()
+	return nil
+}
+
+// Mode 返回当前工作模式。
+func (r *Recorder) Mode() RecordMode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg.Mode
+}
+
+func (r *Recorder) config() RecorderConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg
+}
+
+// Key 计算请求的匹配键：方法、规范化 URL、KeyHeaders 与请求体哈希的 SHA-256。
+func (r *Recorder) Key(req *http.Request) string {
+	return r.describe(req).Key
+}
+
+// describe 生成请求的规范化描述，Key 字段为其哈希。
+func (r *Recorder) describe(req *http.Request) Recording {
+	cfg := r.config()
+	rec := Recording{
+		Method: strings.ToUpper(req.Method),
+		URL:    normalizeURL(req, cfg.IgnoreQuery),
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", rec.Method, rec.URL)
+	keys := append([]string(nil), cfg.KeyHeaders...)
+	sort.Strings(keys)
+	for _, k := range keys {
+		k = http.CanonicalHeaderKey(k)
+		if v, ok := req.Header[k]; ok {
+			if rec.KeyHeaders == nil {
+				rec.KeyHeaders = make(http.Header)
+			}
+			rec.KeyHeaders[k] = v
+			fmt.Fprintf(h, "%s: %s\n", k, strings.Join(v, ", "))
+		}
+	}
+	rec.BodyHash = requestBodyHash(req)
+	fmt.Fprintf(h, "\n%s", rec.BodyHash)
+	rec.Key = hex.EncodeToString(h.Sum(nil))
+	return rec
+}
+
+// normalizeURL 返回小写主机、去掉默认端口、查询参数排序并剔除忽略项后的 URL。
+func normalizeURL(req *http.Request, ignore []string) string {
+	scheme := strings.ToLower(req.URL.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := strings.ToLower(req.Host)
+	if host == "" {
+		host = strings.ToLower(req.URL.Host)
+	}
+	if h, port := hostPort(host, false); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = bracketHost(h)
+	}
+
+	q := req.URL.Query()
+	for _, k := range ignore {
+		q.Del(k)
+	}
+	u := scheme + "://" + host + req.URL.EscapedPath()
+	if enc := q.Encode(); enc != "" { // Encode 按键排序
+		u += "?" + enc
+	}
+	return u
+}
+
+// requestBodyHash 返回请求体的 SHA-256；无法重复读取的大请求体以长度代替。
+func requestBodyHash(req *http.Request) string {
+	if req.GetBody == nil {
+		if req.ContentLength > 0 {
+			return "len:" + strconv.FormatInt(req.ContentLength, 10)
+		}
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	h := sha256.New()
+	if n, _ := io.Copy(h, body); n == 0 {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// path 返回录制文件路径：<Dir>/<主机>/<Key>.json。主机取自客户端可控的 Host，
+// 路径分隔符与 "."、".." 等特殊名被转义；结果不在 Dir 下时返回 false。
+func (r *Recorder) path(rec Recording) (string, bool) {
+	host := rec.URL
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(host)
+	if host != "" && strings.Trim(host, ".") == "" {
+		host = strings.ReplaceAll(host, ".", "%2E")
+	}
+	p := filepath.Join(r.cfg.Dir, host, rec.Key+".json")
+	if rel, err := filepath.Rel(r.cfg.Dir, p); err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return p, true
+}
+
+// Lookup 返回请求对应的录制响应。
+func (r *Recorder) Lookup(req *http.Request) (*http.Response, bool) {
+	p, ok := r.path(r.describe(req))
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, false
+	}
+	header := rec.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	return &http.Response{
+		StatusCode:    rec.Status,
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+	}, true
+}
+
+func (r *Recorder) recording() bool {
+	return r != nil && r.Mode() == RecordRecord
+}
+
+// record 包装响应体，读完后把完整响应写入磁盘；中途出错或超过 MaxBodySize 的响应不保存。
+// SSE 与协议升级（WebSocket）响应没有确定的结尾，不录制。
+func (r *Recorder) record(req *http.Request, resp *http.Response, logger *slog.Logger) {
+	if resp.StatusCode == http.StatusSwitchingProtocols || isEventStream(resp) {
+		return
+	}
+	rec := r.describe(req)
+	p, ok := r.path(rec)
+	if !ok {
+		return
+	}
+	limit := r.config().MaxBodySize
+	if resp.ContentLength > limit {
+		logger.Warn("response too large to record", "size", resp.ContentLength, "limit", limit)
+		return
+	}
+	rec.Status = resp.StatusCode
+	rec.Header = resp.Header.Clone()
+	resp.Body = &recordingBody{ReadCloser: resp.Body, rec: rec, path: p, want: resp.ContentLength, limit: limit, logger: logger}
+}
+
+type recordingBody struct {
+	io.ReadCloser
+	rec     Recording
+	path    string
+	want    int64
+	limit   int64
+	logger  *slog.Logger
+	buf     bytes.Buffer
+	dropped bool
+	once    sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.dropped {
+		return n, err
+	}
+	if int64(b.buf.Len()+n) > b.limit {
+		// 超过上限：放弃本条录制并释放已缓存的内容，响应体继续转发。
+		b.dropped = true
+		b.buf = bytes.Buffer{}
+		b.once.Do(func() {})
+		b.logger.Warn("response too large to record", "limit", b.limit)
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(b.save)
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	// 长度已知且已读满时（如空响应体不会读到 EOF）同样保存；否则说明响应不完整，放弃保存。
+	if b.want >= 0 && int64(b.buf.Len()) == b.want {
+		b.once.Do(b.save)
+	}
+	b.once.Do(func() {})
+	return b.ReadCloser.Close()
+}
+
+func (b *recordingBody) save() {
+	b.rec.Body = b.buf.Bytes()
+	b.rec.RecordedAt = time.Now()
+	data, err := json.MarshalIndent(b.rec, "", "  ")
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	// 先写同目录下的唯一临时文件再重命名，避免回放读到写了一半的记录，
+	// 同一键的并发录制也不会互相覆盖临时文件。
+	f, err := os.CreateTemp(dir, filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, b.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// playback 在回放模式下返回录制的响应；handled 为 false 表示应继续转发到上游。
+func (r *Recorder) playback(req *http.Request) (resp *http.Response, handled bool) {
+	if r == nil || r.Mode() != RecordPlayback {
+		return nil, false
+	}
+	if resp, ok := r.Lookup(req); ok {
+		return resp, true
+	}
+	switch r.config().Unmatched {
+	case UnmatchedPassthrough:
+		return nil, false
+	case UnmatchedError:
+		return textResponse(req, http.StatusBadGateway, fmt.Sprintf("playback: no recording for %s %s", req.Method, req.URL)), true
+	default:
+		return textResponse(req, http.StatusNotFound, fmt.Sprintf("playback: no recording for %s %s", req.Method, req.URL)), true
+	}
+}
+
+// recorderStatus 是管理接口返回的录制回放器状态。
+type recorderStatus struct {
+	Mode      RecordMode      `json:"mode"`
+	Unmatched UnmatchedPolicy `json:"unmatched"`
+	Dir       string          `json:"dir"`
+}
+
+// handleRecorder 查询（GET）或切换（PUT/POST {"mode":"playback"}）录制回放模式。
+func (m *MITM) handleRecorder(w http.ResponseWriter, r *http.Request) {
+	if m.recorder == nil {
+		http.Error(w, "recorder is disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var st recorderStatus
+		if err := json.NewDecoder(r.Body).Decode(&st); err != nil {
+			http.Error(w, "decode recorder status: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.recorder.SetMode(st.Mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := m.recorder.config()
+	writeJSON(w, http.StatusOK, recorderStatus{Mode: cfg.Mode, Unmatched: cfg.Unmatched, Dir: cfg.Dir})
+}
@@ -0,0 +1,196 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecorderKey(t *testing.T) {
+	r, err := NewRecorder(RecorderConfig{Dir: t.TempDir(), KeyHeaders: []string{"accept"}, IgnoreQuery: []string{"_t"}})
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	newReq := func(method, url, accept, body string) *http.Request {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(body)), nil }
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return req
+	}
+
+	base := r.Key(newReq("GET", "http://Example.com:80/a?b=2&a=1&_t=123", "json", ""))
+	if k := r.Key(newReq("get", "http://example.com/a?a=1&b=2", "json", "")); k != base {
+		t.Fatal("normalized requests must share a key")
+	}
+	for _, req := range []*http.Request{
+		newReq("POST", "http://example.com/a?a=1&b=2", "json", ""),
+		newReq("GET", "http://example.com/a?a=1", "json", ""),
+		newReq("GET", "http://example.com/a?a=1&b=2", "html", ""),
+		newReq("GET", "http://example.com/a?a=1&b=2", "json", "body"),
+	} {
+		if r.Key(req) == base {
+			t.Fatalf("%s %s must have a different key", req.Method, req.URL)
+		}
+	}
+
+	if _, err := NewRecorder(RecorderConfig{Dir: t.TempDir(), Mode: "replay"}); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestRecorderPathStaysInDir(t *testing.T) {
+	dir := t.TempDir()
+	r, _ := NewRecorder(RecorderConfig{Dir: dir})
+	for url, want := range map[string]string{
+		"http://../api":         "%2E%2E",
+		"http://./api":          "%2E",
+		"http://..%2F..%2F/api": "..%2F..%2F",
+		"http://a.test:8080/x":  "a.test_8080",
+		"http://[::1]:80/":      "[__1]_80",
+	} {
+		p, ok := r.path(Recording{URL: url, Key: "k"})
+		if !ok || p != filepath.Join(dir, want, "k.json") {
+			t.Errorf("path(%q) = %q, %v, want host dir %q", url, p, ok, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	req.Host = ".."
+	if p, ok := r.path(r.describe(req)); !ok || filepath.Dir(filepath.Dir(p)) != dir {
+		t.Fatalf("Host .. path = %q, %v", p, ok)
+	}
+}
+
+func TestRecorderRecordAndPlayback(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "1")
+		fmt.Fprintf(w, "live %s %s", r.URL.Path, body)
+	}))
+	host := upstream.Listener.Addr().String()
+
+	dir := t.TempDir()
+	rec, _ := NewRecorder(RecorderConfig{Dir: dir, Mode: RecordRecord})
+	addr := startTestMITM(t, nil, WithRecorder(rec))
+
+	post := fmt.Sprintf("POST /api HTTP/1.1\r\nHost: %s\r\nContent-Length: 2\r\n\r\nhi", host)
+	if _, body := doProxyRequest(t, addr, post); body != "live /api hi" {
+		t.Fatalf("record body = %q", body)
+	}
+	doProxyRequest(t, addr, fmt.Sprintf("GET /empty HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+
+	var files []string
+	for i := 0; i < 100 && len(files) < 2; i++ {
+		files, _ = filepath.Glob(filepath.Join(dir, "*", "*.json"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(files) != 2 {
+		t.Fatalf("recorded files = %v", files)
+	}
+
+	upstream.Close()
+	rec.SetMode(RecordPlayback)
+
+	resp, body := doProxyRequest(t, addr, post)
+	if resp.StatusCode != 200 || body != "live /api hi" || resp.Header.Get("X-Upstream") != "1" {
+		t.Fatalf("playback: %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("upstream hits = %d, want 2", hits.Load())
+	}
+
+	other := fmt.Sprintf("POST /api HTTP/1.1\r\nHost: %s\r\nContent-Length: 3\r\n\r\nbye", host)
+	if resp, _ := doProxyRequest(t, addr, other); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unmatched status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRecorderUnmatchedPolicy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("live"))
+	}))
+	t.Cleanup(upstream.Close)
+	raw := fmt.Sprintf("GET /x HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Listener.Addr())
+
+	for policy, want := range map[UnmatchedPolicy]int{UnmatchedPassthrough: 200, UnmatchedError: 502} {
+		rec, _ := NewRecorder(RecorderConfig{Dir: t.TempDir(), Mode: RecordPlayback, Unmatched: policy})
+		addr := startTestMITM(t, nil, WithRecorder(rec))
+		if resp, _ := doProxyRequest(t, addr, raw); resp.StatusCode != want {
+			t.Fatalf("%s: status = %d, want %d", policy, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestRecorderSkipsLargeAndStreamingResponses(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked":
+			w.(http.Flusher).Flush()
+			io.WriteString(w, big)
+		case "/sized":
+			io.WriteString(w, big)
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: a\n\n")
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	host := upstream.Listener.Addr().String()
+
+	dir := t.TempDir()
+	rec, _ := NewRecorder(RecorderConfig{Dir: dir, Mode: RecordRecord, MaxBodySize: 10})
+	addr := startTestMITM(t, nil, WithRecorder(rec))
+	for path, want := range map[string]string{"/chunked": big, "/sized": big, "/events": "data: a\n\n", "/small": "ok"} {
+		if _, body := doProxyRequest(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host)); body != want {
+			t.Fatalf("%s body = %q", path, body)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(files) != 1 {
+		t.Fatalf("recorded files = %v, want only /small", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), "/small") {
+		t.Fatalf("recorded %s", data)
+	}
+}
+
+func TestRecorderConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host", "k.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := &recordingBody{rec: Recording{Key: "k", Status: 200}, path: path}
+			fmt.Fprintf(&b.buf, "body %d", i)
+			b.save()
+		}(i)
+	}
+	wg.Wait()
+	var got Recording
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &got); err != nil || !strings.HasPrefix(string(got.Body), "body ") {
+		t.Fatalf("recording = %s, %v", data, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*")); len(files) != 1 {
+		t.Fatalf("leftover files = %v", files)
+	}
+}
@@ -0,0 +1,197 @@
+package core_refactor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ReplayEdit 描述重放前对原请求的修改，零值字段保持不变；Header 非 nil 时整体替换。
+type ReplayEdit struct {
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *string     `json:"body,omitempty"`
+}
+
+// ReplayResult 是一次重放的原始记录与新记录。
+type ReplayResult struct {
+	Original *CapturedExchange
+	Replayed *CapturedExchange
+}
+
+// Do 不经过客户端连接，按与代理转发相同的路径发送请求：规则引擎（含请求所属 Flow 身份的个人规则）、ProxyFunc、
+// 连接池、重试与熔断、上游 TLS 设置均生效，启用抓包时同样会被记录。
+// 调用方负责关闭返回响应的 Body。
+func (m *MITM) Do(req *http.Request) (*http.Response, error) {
+	resp, _, err := m.do(req)
+	return resp, err
+}
+
+func (m *MITM) do(req *http.Request) (*http.Response, *captureRecorder, error) {
+	if FlowFromRequest(req) == nil {
+		req = req.WithContext(contextWithFlow(req.Context(), newFlow("replay")))
+	}
+	flow := FlowFromRequest(req)
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	if req.GetBody == nil && req.Body != http.NoBody {
+		body, err := bufferBody(req.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		setRequestBody(req, body)
+	}
+
+	rule := m.applyRules(req)
+	flow.rule = rule
+	capture := m.startCapture(req)
+	if rule != nil && rule.Response != nil {
+		capture.response(rule.Response)
+		return rule.Response, capture, nil
+	}
+
+	resp, srv, err := m.roundTrip(req.Context(), req)
+	if err != nil {
+		capture.fail(err)
+		return nil, capture, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		srv.Close()
+		err := errors.New("protocol upgrade is not supported outside a client connection")
+		capture.fail(err)
+		return nil, capture, err
+	}
+	rule.applyResponse(resp)
+	capture.response(resp)
+	return resp, capture, nil
+}
+
+// Get 返回指定 Flow ID 的抓包记录。
+func (s *CaptureStore) Get(flowID uint64) (*CapturedExchange, bool) {
+	for _, e := range s.Entries(CaptureFilter{}) {
+		if e.FlowID == flowID {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Replay 按抓包记录重新发送请求（可先经 edit 修改），读取完整响应后返回原始与新的记录，
+// 新记录同时加入抓包存储。需要通过 WithCapture 启用抓包。
+func (m *MITM) Replay(ctx context.Context, flowID uint64, edit *ReplayEdit) (*ReplayResult, error) {
+	if m.capture == nil {
+		return nil, errors.New("capture is disabled")
+	}
+	orig, ok := m.capture.Get(flowID)
+	if !ok {
+		return nil, fmt.Errorf("flow %d not found", flowID)
+	}
+	req, err := replayRequest(orig, edit)
+	if err != nil {
+		return nil, err
+	}
+	// 沿用原请求方的身份，使其个人规则在重放时同样生效。
+	flow := newFlow(orig.ClientAddr)
+	flow.User = orig.User
+	req = req.WithContext(contextWithFlow(ctx, flow))
+
+	res := &ReplayResult{Original: orig}
+	resp, capture, err := m.do(req)
+	if err == nil {
+		// 读完响应体以完成记录并归还上游连接。
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if capture != nil {
+		res.Replayed = capture.entry
+	}
+	return res, err
+}
+
+// replayRequest 由抓包记录与修改构造新的请求。
+func replayRequest(orig *CapturedExchange, edit *ReplayEdit) (*http.Request, error) {
+	if edit == nil {
+		edit = &ReplayEdit{}
+	}
+	method, rawURL := orig.Request.Method, orig.Request.URL
+	if edit.Method != "" {
+		method = edit.Method
+	}
+	if edit.URL != "" {
+		rawURL = edit.URL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad replay url %q", rawURL)
+	}
+
+	body := orig.Request.Body
+	if edit.Body != nil {
+		body = []byte(*edit.Body)
+	} else if orig.Request.Truncated {
+		return nil, errors.New("request body was not fully captured, provide a body to replay")
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	header := orig.Request.Header
+	if edit.Header != nil {
+		header = edit.Header
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for _, h := range []string{"Content-Length", "Transfer-Encoding", "Proxy-Connection", "Proxy-Authorization"} {
+		req.Header.Del(h)
+	}
+	return req, nil
+}
+
+// replayCommand 是管理接口重放请求的请求体。
+type replayCommand struct {
+	ID uint64 `json:"id"`
+	ReplayEdit
+}
+
+// handleReplay 重放抓包记录：POST {"id":1,...修改字段}，返回原始与新的 HAR 条目。
+func (m *MITM) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var cmd replayCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "decode replay command: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := m.Replay(r.Context(), cmd.ID, &cmd.ReplayEdit)
+	if res == nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := map[string]interface{}{"original": harEntry(res.Original)}
+	if res.Replayed != nil {
+		out["replayed"] = harEntry(res.Replayed)
+	}
+	if err != nil {
+		out["error"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
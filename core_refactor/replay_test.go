@@ -0,0 +1,132 @@
+package core_refactor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newReplaySetup(t *testing.T, opts ...Option) (m *MITM, addr, host string) {
+	t.Helper()
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %s %s %s %s", hits.Add(1), r.Method, r.URL.RequestURI(), r.Header.Get("X-Token"), body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	opts = append([]Option{WithCapture(NewCaptureStore(CaptureConfig{}))}, opts...)
+	addr = startTestMITM(t, func(mm *MITM) { m = mm }, opts...)
+	return m, addr, upstream.Listener.Addr().String()
+}
+
+func waitCaptured(t *testing.T, s *CaptureStore, n int) []*CapturedExchange {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if e := s.Entries(CaptureFilter{}); len(e) >= n {
+			return e
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d captured entries", n)
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	m, addr, host := newReplaySetup(t)
+	doProxyRequest(t, addr, fmt.Sprintf("POST /items?a=1 HTTP/1.1\r\nHost: %s\r\nX-Token: t1\r\nContent-Length: 3\r\n\r\nabc", host))
+	orig := waitCaptured(t, m.Capture(), 1)[0]
+
+	res, err := m.Replay(context.Background(), orig.FlowID, nil)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got := string(res.Replayed.Response.Body); got != "2 POST /items?a=1 t1 abc" {
+		t.Fatalf("replayed body = %q", got)
+	}
+	if res.Original != orig || res.Replayed.FlowID == orig.FlowID {
+		t.Fatal("replay must produce a new flow")
+	}
+
+	body := "xyz"
+	res, err = m.Replay(context.Background(), orig.FlowID, &ReplayEdit{
+		Method: "PUT",
+		URL:    fmt.Sprintf("http://%s/items/2", host),
+		Header: http.Header{"X-Token": {"t2"}},
+		Body:   &body,
+	})
+	if err != nil {
+		t.Fatalf("edited Replay: %v", err)
+	}
+	if got := string(res.Replayed.Response.Body); got != "3 PUT /items/2 t2 xyz" {
+		t.Fatalf("edited replay body = %q", got)
+	}
+	if n := len(m.Capture().Entries(CaptureFilter{})); n != 3 {
+		t.Fatalf("captured entries = %d, want 3", n)
+	}
+
+	if _, err := m.Replay(context.Background(), 9999, nil); err == nil {
+		t.Fatal("expected error for unknown flow")
+	}
+}
+
+func TestReplayAppliesRules(t *testing.T) {
+	rules, _ := NewRuleEngine(RuleSet{Rules: []Rule{
+		{Match: RuleMatch{Path: "/old"}, Rewrite: &RewriteAction{Path: "/new"}, SetHeaders: map[string]string{"X-Token": "rule"}},
+	}})
+	m, _, host := newReplaySetup(t, WithRules(rules))
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/old", host), nil)
+	resp, err := m.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "1 GET /new rule " {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestReplayAppliesProfileRules(t *testing.T) {
+	m, addr, host := newReplaySetup(t)
+	doProxyRequest(t, addr, fmt.Sprintf("GET /api HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	orig := waitCaptured(t, m.Capture(), 1)[0]
+
+	// 原请求来自 127.0.0.1，其个人规则在重放时生效。
+	m.profiles.Set("127.0.0.1", RuleSet{Rules: []Rule{{Match: RuleMatch{Path: "/api"}, Block: &BlockAction{Status: 418, Body: "mine"}}}})
+	res, err := m.Replay(context.Background(), orig.FlowID, nil)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if r := res.Replayed.Response; r.StatusCode != 418 || string(r.Body) != "mine" {
+		t.Fatalf("replayed = %d %q", r.StatusCode, r.Body)
+	}
+}
+
+func TestReplayManage(t *testing.T) {
+	m, addr, host := newReplaySetup(t)
+	doProxyRequest(t, addr, fmt.Sprintf("GET /ping HTTP/1.1\r\nHost: %s\r\n\r\n", host))
+	orig := waitCaptured(t, m.Capture(), 1)[0]
+
+	cmd := fmt.Sprintf(`{"id":%d,"url":"http://%s/pong"}`, orig.FlowID, host)
+	resp, body := doProxyRequest(t, addr, fmt.Sprintf("POST %s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n\r\n%s",
+		RouteReplay, managePort(addr), len(cmd), cmd))
+	var out struct {
+		Original HAREntry `json:"original"`
+		Replayed HAREntry `json:"replayed"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("status %d, decode %v: %s", resp.StatusCode, err, body)
+	}
+	if !strings.HasSuffix(out.Original.Request.URL, "/ping") || out.Replayed.Response.Content.Text != "2 GET /pong  " {
+		t.Fatalf("original %s, replayed %+v", out.Original.Request.URL, out.Replayed.Response.Content)
+	}
+}
@@ -0,0 +1,101 @@
+package core_refactor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy 控制上游请求失败时的重试行为。
+//
+// 复用的空闲连接在未收到任何响应前失败，视为连接已被对端关闭（stale），
+// 会立即换新连接重放一次且不计入 MaxRetries；非幂等请求只有在请求尚未写出任何字节时才重放。
+// 其余失败（拨号失败、新连接上的读写错误）仅对可重放请求按退避重试。
+type RetryPolicy struct {
+	// MaxRetries 真实失败时的最大重试次数，0 表示不重试。
+	MaxRetries int
+	// Backoff 首次重试前的等待时间，之后每次翻倍。
+	Backoff time.Duration
+	// MaxBackoff 退避时间上限，0 表示不限制。
+	MaxBackoff time.Duration
+	// Retryable 可选钩子，返回 true 时即使方法非幂等也允许重放。
+	Retryable func(*http.Request) bool
+}
+
+// DefaultRetryPolicy 是未配置时使用的重试策略：幂等请求最多重试一次。
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 1,
+	Backoff:    50 * time.Millisecond,
+	MaxBackoff: time.Second,
+}
+
+// RetryAttempt 记录一次重试的原因。
+type RetryAttempt struct {
+	Attempt int           `json:"attempt"`
+	Error   string        `json:"error"`
+	Stale   bool          `json:"stale"`
+	Backoff time.Duration `json:"backoff"`
+	Time    time.Time     `json:"time"`
+}
+
+// canReplay 判断请求是否可以安全地再次发送到上游。
+func (p RetryPolicy) canReplay(req *http.Request) bool {
+	if !bodyReplayable(req) {
+		return false
+	}
+	if isIdempotent(req) {
+		return true
+	}
+	return p.Retryable != nil && p.Retryable(req)
+}
+
+// backoff 返回第 n 次（从 1 开始）重试前的等待时间。
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// isIdempotent 判断请求方法是否幂等；携带 Idempotency-Key 的请求同样视为可重放。
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+func bodyReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 || req.GetBody != nil
+}
+
+// isStaleConnErr 判断错误是否符合“复用连接已被对端关闭”的特征。
+func isStaleConnErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,169 @@
+package core_refactor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startOneShotUpstream 启动一个每条连接只处理一个请求后即关闭的上游，模拟 keep-alive 被服务端关闭。
+func startOneShotUpstream(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var count atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, req.Body)
+				if req.URL.Path == "/slow" {
+					time.Sleep(100 * time.Millisecond)
+				}
+				count.Add(1)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}(c)
+		}
+	}()
+	return ln.Addr().String(), &count
+}
+
+func sendPosts(t *testing.T, addr, upstream string, n int) []int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var codes []int
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: 4\r\n\r\ndata", upstream)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("read response %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+		// 等待上游关闭连接，确保下一次请求命中已失效的空闲连接。
+		time.Sleep(50 * time.Millisecond)
+	}
+	return codes
+}
+
+func TestRetrySkipsNonIdempotentOnStaleConn(t *testing.T) {
+	upstream, count := startOneShotUpstream(t)
+	addr := startTestMITM(t, nil)
+
+	codes := sendPosts(t, addr, upstream, 2)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusBadGateway {
+		t.Fatalf("status codes = %v, want [200 502]", codes)
+	}
+	if n := count.Load(); n != 1 {
+		t.Fatalf("upstream request count = %d, want 1", n)
+	}
+}
+
+func TestRetryHookMarksRequestSafe(t *testing.T) {
+	upstream, count := startOneShotUpstream(t)
+
+	var flows []*Flow
+	addr := startTestMITM(t, nil,
+		WithRetryPolicy(RetryPolicy{
+			Retryable: func(r *http.Request) bool { return r.Method == http.MethodPost },
+		}),
+		WithRequestHandler(func(r *http.Request) *http.Response {
+			flows = append(flows, FlowFromRequest(r))
+			return nil
+		}),
+	)
+
+	codes := sendPosts(t, addr, upstream, 2)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Fatalf("status codes = %v, want [200 200]", codes)
+	}
+	if n := count.Load(); n != 2 {
+		t.Fatalf("upstream request count = %d, want 2", n)
+	}
+	retries := flows[1].Retries()
+	if len(retries) != 1 || !retries[0].Stale {
+		t.Fatalf("retries = %+v, want one stale retry", retries)
+	}
+}
+
+func TestStaleReplayDialsFresh(t *testing.T) {
+	upstream, count := startOneShotUpstream(t)
+	var mu sync.Mutex
+	var flows []*Flow
+	addr := startTestMITM(t, nil, WithRequestHandler(func(r *http.Request) *http.Response {
+		mu.Lock()
+		flows = append(flows, FlowFromRequest(r))
+		mu.Unlock()
+		return nil
+	}))
+
+	// 并发两个慢请求，让池中留下两条随后都被上游关闭的空闲连接。
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doProxyRequest(t, addr, fmt.Sprintf("GET /slow HTTP/1.1\r\nHost: %s\r\n\r\n", upstream))
+		}()
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+
+	resp, _ := doProxyRequest(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", upstream))
+	if resp.StatusCode != http.StatusOK || count.Load() != 3 {
+		t.Fatalf("status = %d, upstream requests = %d", resp.StatusCode, count.Load())
+	}
+	mu.Lock()
+	retries := flows[len(flows)-1].Retries()
+	mu.Unlock()
+	if len(retries) != 1 || !retries[0].Stale {
+		t.Fatalf("retries = %+v, want a single stale replay on a fresh connection", retries)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 30 * time.Millisecond}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Fatalf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	if !isIdempotent(get) || isIdempotent(post) {
+		t.Fatal("unexpected idempotency classification")
+	}
+	post.Header.Set("Idempotency-Key", "abc")
+	if !isIdempotent(post) {
+		t.Fatal("request with Idempotency-Key should be replayable")
+	}
+}
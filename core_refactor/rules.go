@@ -0,0 +1,545 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 规则集的求值模式。
+const (
+	// RuleModeFirst 只执行第一条命中的规则（规则可通过 Continue 继续向下匹配）。
+	RuleModeFirst = "first"
+	// RuleModeChain 依次执行所有命中的规则，直到遇到终止动作（重定向、map local、拦截）。
+	RuleModeChain = "chain"
+)
+
+// RuleSet 是可从 JSON/YAML 加载的规则集合。
+type RuleSet struct {
+	Mode  string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule 由匹配条件与动作组成；所有非空匹配条件同时满足才算命中。
+type Rule struct {
+	Name     string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Disabled bool      `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Match    RuleMatch `json:"match" yaml:"match"`
+	// Continue 在 first 模式下命中后继续匹配后续规则。
+	Continue bool `json:"continue,omitempty" yaml:"continue,omitempty"`
+
+	Rewrite               *RewriteAction    `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Redirect              *RedirectAction   `json:"redirect,omitempty" yaml:"redirect,omitempty"`
+	MapLocal              *MapLocalRule     `json:"mapLocal,omitempty" yaml:"mapLocal,omitempty"`
+	Block                 *BlockAction      `json:"block,omitempty" yaml:"block,omitempty"`
+	SetHeaders            map[string]string `json:"setHeaders,omitempty" yaml:"setHeaders,omitempty"`
+	RemoveHeaders         []string          `json:"removeHeaders,omitempty" yaml:"removeHeaders,omitempty"`
+	SetResponseHeaders    map[string]string `json:"setResponseHeaders,omitempty" yaml:"setResponseHeaders,omitempty"`
+	RemoveResponseHeaders []string          `json:"removeResponseHeaders,omitempty" yaml:"removeResponseHeaders,omitempty"`
+	// Proxy 选择上游代理 URL；"direct" 表示强制直连。
+	Proxy string `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+}
+
+// RuleMatch 描述匹配条件。字符串模式默认为 glob（* 可跨越 /），以 "re:" 开头时为正则表达式。
+type RuleMatch struct {
+	Scheme   string            `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	Host     string            `json:"host,omitempty" yaml:"host,omitempty"`
+	Path     string            `json:"path,omitempty" yaml:"path,omitempty"`
+	Methods  []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Query    map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+	ClientIP []string          `json:"clientIP,omitempty" yaml:"clientIP,omitempty"`
+}
+
+// RewriteAction 改写请求目标；Path 在匹配条件为正则时可使用 $1 等分组引用。
+type RewriteAction struct {
+	Scheme      string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	Host        string `json:"host,omitempty" yaml:"host,omitempty"`
+	Path        string `json:"path,omitempty" yaml:"path,omitempty"`
+	StripPrefix string `json:"stripPrefix,omitempty" yaml:"stripPrefix,omitempty"`
+	AddPrefix   string `json:"addPrefix,omitempty" yaml:"addPrefix,omitempty"`
+}
+
+// RedirectAction 直接返回重定向响应。
+type RedirectAction struct {
+	Location string `json:"location" yaml:"location"`
+	Status   int    `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+// BlockAction 直接拦截请求并返回指定状态码。
+type BlockAction struct {
+	Status int    `json:"status,omitempty" yaml:"status,omitempty"`
+	Body   string `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// compiledRule 是预编译匹配模式后的规则。
+type compiledRule struct {
+	Rule
+	scheme  *regexp.Regexp
+	host    *regexp.Regexp
+	path    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	query   map[string]*regexp.Regexp
+	nets    []*net.IPNet
+	proxy   *Proxy
+}
+
+// RuleResult 是规则求值的结果。
+type RuleResult struct {
+	// Matched 命中的规则名（未命名规则以序号表示）。
+	Matched []string
+	// Response 非 nil 表示规则直接给出了响应（重定向、map local、拦截）。
+	Response *http.Response
+	// Proxy 非 nil 表示规则选择了上游代理。
+	Proxy *Proxy
+
+	setRespHeaders    map[string]string
+	removeRespHeaders []string
+}
+
+// RuleEngine 按顺序对请求求值规则集，支持从文件加载与热重载。
+type RuleEngine struct {
+	mu      sync.RWMutex
+	mode    string
+	set     RuleSet
+	rules   []compiledRule
+	path    string
+	modTime time.Time
+}
+
+// NewRuleEngine 使用给定规则集创建规则引擎。
+func NewRuleEngine(rs RuleSet) (*RuleEngine, error) {
+	e := &RuleEngine{}
+	if err := e.SetRules(rs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LoadRules 从 JSON 或 YAML（按扩展名 .yaml/.yml 判断）文件加载规则引擎。
+func LoadRules(path string) (*RuleEngine, error) {
+	e := &RuleEngine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ParseRuleSet 解析 JSON 或 YAML 格式的规则集。
+func ParseRuleSet(data []byte, isYAML bool) (RuleSet, error) {
+	var rs RuleSet
+	if isYAML {
+		// yaml.v3 把未加引号的标量（如 1、true）按原文解码到字符串字段，setHeaders: {X-Debug: 1} 可以直接书写。
+		if err := yaml.Unmarshal(data, &rs); err != nil {
+			return rs, fmt.Errorf("decode rules: %w", err)
+		}
+		return rs, nil
+	}
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return rs, fmt.Errorf("decode rules: %w", err)
+	}
+	return rs, nil
+}
+
+// Reload 重新读取关联的规则文件。
+func (e *RuleEngine) Reload() error {
+	e.mu.RLock()
+	path := e.path
+	e.mu.RUnlock()
+	if path == "" {
+		return fmt.Errorf("rule engine has no file")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat rules %q: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read rules %q: %w", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	rs, err := ParseRuleSet(data, ext == ".yaml" || ext == ".yml")
+	if err != nil {
+		return fmt.Errorf("parse rules %q: %w", path, err)
+	}
+	if err := e.SetRules(rs); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.modTime = info.ModTime()
+	e.mu.Unlock()
+	return nil
+}
+
+// Watch 以轮询方式监听规则文件变更，变更时调用 Reload；解析失败时保留旧规则。
+func (e *RuleEngine) Watch(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			e.mu.RLock()
+			path, modTime := e.path, e.modTime
+			e.mu.RUnlock()
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(modTime) {
+				continue
+			}
+			_ = e.Reload()
+		}
+	}
+}
+
+// SetRules 编译并替换全部规则。
+func (e *RuleEngine) SetRules(rs RuleSet) error {
+	switch rs.Mode {
+	case "", RuleModeFirst, RuleModeChain:
+	default:
+		return fmt.Errorf("unknown rule mode %q", rs.Mode)
+	}
+	compiled := make([]compiledRule, 0, len(rs.Rules))
+	for i, r := range rs.Rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		compiled = append(compiled, cr)
+	}
+
+	e.mu.Lock()
+	e.mode = rs.Mode
+	e.set = rs
+	e.rules = compiled
+	e.mu.Unlock()
+	return nil
+}
+
+// Rules 返回当前规则集。
+func (e *RuleEngine) Rules() RuleSet {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.set
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	cr := compiledRule{Rule: r}
+	var err error
+	if cr.scheme, err = compilePattern(r.Match.Scheme, true); err != nil {
+		return cr, err
+	}
+	if cr.host, err = compilePattern(r.Match.Host, true); err != nil {
+		return cr, err
+	}
+	if cr.path, err = compilePattern(r.Match.Path, false); err != nil {
+		return cr, err
+	}
+	if cr.headers, err = compilePatternMap(r.Match.Headers); err != nil {
+		return cr, err
+	}
+	if cr.query, err = compilePatternMap(r.Match.Query); err != nil {
+		return cr, err
+	}
+	for _, c := range r.Match.ClientIP {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			return cr, err
+		}
+		cr.nets = append(cr.nets, n)
+	}
+	if r.Proxy != "" && r.Proxy != "direct" {
+		p, err := ParseProxyURL(r.Proxy)
+		if err != nil {
+			return cr, err
+		}
+		cr.proxy = &p
+	} else if r.Proxy == "direct" {
+		cr.proxy = &Proxy{}
+	}
+	if r.Redirect != nil && r.Redirect.Location == "" {
+		return cr, fmt.Errorf("redirect without location")
+	}
+	if r.MapLocal != nil && r.MapLocal.Dir == "" {
+		return cr, fmt.Errorf("mapLocal without dir")
+	}
+	return cr, nil
+}
+
+// compilePattern 将 glob 或 "re:" 正则编译为锚定的正则表达式；空模式返回 nil。
+func compilePattern(p string, fold bool) (*regexp.Regexp, error) {
+	if p == "" {
+		return nil, nil
+	}
+	var expr string
+	if strings.HasPrefix(p, "re:") {
+		expr = p[3:]
+	} else {
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range p {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		expr = b.String()
+	}
+	if fold {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("compile pattern %q: %w", p, err)
+	}
+	return re, nil
+}
+
+func compilePatternMap(m map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]*regexp.Regexp, len(m))
+	for k, p := range m {
+		re, err := compilePattern(p, false)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = re
+	}
+	return out, nil
+}
+
+func (r *compiledRule) matches(req *http.Request, clientIP net.IP) bool {
+	if r.Disabled {
+		return false
+	}
+	if r.scheme != nil && !r.scheme.MatchString(req.URL.Scheme) {
+		return false
+	}
+	if r.host != nil {
+		host, _ := hostPort(req.Host, false)
+		if !r.host.MatchString(host) {
+			return false
+		}
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Match.Methods) > 0 {
+		ok := false
+		for _, m := range r.Match.Methods {
+			if strings.EqualFold(m, req.Method) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for k, re := range r.headers {
+		if !re.MatchString(req.Header.Get(k)) {
+			return false
+		}
+	}
+	if len(r.query) > 0 {
+		q := req.URL.Query()
+		for k, re := range r.query {
+			if !q.Has(k) || !re.MatchString(q.Get(k)) {
+				return false
+			}
+		}
+	}
+	if len(r.nets) > 0 {
+		ok := false
+		for _, n := range r.nets {
+			if clientIP != nil && n.Contains(clientIP) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply 对请求求值规则：就地修改请求（改写、请求头），并返回需要短路的响应、
+// 选定的上游代理以及待应用到响应上的修改。没有规则命中时返回 nil。
+func (e *RuleEngine) Apply(req *http.Request) *RuleResult {
+	e.mu.RLock()
+	rules, mode := e.rules, e.mode
+	e.mu.RUnlock()
+
+	clientIP := requestClientIP(req)
+	var res *RuleResult
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(req, clientIP) {
+			continue
+		}
+		if res == nil {
+			res = &RuleResult{}
+		}
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		res.Matched = append(res.Matched, name)
+
+		if r.applyTo(req, res) {
+			return res
+		}
+		if mode != RuleModeChain && !r.Continue {
+			return res
+		}
+	}
+	return res
+}
+
+// requestClientIP 返回请求关联 Flow 的客户端 IP；不经过代理管线的请求返回 nil。
+func requestClientIP(req *http.Request) net.IP {
+	f := FlowFromRequest(req)
+	if f == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(f.ClientAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// applyTo 执行规则动作；返回 true 表示产生了终止响应。
+func (r *compiledRule) applyTo(req *http.Request, res *RuleResult) bool {
+	for _, h := range r.RemoveHeaders {
+		req.Header.Del(h)
+	}
+	for k, v := range r.SetHeaders {
+		req.Header.Set(k, v)
+	}
+	if len(r.SetResponseHeaders) > 0 && res.setRespHeaders == nil {
+		res.setRespHeaders = make(map[string]string)
+	}
+	for k, v := range r.SetResponseHeaders {
+		res.setRespHeaders[k] = v
+	}
+	res.removeRespHeaders = append(res.removeRespHeaders, r.RemoveResponseHeaders...)
+	if r.proxy != nil {
+		p := *r.proxy
+		res.Proxy = &p
+	}
+
+	if rw := r.Rewrite; rw != nil {
+		if rw.Scheme != "" {
+			req.URL.Scheme = rw.Scheme
+		}
+		if rw.Host != "" {
+			req.Host = rw.Host
+			req.URL.Host = rw.Host
+		}
+		p := req.URL.Path
+		if rw.Path != "" {
+			if r.path != nil && strings.HasPrefix(r.Match.Path, "re:") {
+				p = r.path.ReplaceAllString(p, rw.Path)
+			} else {
+				p = rw.Path
+			}
+		}
+		if rw.StripPrefix != "" {
+			p = strings.TrimPrefix(p, rw.StripPrefix)
+			if !strings.HasPrefix(p, "/") {
+				p = "/" + p
+			}
+		}
+		if rw.AddPrefix != "" {
+			p = strings.TrimSuffix(rw.AddPrefix, "/") + p
+		}
+		if p != req.URL.Path {
+			req.URL.Path = p
+			req.URL.RawPath = ""
+		}
+	}
+
+	switch {
+	case r.Block != nil:
+		status := r.Block.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		body := r.Block.Body
+		if body == "" {
+			body = "blocked by rule " + r.Name
+		}
+		res.Response = textResponse(req, status, body)
+	case r.Redirect != nil:
+		status := r.Redirect.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		resp := textResponse(req, status, "")
+		resp.Header.Set("Location", r.Redirect.Location)
+		res.Response = resp
+	case r.MapLocal != nil:
+		res.Response = r.MapLocal.Serve(req)
+	default:
+		return false
+	}
+	res.applyResponse(res.Response)
+	return true
+}
+
+// applyResponse 将规则中的响应头修改应用到响应上。
+func (res *RuleResult) applyResponse(resp *http.Response) {
+	if res == nil || resp == nil {
+		return
+	}
+	for _, h := range res.removeRespHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range res.setRespHeaders {
+		resp.Header.Set(k, v)
+	}
+}
+
+// handleRules 查询（GET）或替换（PUT/POST）规则集。
+func (m *MITM) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, m.rules.Rules())
+	case http.MethodPut, http.MethodPost:
+		var rs RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			http.Error(w, "decode rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := m.rules.SetRules(rs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, m.rules.Rules())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
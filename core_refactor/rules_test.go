@@ -0,0 +1,247 @@
+package core_refactor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newRuleEngine(t *testing.T, rs RuleSet) *RuleEngine {
+	t.Helper()
+	e, err := NewRuleEngine(rs)
+	if err != nil {
+		t.Fatalf("NewRuleEngine: %v", err)
+	}
+	return e
+}
+
+func TestRuleMatchAndRewrite(t *testing.T) {
+	e := newRuleEngine(t, RuleSet{Rules: []Rule{
+		{
+			Name:    "api-v2",
+			Match:   RuleMatch{Host: "*.example.com", Path: `re:^/api/v1/(.*)$`, Methods: []string{"GET"}},
+			Rewrite: &RewriteAction{Host: "backend.test:8080", Path: "/v2/$1"},
+		},
+		{Name: "never", Match: RuleMatch{Path: "/*"}, SetHeaders: map[string]string{"X-Never": "1"}},
+	}})
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/api/v1/users?id=1", nil)
+	res := e.Apply(req)
+	if res == nil || !reflect.DeepEqual(res.Matched, []string{"api-v2"}) {
+		t.Fatalf("matched = %+v", res)
+	}
+	if req.Host != "backend.test:8080" || req.URL.Path != "/v2/users" || req.URL.RawQuery != "id=1" {
+		t.Fatalf("rewritten to %s %s", req.Host, req.URL)
+	}
+	if req.Header.Get("X-Never") != "" {
+		t.Fatal("first mode must stop after the first match")
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "http://www.example.com/api/v1/users", nil)
+	if res := e.Apply(post); res == nil || res.Matched[0] != "never" {
+		t.Fatalf("POST matched = %+v", res)
+	}
+}
+
+func TestRuleChainMode(t *testing.T) {
+	rules := []Rule{
+		{Name: "a", Match: RuleMatch{Host: "example.com"}, SetHeaders: map[string]string{"X-A": "1"}},
+		{Name: "b", Match: RuleMatch{Headers: map[string]string{"X-A": "1"}}, RemoveHeaders: []string{"Cookie"}},
+		{Name: "c", Match: RuleMatch{Query: map[string]string{"debug": "*"}}, Block: &BlockAction{Status: 451}},
+		{Name: "d", Match: RuleMatch{Path: "/*"}, SetHeaders: map[string]string{"X-D": "1"}},
+	}
+	e := newRuleEngine(t, RuleSet{Mode: RuleModeChain, Rules: rules})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/x?debug=1", nil)
+	req.Header.Set("Cookie", "s=1")
+	res := e.Apply(req)
+	if !reflect.DeepEqual(res.Matched, []string{"a", "b", "c"}) {
+		t.Fatalf("matched = %v", res.Matched)
+	}
+	if req.Header.Get("Cookie") != "" || req.Header.Get("X-D") != "" {
+		t.Fatalf("headers = %v", req.Header)
+	}
+	if res.Response == nil || res.Response.StatusCode != 451 {
+		t.Fatalf("block response = %+v", res.Response)
+	}
+
+	// first 模式下 Continue 的效果与 chain 相同。
+	rules[0].Continue = true
+	e = newRuleEngine(t, RuleSet{Rules: rules})
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/x", nil)
+	if res := e.Apply(req); !reflect.DeepEqual(res.Matched, []string{"a", "b"}) {
+		t.Fatalf("continue matched = %v", res.Matched)
+	}
+}
+
+func TestRuleRedirectAndProxy(t *testing.T) {
+	e := newRuleEngine(t, RuleSet{Rules: []Rule{
+		{Match: RuleMatch{Scheme: "http", Host: "old.test"}, Redirect: &RedirectAction{Location: "https://new.test/"}},
+		{Match: RuleMatch{Host: "corp.test", ClientIP: []string{"10.0.0.0/8"}}, Proxy: "http://user:pw@proxy.corp:3128"},
+	}})
+
+	res := e.Apply(httptest.NewRequest(http.MethodGet, "http://old.test/a", nil))
+	if res.Response == nil || res.Response.StatusCode != http.StatusFound || res.Response.Header.Get("Location") != "https://new.test/" {
+		t.Fatalf("redirect = %+v", res.Response)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://corp.test/", nil)
+	flow := newFlow("10.1.2.3:5555")
+	req = req.WithContext(contextWithFlow(req.Context(), flow))
+	res = e.Apply(req)
+	if res == nil || res.Proxy == nil || res.Proxy.Host != "proxy.corp:3128" || res.Proxy.Username != "user" {
+		t.Fatalf("proxy = %+v", res)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://corp.test/", nil)
+	req = req.WithContext(contextWithFlow(req.Context(), newFlow("192.168.0.1:5555")))
+	if res := e.Apply(req); res != nil {
+		t.Fatalf("client IP outside range matched: %v", res.Matched)
+	}
+}
+
+func TestParseRuleSetYAML(t *testing.T) {
+	data := []byte(`# 规则示例
+mode: chain
+rules:
+  - name: "static"
+    match:
+      host: cdn.test
+      methods: [GET, HEAD]
+    mapLocal:
+      dir: /srv/static
+      noCache: true
+  - name: headers
+    disabled: false
+    match: {path: "/api/*"}
+    setResponseHeaders:
+      Access-Control-Allow-Origin: '*'
+    removeHeaders:
+    - Cookie
+    - Authorization  # 去掉认证信息
+`)
+	rs, err := ParseRuleSet(data, true)
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %v", err)
+	}
+	want := RuleSet{Mode: RuleModeChain, Rules: []Rule{
+		{
+			Name:     "static",
+			Match:    RuleMatch{Host: "cdn.test", Methods: []string{"GET", "HEAD"}},
+			MapLocal: &MapLocalRule{Dir: "/srv/static", NoCache: true},
+		},
+		{
+			Name:               "headers",
+			Match:              RuleMatch{Path: "/api/*"},
+			SetResponseHeaders: map[string]string{"Access-Control-Allow-Origin": "*"},
+			RemoveHeaders:      []string{"Cookie", "Authorization"},
+		},
+	}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Fatalf("got %+v\nwant %+v", rs, want)
+	}
+
+	if _, err := ParseRuleSet([]byte("rules:\n  - name: a\n   bad: 1\n"), true); err == nil {
+		t.Fatal("expected indentation error")
+	}
+}
+
+func TestParseRuleSetYAMLScalarsAndAnchors(t *testing.T) {
+	data := []byte(`defaults: &cors
+  Access-Control-Allow-Origin: "*"
+  X-Max-Age: 600
+rules:
+  - name: debug
+    match: {path: /api, headers: {X-Flag: yes}}
+    setHeaders: {X-Debug: 1, X-Ratio: 0.5, X-On: true}
+    setResponseHeaders:
+      <<: *cors
+      X-Max-Age: 60
+    block:
+      status: 418
+      body: |
+        line one
+        line two
+`)
+	rs, err := ParseRuleSet(data, true)
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %v", err)
+	}
+	r := rs.Rules[0]
+	if want := map[string]string{"X-Debug": "1", "X-Ratio": "0.5", "X-On": "true"}; !reflect.DeepEqual(r.SetHeaders, want) {
+		t.Fatalf("setHeaders = %v", r.SetHeaders)
+	}
+	if r.Match.Headers["X-Flag"] != "yes" {
+		t.Fatalf("match headers = %v", r.Match.Headers)
+	}
+	if want := map[string]string{"Access-Control-Allow-Origin": "*", "X-Max-Age": "60"}; !reflect.DeepEqual(r.SetResponseHeaders, want) {
+		t.Fatalf("setResponseHeaders = %v", r.SetResponseHeaders)
+	}
+	if r.Block.Status != 418 || r.Block.Body != "line one\nline two\n" {
+		t.Fatalf("block = %+v", r.Block)
+	}
+
+	// 非字符串字段仍做类型校验。
+	if _, err := ParseRuleSet([]byte("rules:\n  - block: {status: abc}\n"), true); err == nil {
+		t.Fatal("expected type error for non-numeric status")
+	}
+}
+
+func TestLoadRulesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte("rules:\n  - name: one\n    match: {host: a.test}\n"), 0644)
+
+	e, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	if rs := e.Rules(); len(rs.Rules) != 1 || rs.Rules[0].Name != "one" {
+		t.Fatalf("rules = %+v", rs)
+	}
+
+	os.WriteFile(path, []byte("rules:\n  - name: bad\n    match: {path: 're:('}\n"), 0644)
+	if err := e.Reload(); err == nil {
+		t.Fatal("expected compile error")
+	}
+	if rs := e.Rules(); rs.Rules[0].Name != "one" {
+		t.Fatal("failed reload must keep previous rules")
+	}
+}
+
+func TestWithRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-Rule"))
+	}))
+	t.Cleanup(upstream.Close)
+	target := upstream.Listener.Addr().String()
+
+	e := newRuleEngine(t, RuleSet{Rules: []Rule{
+		{Name: "block", Match: RuleMatch{Host: "ads.test"}, Block: &BlockAction{}},
+		{
+			Name:                  "remap",
+			Match:                 RuleMatch{Host: "app.test", Path: "/old/*"},
+			Rewrite:               &RewriteAction{Host: target, StripPrefix: "/old", AddPrefix: "/new"},
+			SetHeaders:            map[string]string{"X-Rule": "remap"},
+			RemoveResponseHeaders: []string{"Server"},
+		},
+	}})
+	addr := startTestMITM(t, nil, WithRules(e))
+
+	resp, body := doProxyRequest(t, addr, "GET /old/page HTTP/1.1\r\nHost: app.test\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "/new/page remap" {
+		t.Fatalf("status = %d body = %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Server") != "" {
+		t.Fatal("response header not removed")
+	}
+
+	resp, _ = doProxyRequest(t, addr, "GET / HTTP/1.1\r\nHost: ads.test\r\n\r\n")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("blocked status = %d", resp.StatusCode)
+	}
+}
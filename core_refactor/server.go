@@ -2,15 +2,18 @@ package core_refactor
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"strings"
 	"time"
 )
 
+// DialFunc 是建立上游 TCP 连接的拨号函数，签名与 net.Dialer.DialContext 一致。
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // serverConn 封装与上游目标服务器之间的连接。
 type serverConn struct {
 	raw     net.Conn
@@ -18,21 +21,29 @@ type serverConn struct {
 	tlsConn *tls.Conn
 	isTLS   bool
 	host    string // 原始请求 Host（不含端口）
+
+	key       poolKey   // 所属连接池键
+	idleSince time.Time // 归还连接池的时间
+	reused    bool      // 是否取自连接池中的空闲连接
+	written   int64     // 当前请求已写出的字节数
 }
 
-// dialServer 建立到目标服务器的 TCP 连接；若指定了上游代理，则先连接到代理。
-func dialServer(target string, proxy Proxy, timeout time.Duration) (*serverConn, error) {
-	addr := target
-	if !strings.Contains(addr, ":") {
-		addr += ":80"
-	}
+// dialServer 通过 dial 建立到目标服务器的 TCP 连接；若指定了上游代理，则先连接到代理。
+// timeout 作用于整个拨号过程（包括自定义拨号器与 DNS 覆盖）。
+func dialServer(ctx context.Context, dial DialFunc, target string, proxy Proxy, timeout time.Duration) (*serverConn, error) {
+	addr := withPort(target, "80")
 
 	dialAddr := addr
 	if !proxy.IsDirect() {
 		dialAddr = proxy.Host
 	}
 
-	conn, err := net.DialTimeout("tcp", dialAddr, timeout)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := dial(ctx, "tcp", dialAddr)
 	if err != nil {
 		return nil, fmt.Errorf("dial %s: %w", dialAddr, err)
 	}
@@ -54,9 +65,7 @@ func dialServer(target string, proxy Proxy, timeout time.Duration) (*serverConn,
 }
 
 func (s *serverConn) connectViaProxy(targetAddr string, proxy Proxy) error {
-	if !strings.Contains(targetAddr, ":") {
-		targetAddr += ":443"
-	}
+	targetAddr = withPort(targetAddr, "443")
 	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", targetAddr, targetAddr)
 	if auth := proxy.BasicAuth(); auth != "" {
 		req += "Proxy-Authorization: " + auth + "\r\n"
@@ -80,13 +89,7 @@ func (s *serverConn) connectViaProxy(targetAddr string, proxy Proxy) error {
 }
 
 func (s *serverConn) upgradeTLS(targetAddr string) error {
-	if !strings.Contains(targetAddr, ":") {
-		targetAddr += ":443"
-	}
-	hostname, _, _ := net.SplitHostPort(targetAddr)
-	if hostname == "" {
-		hostname = targetAddr
-	}
+	hostname, _ := hostPort(targetAddr, true)
 
 	tlsConn := tls.Client(s.raw, &tls.Config{
 		ServerName:         hostname,
@@ -113,11 +116,14 @@ func (s *serverConn) Read(p []byte) (int, error) {
 	return s.raw.Read(p)
 }
 
-func (s *serverConn) Write(p []byte) (int, error) {
+func (s *serverConn) Write(p []byte) (n int, err error) {
 	if s.isTLS {
-		return s.tlsConn.Write(p)
+		n, err = s.tlsConn.Write(p)
+	} else {
+		n, err = s.raw.Write(p)
 	}
-	return s.raw.Write(p)
+	s.written += int64(n)
+	return n, err
 }
 
 func (s *serverConn) Close() error {
@@ -3,31 +3,40 @@ package core_refactor
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// session 对应一个客户端连接的生命周期，负责请求串行读取、响应顺序写入、
-// 上游连接复用以及 WebSocket 隧道。
+// session 对应一个客户端连接的生命周期，负责请求串行读取、响应顺序写入
+// 以及 WebSocket 隧道；上游连接由 MITM 的共享连接池统一管理。
 type session struct {
 	mitm    *MITM
 	client  *clientConn
-	servers map[string]*serverConn
 	writeCh chan func() error
-	mu      sync.Mutex
 	ctx     context.Context
 	cancel  context.CancelFunc
+	user    string // 通过代理认证的用户名
+
+	intercept bool // 是否允许对该客户端解密并执行钩子（见 ACLConfig.Intercept）
+
+	active atomic.Int32           // 已读取但响应尚未写完的请求数，为 0 时连接空闲
+	ws     atomic.Pointer[WSConn] // 当前的 WebSocket 隧道
 }
 
 func (s *session) writeLoop() {
 	for fn := range s.writeCh {
 		if err := fn(); err != nil {
-			s.mitm.logf("write to client error: %v", err)
+			s.mitm.logger.Debug("write to client failed", "client", s.client.RemoteAddr().String(), "error", err)
 			s.cancel()
+			// 关闭客户端连接以唤醒阻塞在 ReadRequest 上的读循环。
+			s.client.Close()
 			return
 		}
 	}
@@ -40,17 +49,28 @@ func (s *session) submit(fn func() error) {
 	}
 }
 
+// begin 标记开始处理一个请求。
+func (s *session) begin() {
+	s.active.Add(1)
+}
+
+// end 在该请求之前排队的写出全部完成后清除处理中标记。
+func (s *session) end() {
+	s.submit(func() error {
+		s.active.Add(-1)
+		return nil
+	})
+}
+
 func (s *session) close() {
-	s.mu.Lock()
-	for _, srv := range s.servers {
-		srv.Close()
-	}
-	s.mu.Unlock()
 	s.client.Close()
 	close(s.writeCh)
 }
 
 func (s *session) handleRequest(req *http.Request, isWS bool) {
+	flow := newFlow(s.client.RemoteAddr().String())
+	flow.User = s.user
+	req = req.WithContext(contextWithFlow(s.ctx, flow))
 	defer req.Body.Close()
 
 	// 缓存小请求体，便于上游复用连接失效时安全重试。
@@ -58,25 +78,29 @@ func (s *session) handleRequest(req *http.Request, isWS bool) {
 		if req.ContentLength > 0 {
 			body, err := io.ReadAll(req.Body)
 			if err != nil {
-				s.mitm.logf("read request body error: %v", err)
-				s.submit(func() error {
-					w := NewResponseWriter(s.client)
-					w.WriteHeader(http.StatusBadGateway)
-					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-					_, werr := w.Write([]byte(err.Error()))
-					return werr
-				})
+				s.mitm.flowLog(req).Warn("read request body failed", "error", err)
+				s.writeError(req, http.StatusBadGateway, err, nil)
 				return
 			}
 			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
 		}
 	}
 
+	s.client.setTarget(req.Host)
+
 	if s.mitm.mustManageRequest(req) {
 		s.handleManage(req)
 		return
 	}
 
+	if !s.intercept {
+		s.passthrough(req, isWS)
+		return
+	}
+
 	if s.mitm.htmlInjector != nil {
 		EnableCompressionHint(req)
 	}
@@ -89,29 +113,88 @@ func (s *session) handleRequest(req *http.Request, isWS bool) {
 		}
 	}
 
+	rule := s.mitm.applyRules(req)
+	if rule != nil {
+		flow.rule = rule
+		if rule.Response != nil {
+			s.mitm.flowLog(req).Info("rule short-circuited request", "rules", rule.Matched, "url", req.URL.String())
+			s.respond(req, rule.Response)
+			return
+		}
+	}
+
 	if s.mitm.requestHandler != nil {
 		if resp := s.mitm.requestHandler(req); resp != nil {
+			s.respond(req, resp)
+			return
+		}
+	}
+
+	for _, rule := range s.mitm.mapLocal {
+		if rule.Match(req) {
+			s.respond(req, rule.Serve(req))
+			return
+		}
+	}
+
+	if !s.pauseRequest(req) {
+		return
+	}
+
+	if resp, ok := s.mitm.recorder.playback(req); ok {
+		s.respond(req, resp)
+		return
+	}
+
+	faults := s.mitm.faults.pick(req)
+	for _, f := range faults {
+		switch f.Action {
+		case FaultStatus:
+			s.mitm.flowLog(req).Info("fault injected", "fault", f.Name, "status", f.Status, "url", req.URL.String())
+			s.respond(req, faultResponse(req, f))
+			return
+		case FaultReset:
+			s.mitm.flowLog(req).Info("fault injected", "fault", f.Name, "action", "reset", "url", req.URL.String())
 			s.submit(func() error {
-				defer resp.Body.Close()
-				return resp.Write(s.client)
+				s.client.reset()
+				return errFaultReset
 			})
 			return
 		}
 	}
 
-	resp, err := s.forward(req, isWS)
+	var (
+		capture *captureRecorder
+		grpc    *grpcCall
+	)
+	if !isWS {
+		grpc = s.mitm.startGRPC(req)
+		capture = s.mitm.startCapture(req)
+		capture.trackGRPC(grpc)
+	}
+
+	resp, srv, err := s.mitm.roundTrip(s.ctx, req)
 	if err != nil {
-		s.mitm.logf("forward request error: %v", err)
-		s.submit(func() error {
-			w := NewResponseWriter(s.client)
-			w.WriteHeader(http.StatusBadGateway)
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			_, werr := w.Write([]byte(err.Error()))
-			return werr
-		})
+		s.mitm.flowLog(req).Error("forward request failed", "url", req.URL.String(), "error", err)
+		capture.fail(err)
+		var openErr *circuitOpenError
+		if errors.As(err, &openErr) {
+			// 熔断打开时快速失败，提示客户端稍后重试。
+			s.writeError(req, http.StatusServiceUnavailable, err, http.Header{
+				"Retry-After": []string{strconv.Itoa(int(openErr.retryAfter.Seconds()) + 1)},
+			})
+			return
+		}
+		s.writeError(req, http.StatusBadGateway, err, nil)
 		return
 	}
 
+	if !isWS && s.mitm.recorder.recording() {
+		s.mitm.recorder.record(req, resp, s.mitm.flowLog(req))
+	}
+
+	rule.applyResponse(resp)
+
 	if s.mitm.responseHandler != nil {
 		if replaced := s.mitm.responseHandler(resp); replaced != nil {
 			resp.Body.Close()
@@ -121,120 +204,78 @@ func (s *session) handleRequest(req *http.Request, isWS bool) {
 
 	if s.mitm.htmlInjector != nil {
 		if err := s.mitm.htmlInjector.Inject(resp); err != nil {
-			s.mitm.logf("html inject error: %v", err)
+			s.mitm.flowLog(req).Warn("html inject failed", "error", err)
 		}
 	}
 
-	if isWS {
-		s.handleWebSocket(req, resp)
-		return
-	}
-
-	s.submit(func() error {
-		defer resp.Body.Close()
-		if err := resp.Write(s.client); err != nil {
-			return err
-		}
-		s.mitm.logln(s.client.RemoteAddr(), req.URL, resp.Status)
-		return nil
-	})
-}
-
-func (s *session) forward(req *http.Request, isWS bool) (*http.Response, error) {
-	proxy := s.mitm.proxyFunc(req)
-	srv, err := s.getServer(req, proxy)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := s.writeRequest(req, srv); err != nil {
-		s.removeServer(req.Host)
-		// 上游复用连接可能已被对端关闭，重试一次。
-		srv, err = s.getServer(req, proxy)
-		if err != nil {
-			return nil, err
-		}
-		if err := s.writeRequest(req, srv); err != nil {
-			s.removeServer(req.Host)
-			return nil, err
+	if !isWS {
+		if resp = s.pauseResponse(req, resp); resp == nil {
+			return
 		}
 	}
 
-	resp, err := srv.ReadResponse(req)
-	if err != nil {
-		s.removeServer(req.Host)
-		// 上游复用连接可能已被对端关闭，重试一次。
-		srv, err = s.getServer(req, proxy)
-		if err != nil {
-			return nil, err
-		}
-		if err := s.writeRequest(req, srv); err != nil {
-			s.removeServer(req.Host)
-			return nil, err
-		}
-		resp, err = srv.ReadResponse(req)
-		if err != nil {
-			s.removeServer(req.Host)
-			return nil, err
+	if len(faults) > 0 && !isWS {
+		if err := applyResponseFaults(req, resp, faults); err != nil {
+			resp.Body.Close()
+			return
 		}
 	}
-	return resp, nil
-}
-
-func (s *session) getServer(req *http.Request, proxy Proxy) (*serverConn, error) {
-	targetHost := req.Host
-	targetPort := targetPort(req, s.client.isTLS)
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	key := req.Host
-	srv := s.servers[key]
-	if srv != nil {
-		return srv, nil
-	}
 
-	target := targetHost
-	if _, _, err := net.SplitHostPort(targetHost); err != nil {
-		target = net.JoinHostPort(targetHost, targetPort)
+	if isWS {
+		s.handleWebSocket(req, resp, srv)
+		return
 	}
 
-	srv, err := dialServer(target, proxy, s.mitm.dialTimeout)
-	if err != nil {
-		return nil, err
+	if isEventStream(resp) {
+		s.mitm.wrapSSE(req, resp, capture)
 	}
+	grpc.response(resp)
+	capture.response(resp)
 
-	if req.URL.Scheme == "https" || (req.URL.Scheme == "" && s.client.isTLS) {
-		if err := srv.upgradeTLS(target); err != nil {
-			srv.Close()
-			return nil, err
-		}
-	}
+	s.submit(func() error { return s.writeResponse(req, resp) })
+}
 
-	s.servers[key] = srv
-	return srv, nil
+// respond 将一个短路响应按顺序写回客户端。
+func (s *session) respond(req *http.Request, resp *http.Response) {
+	s.submit(func() error { return s.writeResponse(req, resp) })
 }
 
-func (s *session) removeServer(host string) {
-	s.mu.Lock()
-	srv := s.servers[host]
-	delete(s.servers, host)
-	s.mu.Unlock()
-	if srv != nil {
-		srv.Close()
+// writeResponse 写出响应，并记录指标与访问日志。
+func (s *session) writeResponse(req *http.Request, resp *http.Response) error {
+	if s.mitm.draining.Load() && resp.StatusCode != http.StatusSwitchingProtocols {
+		// 关闭过程中通知客户端不再复用连接。
+		resp.Close = true
 	}
+	body := &countingBody{ReadCloser: resp.Body}
+	resp.Body = body
+	defer body.Close()
+	err := resp.Write(s.client)
+	s.mitm.finishRequest(req, resp.StatusCode, body.n, err)
+	return err
 }
 
-func (s *session) writeRequest(req *http.Request, srv *serverConn) error {
-	out := req.Clone(context.Background())
-	defer out.Body.Close()
-	return out.Write(srv)
+// writeError 向客户端写出一个纯文本错误响应。
+func (s *session) writeError(req *http.Request, status int, err error, header http.Header) {
+	s.submit(func() error {
+		w := NewResponseWriter(s.client)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		n, werr := w.Write([]byte(err.Error()))
+		s.mitm.finishRequest(req, status, int64(n), err)
+		return werr
+	})
 }
 
-func (s *session) handleWebSocket(req *http.Request, resp *http.Response) {
+func (s *session) handleWebSocket(req *http.Request, resp *http.Response, srv *serverConn) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// 升级后的连接不再归还连接池，隧道结束时关闭。
+		defer srv.Close()
+	}
 	err := func() error {
-		defer resp.Body.Close()
-		if err := resp.Write(s.client); err != nil {
+		if err := s.writeResponse(req, resp); err != nil {
 			return err
 		}
 		if resp.StatusCode != http.StatusSwitchingProtocols {
@@ -243,20 +284,13 @@ func (s *session) handleWebSocket(req *http.Request, resp *http.Response) {
 		return nil
 	}()
 	if err != nil {
-		s.mitm.logf("websocket handshake error: %v", err)
+		s.mitm.flowLog(req).Warn("websocket handshake failed", "error", err)
 		return
 	}
 
 	_ = s.client.SetDeadline(time.Time{})
-	srv := s.servers[req.Host]
-	if srv == nil {
-		s.mitm.logf("websocket server connection missing")
-		return
-	}
 
-	s.mitm.logf("websocket tunnel: %s", req.Host)
-	var wg sync.WaitGroup
-	wg.Add(2)
+	s.mitm.flowLog(req).Info("websocket tunnel opened")
 	var closeOnce sync.Once
 	closeBoth := func() {
 		closeOnce.Do(func() {
@@ -264,23 +298,15 @@ func (s *session) handleWebSocket(req *http.Request, resp *http.Response) {
 			srv.Close()
 		})
 	}
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(s.client, srv)
-		if err != nil {
-			s.mitm.logf("websocket copy server->client error: %v", err)
-		}
-		closeBoth()
-	}()
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(srv, s.client)
-		if err != nil {
-			s.mitm.logf("websocket copy client->server error: %v", err)
-		}
-		closeBoth()
-	}()
-	wg.Wait()
+	c := newWSConn(req, s.client, srv, closeBoth)
+	s.ws.Store(c)
+	defer s.ws.Store(nil)
+	// 从 bufio.Reader 读取：握手时可能已随 101 响应（或升级请求）缓冲了后续帧的字节。
+	if s.intercept && (s.mitm.wsHook != nil || s.mitm.wsTunnels != nil) {
+		s.mitm.proxyWebSocket(c, resp, s.client.reader, srv.reader)
+		return
+	}
+	s.mitm.relayWebSocket(c, s.client.reader, srv.reader)
 }
 
 func (s *session) handleManage(req *http.Request) {
@@ -291,8 +317,9 @@ func (s *session) handleManage(req *http.Request) {
 	w.Header().Set("Access-Control-Max-Age", "86400")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
+	// 非回环客户端只能访问 /mitm/profile：该接口按调用方身份隔离，局域网内的使用者可借此管理自己的规则。
 	remoteIP, _, _ := net.SplitHostPort(s.client.RemoteAddr().String())
-	if ip := net.ParseIP(remoteIP); ip != nil && !ip.IsLoopback() {
+	if ip := net.ParseIP(remoteIP); !s.mitm.inBandManage() || (ip != nil && !ip.IsLoopback() && req.URL.Path != RouteProfile) {
 		w.WriteHeader(http.StatusNotFound)
 		s.submit(func() error { _, err := w.Write([]byte("404 not found")); return err })
 		return
@@ -309,7 +336,15 @@ func (s *session) handleManage(req *http.Request) {
 	s.mitm.mu.Unlock()
 
 	if h != nil {
-		s.submit(func() error { h(w, req); return nil })
+		s.submit(func() error {
+			h(w, req)
+			// 与 net/http 一致：处理函数只调用了 WriteHeader（如 204）时也要写出响应头。
+			if !w.headerWritten {
+				_, err := w.Write(nil)
+				return err
+			}
+			return nil
+		})
 	} else {
 		w.WriteHeader(http.StatusNoContent)
 		s.submit(func() error { _, err := w.Write(nil); return err })
@@ -0,0 +1,98 @@
+package core_refactor
+
+import (
+	"context"
+	"time"
+)
+
+// shutdownPollInterval 是 Shutdown 检查空闲连接的间隔。
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown 优雅地关闭代理：停止接受新连接（含管理监听器），空闲的 keep-alive 连接立即关闭，
+// 进行中的请求写完响应（带 Connection: close）后关闭，WebSocket 隧道向两端发送 1001 关闭帧并
+// 等待双方断开；ctx 到期时强制关闭剩余连接并返回 ctx.Err()。
+// 盲隧道（见 ACLConfig.Intercept）无法感知应用层边界，会一直保持到双方断开或 ctx 到期。
+// 可重复调用，例如先以较长的超时调用，再以已取消的 ctx 调用以立即结束。
+func (m *MITM) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	first := !m.closed
+	m.closed = true
+	ln := m.listener
+	admin := m.adminServer
+	m.mu.Unlock()
+
+	if first {
+		m.draining.Store(true)
+		if ln != nil {
+			if err := ln.Close(); err != nil {
+				return err
+			}
+		}
+		if admin != nil {
+			go admin.Shutdown(ctx)
+		}
+	}
+
+	// closeIdleSessions 持有 clientsMu，也保证 Start 中已发生的 conns.Add 先于下面的 Wait。
+	m.closeIdleSessions()
+	done := make(chan struct{})
+	go func() {
+		m.conns.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			m.pool.closeIdle(true)
+			return nil
+		case <-ctx.Done():
+			if admin != nil {
+				admin.Close()
+			}
+			// 强制关闭所有活跃客户端连接并取消会话，避免 goroutine 在客户端或上游 I/O 上阻塞导致程序无法退出。
+			m.clientsMu.Lock()
+			for s := range m.sessions {
+				s.cancel()
+			}
+			for c := range m.clients {
+				c.Close()
+			}
+			m.clientsMu.Unlock()
+			<-done
+			m.pool.closeIdle(true)
+			return ctx.Err()
+		case <-ticker.C:
+			m.closeIdleSessions()
+		}
+	}
+}
+
+// trackSession 登记或注销一个客户端会话，供 Shutdown 判断连接是否空闲。
+func (m *MITM) trackSession(s *session, add bool) {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+	if add {
+		m.sessions[s] = struct{}{}
+	} else {
+		delete(m.sessions, s)
+	}
+}
+
+// closeIdleSessions 关闭没有进行中请求的连接，并通知 WebSocket 隧道的两端关闭。
+func (m *MITM) closeIdleSessions() {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+	for s := range m.sessions {
+		if c := s.ws.Load(); c != nil {
+			go c.goAway()
+			continue
+		}
+		if s.active.Load() == 0 {
+			s.cancel()
+			s.client.Close()
+		}
+	}
+}
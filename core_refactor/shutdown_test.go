@@ -0,0 +1,174 @@
+package core_refactor
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startShutdownMITM 启动代理并返回其地址与实例，测试自行调用 Shutdown。
+func startShutdownMITM(t *testing.T, opts ...Option) (string, *MITM) {
+	t.Helper()
+	var m *MITM
+	addr := startTestMITM(t, func(mm *MITM) { m = mm }, opts...)
+	return addr, m
+}
+
+func TestShutdownDrainsInFlight(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, "done "+r.URL.Path)
+	}))
+	t.Cleanup(upstream.Close)
+	addr, m := startShutdownMITM(t)
+	target := upstream.Listener.Addr().String()
+
+	// 一条已完成请求的 keep-alive 空闲连接。
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer idle.Close()
+	fmt.Fprintf(idle, "GET http://%s/fast HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	idleReader := bufio.NewReader(idle)
+	if resp, err := http.ReadResponse(idleReader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("fast request: %v %v", resp, err)
+	} else {
+		io.ReadAll(resp.Body)
+	}
+
+	// 一条进行中的慢请求。
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer busy.Close()
+	fmt.Fprintf(busy, "GET http://%s/slow HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- m.Shutdown(ctx)
+	}()
+
+	// 空闲连接被立即关闭，新连接不再被接受。
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idleReader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("idle connection read err = %v, want EOF", err)
+	}
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i > 50 {
+			t.Fatal("listener still accepting after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before in-flight request finished: %v", err)
+	default:
+	}
+
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(busy), nil)
+	if err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "done /slow" || !resp.Close {
+		t.Fatalf("in-flight response = %q, close=%v", body, resp.Close)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownForceClosesOnDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+	addr, m := startShutdownMITM(t)
+	target := upstream.Listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET http://%s/hang HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown err = %v, want deadline exceeded", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected connection to be force-closed")
+	}
+}
+
+func TestShutdownClosesWebSockets(t *testing.T) {
+	host := startWSEchoServer(t)
+	addr, m := startShutdownMITM(t)
+	conn, br := dialWebSocket(t, addr, host)
+
+	writeWSFrame(conn, &wsFrame{fin: true, opcode: WSText, payload: []byte("hi")}, true)
+	// 未设置钩子时帧原样转发：回显为两片压缩帧。
+	for i := 0; i < 2; i++ {
+		if _, err := readWSFrame(br, maxWSMessageSize); err != nil {
+			t.Fatalf("read echo: %v", err)
+		}
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- m.Shutdown(ctx)
+	}()
+
+	f, err := readWSFrame(br, maxWSMessageSize)
+	if err != nil {
+		t.Fatalf("read close frame: %v", err)
+	}
+	if f.opcode != WSClose || len(f.payload) < 2 || binary.BigEndian.Uint16(f.payload) != 1001 {
+		t.Fatalf("got %+v, want close 1001", f)
+	}
+	writeWSFrame(conn, &wsFrame{fin: true, opcode: WSClose, payload: f.payload[:2]}, true)
+	conn.Close()
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown did not finish after websocket closed")
+	}
+}
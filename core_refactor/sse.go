@@ -0,0 +1,191 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSEEvent 是 text/event-stream 中的一个事件；多行 data 以 "\n" 连接。
+type SSEEvent struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+	// Retry 是服务器建议的重连间隔（毫秒），0 表示未设置。
+	Retry int `json:"retry,omitempty"`
+	// Time 是代理收到该事件的时间。
+	Time time.Time `json:"time"`
+
+	// hasData、hasID 记录原始事件是否带有 data、id 字段，使显式的空值在重新编码时得以保留
+	// （空 id 会重置客户端的 Last-Event-ID）。
+	hasData, hasID bool
+}
+
+// SSEHook 在事件转发前调用，可检查或就地修改事件，返回 nil 表示丢弃该事件，
+// 也可以返回新的事件替换原事件。
+type SSEHook func(req *http.Request, ev *SSEEvent) *SSEEvent
+
+// isEventStream 判断响应是否为未压缩的 SSE 流；压缩的流无法逐事件解析，按普通响应体转发。
+func isEventStream(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mt != "text/event-stream" {
+		return false
+	}
+	ce := resp.Header.Get("Content-Encoding")
+	return ce == "" || strings.EqualFold(ce, "identity")
+}
+
+// wrapSSE 将 SSE 响应体替换为逐事件解析的读取器：每个事件解析完成后立即交给钩子，
+// 并作为一次独立的 Read 返回，使其在写回客户端时单独成块、立即刷出。
+func (m *MITM) wrapSSE(req *http.Request, resp *http.Response, capture *captureRecorder) {
+	// 事件经过改写后长度可能变化，统一以分块编码写回。
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Body = &sseBody{
+		ReadCloser: resp.Body,
+		r:          bufio.NewReader(resp.Body),
+		req:        req,
+		hook:       m.sseHook,
+		capture:    capture,
+	}
+}
+
+type sseBody struct {
+	io.ReadCloser
+	r       *bufio.Reader
+	req     *http.Request
+	hook    SSEHook
+	capture *captureRecorder
+
+	out []byte
+	err error
+
+	ev       SSEEvent
+	data     []string
+	comments []string
+	fields   bool
+}
+
+func (b *sseBody) Read(p []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.next()
+	}
+	n := copy(p, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+// next 读取一行并推进解析状态，产生的输出追加到 b.out。
+func (b *sseBody) next() {
+	line, err := b.r.ReadString('\n')
+	if line != "" {
+		b.line(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+	}
+	if err != nil {
+		// 流结束时未以空行结尾的事件照常转发，由客户端按规范决定是否丢弃。
+		b.dispatch()
+		b.err = err
+	}
+}
+
+func (b *sseBody) line(line string) {
+	switch {
+	case line == "":
+		b.dispatch()
+	case line[0] == ':':
+		if !b.fields {
+			// 事件之间的注释通常是心跳，原样立即转发。
+			b.out = append(b.out, line+"\n"...)
+		} else {
+			b.comments = append(b.comments, line)
+		}
+	default:
+		b.field(line)
+	}
+}
+
+func (b *sseBody) field(line string) {
+	name, value, _ := strings.Cut(line, ":")
+	value = strings.TrimPrefix(value, " ")
+	switch name {
+	case "data":
+		b.data = append(b.data, value)
+	case "event":
+		b.ev.Event = value
+	case "id":
+		if strings.ContainsRune(value, 0) {
+			return
+		}
+		b.ev.ID, b.ev.hasID = value, true
+	case "retry":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return
+		}
+		b.ev.Retry = n
+	default:
+		// 规范要求忽略未知字段。
+		return
+	}
+	b.fields = true
+}
+
+// dispatch 结束当前事件：交给钩子、记录到抓包并编码输出。
+func (b *sseBody) dispatch() {
+	comments := b.comments
+	if !b.fields {
+		for _, c := range comments {
+			b.out = append(b.out, c+"\n"...)
+		}
+		b.comments = nil
+		return
+	}
+	ev := b.ev
+	ev.Data, ev.hasData = strings.Join(b.data, "\n"), len(b.data) > 0
+	ev.Time = time.Now()
+	b.ev, b.data, b.comments, b.fields = SSEEvent{}, nil, nil, false
+
+	out := &ev
+	if b.hook != nil {
+		out = b.hook(b.req, out)
+	}
+	var buf bytes.Buffer
+	for _, c := range comments {
+		buf.WriteString(c + "\n")
+	}
+	if out != nil {
+		b.capture.event(*out)
+		encodeSSEEvent(&buf, out)
+	}
+	b.out = append(b.out, buf.Bytes()...)
+}
+
+// encodeSSEEvent 按 text/event-stream 格式写出事件。
+func encodeSSEEvent(buf *bytes.Buffer, ev *SSEEvent) {
+	if ev.Event != "" {
+		buf.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.ID != "" || ev.hasID {
+		buf.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Retry > 0 {
+		buf.WriteString("retry: " + strconv.Itoa(ev.Retry) + "\n")
+	}
+	if ev.Data != "" || ev.hasData || (ev.Event == "" && ev.ID == "" && !ev.hasID && ev.Retry == 0) {
+		for _, l := range strings.Split(ev.Data, "\n") {
+			buf.WriteString("data: " + l + "\n")
+		}
+	}
+	buf.WriteString("\n")
+}
@@ -0,0 +1,134 @@
+package core_refactor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEParse(t *testing.T) {
+	in := ": heartbeat\r\n\r\n" +
+		"event: update\r\nid: 1\r\ndata: line1\r\ndata: line2\r\nx-unknown: 1\r\n\r\n" +
+		"data: drop\n\n" +
+		"retry: 3000\ndata:nospace\n: inside\n\n" +
+		"data: tail"
+	var seen []SSEEvent
+	hook := func(req *http.Request, ev *SSEEvent) *SSEEvent {
+		seen = append(seen, *ev)
+		if ev.Data == "drop" {
+			return nil
+		}
+		ev.Data = strings.ToUpper(ev.Data)
+		return ev
+	}
+	b := &sseBody{ReadCloser: io.NopCloser(nil), r: bufio.NewReader(strings.NewReader(in)), hook: hook}
+	out, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := ": heartbeat\n" +
+		"event: update\nid: 1\ndata: LINE1\ndata: LINE2\n\n" +
+		": inside\nretry: 3000\ndata: NOSPACE\n\n" +
+		"data: TAIL\n\n"
+	if string(out) != want {
+		t.Fatalf("output:\n%q\nwant:\n%q", out, want)
+	}
+	if len(seen) != 4 || seen[0].Event != "update" || seen[0].ID != "1" || seen[0].Data != "line1\nline2" ||
+		seen[2].Retry != 3000 || seen[3].Data != "tail" {
+		t.Fatalf("hook saw %+v", seen)
+	}
+}
+
+func TestSSEKeepsEmptyFields(t *testing.T) {
+	in := "event: ping\ndata:\n\n" +
+		"id:\ndata: reset\n\n" +
+		"id\n\n" +
+		"event: only\n\n"
+	b := &sseBody{ReadCloser: io.NopCloser(nil), r: bufio.NewReader(strings.NewReader(in))}
+	out, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := "event: ping\ndata: \n\n" +
+		"id: \ndata: reset\n\n" +
+		"id: \n\n" +
+		"event: only\n\n"
+	if string(out) != want {
+		t.Fatalf("output:\n%q\nwant:\n%q", out, want)
+	}
+}
+
+func TestSSEStreamThroughProxy(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-next // 第二个事件要等客户端收到第一个事件后才发送
+		fmt.Fprint(w, "event: done\ndata: second\n\n")
+	}))
+	t.Cleanup(upstream.Close)
+
+	store := NewCaptureStore(CaptureConfig{})
+	hook := func(req *http.Request, ev *SSEEvent) *SSEEvent {
+		ev.Data = "[" + ev.Data + "]"
+		return ev
+	}
+	addr := startTestMITM(t, nil, WithCapture(store), WithSSEHook(hook))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: %s\r\n\r\n", upstream.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	br := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read event: %v (got %q)", err, lines)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	if ev := readEvent(); ev != "data: [first]\n" {
+		t.Fatalf("first event = %q", ev)
+	}
+	close(next)
+	if ev := readEvent(); ev != "event: done\ndata: [second]\n" {
+		t.Fatalf("second event = %q", ev)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	var entries []*CapturedExchange
+	for i := 0; i < 100 && len(entries) == 0; i++ {
+		entries = store.Entries(CaptureFilter{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("captured %d entries", len(entries))
+	}
+	evs := entries[0].Response.Events
+	if len(evs) != 2 || evs[0].Data != "[first]" || evs[1].Event != "done" || evs[1].Time.Before(evs[0].Time) {
+		t.Fatalf("captured events = %+v", evs)
+	}
+	if !strings.Contains(string(entries[0].Response.Body), "data: [second]") {
+		t.Fatalf("captured body = %q", entries[0].Response.Body)
+	}
+}
@@ -1,12 +1,17 @@
 package core_refactor
 
 import (
+	"bufio"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"io"
 	"math/big"
+	"net"
+	"net/http"
+	"testing"
 )
 
 func pemEncodeCert(der []byte) []byte {
@@ -41,3 +46,30 @@ func generateRootCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
 	}
 	return cert, priv, nil
 }
+
+// doProxyRequest 通过新建的代理连接发送原始 HTTP 请求文本并返回读取完毕的响应与响应体。
+func doProxyRequest(t *testing.T, addr, raw string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+// managePort 返回代理监听端口，用于构造管理接口请求的 Host。
+func managePort(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
@@ -0,0 +1,168 @@
+package core_refactor
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// roundTrip 通过共享连接池将请求发送到上游并读取响应头，失败时按 RetryPolicy 重试，
+// 重试记录写入请求关联的 Flow。
+// 普通响应的 Body 在读完后自动归还连接；WebSocket 升级成功时返回底层连接，
+// 由调用方接管其生命周期。
+func (m *MITM) roundTrip(ctx context.Context, req *http.Request) (*http.Response, *serverConn, error) {
+	proxy := m.proxyFunc(req)
+	if f := FlowFromRequest(req); f != nil && f.rule != nil && f.rule.Proxy != nil {
+		proxy = *f.rule.Proxy
+	}
+	key := m.upstreamKey(req, proxy)
+	dial := func() (*serverConn, error) {
+		return m.dialUpstream(ctx, key, proxy)
+	}
+
+	policy := m.retryPolicy
+	flow := FlowFromRequest(req)
+	replayable := policy.canReplay(req)
+	staleRetried, skipAllow := false, false
+	failures := 0
+
+	for attempt := 1; ; attempt++ {
+		// stale 重放沿用上一次的熔断放行，避免半开状态下重复占用探测名额。
+		if !skipAllow {
+			if err := m.health.allow(key.addr); err != nil {
+				return nil, nil, err
+			}
+		}
+		skipAllow = false
+
+		var srv *serverConn
+		var err error
+		if staleRetried {
+			srv, err = m.pool.dialNew(ctx, key, dial)
+		} else {
+			srv, err = m.pool.get(ctx, key, dial)
+		}
+		if err == nil {
+			var resp *http.Response
+			resp, err = m.exchange(req, srv)
+			if err == nil {
+				m.health.record(key.addr, nil)
+				return m.wrapResponse(req, resp, srv), srv, nil
+			}
+
+			// 复用连接被对端关闭：立即换新连接重放，不计入重试次数。
+			stale := srv.reused && isStaleConnErr(err)
+			if stale && !staleRetried && (replayable || (bodyReplayable(req) && srv.written == 0)) {
+				staleRetried = true
+				skipAllow = true
+				flow.addRetry(RetryAttempt{Attempt: attempt, Error: err.Error(), Stale: true, Time: time.Now()})
+				continue
+			}
+		}
+		if ctx.Err() == nil {
+			m.health.record(key.addr, err)
+		} else {
+			// 被取消的请求不计入健康统计，但必须归还半开探测名额，否则熔断器会一直停在探测中。
+			m.health.release(key.addr)
+		}
+
+		if !replayable || failures >= policy.MaxRetries || ctx.Err() != nil {
+			return nil, nil, err
+		}
+		failures++
+		wait := policy.backoff(failures)
+		flow.addRetry(RetryAttempt{Attempt: attempt, Error: err.Error(), Backoff: wait, Time: time.Now()})
+		m.flowLog(req).Warn("retrying upstream request", "method", req.Method, "url", req.URL.String(), "attempt", attempt, "backoff", wait, "error", err)
+		if err := sleepCtx(ctx, wait); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// exchange 在给定连接上写出请求并读取响应头；失败时丢弃该连接。
+func (m *MITM) exchange(req *http.Request, srv *serverConn) (*http.Response, error) {
+	srv.written = 0
+	start := time.Now()
+	// 请求上下文被取消（如 Shutdown 强制关闭会话）时打断阻塞在上游的读写。
+	stop := context.AfterFunc(req.Context(), func() { srv.raw.SetDeadline(time.Now()) })
+	if err := writeRequest(req, srv); err != nil {
+		stop()
+		m.pool.discard(srv)
+		return nil, err
+	}
+	resp, err := srv.ReadResponse(req)
+	if !stop() && err == nil {
+		resp.Body.Close()
+		err = req.Context().Err()
+	}
+	if err != nil {
+		m.pool.discard(srv)
+		return nil, err
+	}
+	m.metrics.observeTTFB(time.Since(start))
+	return resp, nil
+}
+
+// wrapResponse 为普通响应挂接连接归还逻辑；协议升级响应的连接交由调用方处理。
+func (m *MITM) wrapResponse(req *http.Request, resp *http.Response, srv *serverConn) *http.Response {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		m.pool.detach(srv)
+		return resp
+	}
+	resp.Body = &pooledBody{
+		body:     resp.Body,
+		pool:     m.pool,
+		srv:      srv,
+		reusable: !resp.Close && !req.Close,
+	}
+	return resp
+}
+
+// upstreamKey 计算请求对应的连接池键。
+func (m *MITM) upstreamKey(req *http.Request, proxy Proxy) poolKey {
+	isTLS := req.URL.Scheme == "https"
+	target := withPort(req.Host, targetPort(req, isTLS))
+	scheme := "http"
+	if isTLS {
+		scheme = "https"
+	}
+	return newPoolKey(scheme, target, proxy)
+}
+
+// dialUpstream 建立一条新的上游连接，并在 https 下完成 TLS 握手。
+func (m *MITM) dialUpstream(ctx context.Context, key poolKey, proxy Proxy) (*serverConn, error) {
+	start := time.Now()
+	srv, err := dialServer(ctx, m.dial, key.addr, proxy, m.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	m.metrics.observeDial(time.Since(start))
+	if key.scheme == "https" {
+		start = time.Now()
+		if err := srv.upgradeTLS(key.addr); err != nil {
+			srv.Close()
+			return nil, err
+		}
+		m.metrics.observeTLS(time.Since(start))
+	}
+	return srv, nil
+}
+
+// writeRequest 将请求写到上游连接；若请求体可重放则每次使用新的副本。
+func writeRequest(req *http.Request, srv *serverConn) error {
+	out := req.Clone(context.Background())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		out.Body = body
+	}
+	defer out.Body.Close()
+	return out.Write(srv)
+}
+
+// PoolStats 返回共享上游连接池的统计快照。
+func (m *MITM) PoolStats() PoolStats {
+	return m.pool.stats()
+}
@@ -1,22 +1,26 @@
 package core_refactor
 
 import (
-	"fmt"
 	"net"
 	"net/http"
 	"strings"
 )
 
-// localIPs 返回本机非回环 IPv4 地址集合，用于检测请求环回。
+// localIPs 返回本机地址集合（IPv4 与 IPv6，含回环地址与 localhost），用于检测发往代理自身的请求。
+// 仅有 IPv6 或仅有回环接口的主机同样可用。
 func localIPs() (map[string]struct{}, error) {
-	ips := make(map[string]struct{})
+	ips := map[string]struct{}{
+		"localhost": {},
+		"127.0.0.1": {},
+		"::1":       {},
+	}
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
 
 	for _, iface := range ifaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+		if iface.Flags&net.FlagUp == 0 {
 			continue
 		}
 		addrs, err := iface.Addrs()
@@ -24,18 +28,25 @@ func localIPs() (map[string]struct{}, error) {
 			return nil, err
 		}
 		for _, addr := range addrs {
-			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
-				ips[ipNet.IP.String()] = struct{}{}
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips[canonicalHost(ipNet.IP.String())] = struct{}{}
 			}
 		}
 	}
+	return ips, nil
+}
 
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("no valid non-loopback IPv4 address found")
+// canonicalHost 把 IP 字面量规范化（去掉方括号与 zone，IPv4 映射地址转为 IPv4），
+// 其余主机名转为小写。
+func canonicalHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host, ":") {
+		host = host[:i]
 	}
-	ips["localhost"] = struct{}{}
-	ips["127.0.0.1"] = struct{}{}
-	return ips, nil
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
 }
 
 // isWebSocketRequest 判断请求是否为 WebSocket 升级请求。
@@ -49,10 +60,11 @@ func isWebSocketRequest(r *http.Request) bool {
 }
 
 // hostPort 拆分 host 与端口；未指定端口时根据 isTLS 推断默认值。
+// 返回的 host 不含 IPv6 字面量的方括号。
 func hostPort(host string, isTLS bool) (string, string) {
 	h, p, err := net.SplitHostPort(host)
 	if err != nil {
-		h = host
+		h = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
 		if isTLS {
 			p = "443"
 		} else {
@@ -62,6 +74,22 @@ func hostPort(host string, isTLS bool) (string, string) {
 	return h, p
 }
 
+// withPort 在 addr 未带端口时补上 port，正确处理 IPv6 字面量（带或不带方括号）。
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), port)
+}
+
+// bracketHost 为 IPv6 字面量加上方括号，使其可用于 URL 或 Host 头。
+func bracketHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
 // targetPort 返回请求目标端口；优先使用 URL/Host 中的显式端口，否则按协议推断。
 func targetPort(req *http.Request, clientTLS bool) string {
 	_, port := hostPort(req.Host, clientTLS)
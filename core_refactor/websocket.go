@@ -0,0 +1,496 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxWSMessageSize 是解析模式下单条 WebSocket 消息（含分片合并与解压后）的大小上限。
+const maxWSMessageSize = 64 << 20
+
+// wsWindowSize 是 permessage-deflate 的 LZ77 滑动窗口大小。
+const wsWindowSize = 32 << 10
+
+var errWSTooLarge = errors.New("websocket message too large")
+
+// WSDirection 表示 WebSocket 消息的来源方向。
+type WSDirection string
+
+const (
+	// WSFromClient 客户端发往服务器的消息。
+	WSFromClient WSDirection = "client"
+	// WSFromServer 服务器发往客户端的消息。
+	WSFromServer WSDirection = "server"
+)
+
+// WSOpcode 是 RFC 6455 的帧操作码。
+type WSOpcode byte
+
+const (
+	WSContinuation WSOpcode = 0x0
+	WSText         WSOpcode = 0x1
+	WSBinary       WSOpcode = 0x2
+	WSClose        WSOpcode = 0x8
+	WSPing         WSOpcode = 0x9
+	WSPong         WSOpcode = 0xA
+)
+
+func (op WSOpcode) isControl() bool { return op&0x8 != 0 }
+
+func (op WSOpcode) String() string {
+	switch op {
+	case WSContinuation:
+		return "continuation"
+	case WSText:
+		return "text"
+	case WSBinary:
+		return "binary"
+	case WSClose:
+		return "close"
+	case WSPing:
+		return "ping"
+	case WSPong:
+		return "pong"
+	}
+	return fmt.Sprintf("opcode(%d)", byte(op))
+}
+
+// WSMessage 是一条完整的 WebSocket 消息：分片已合并、permessage-deflate 已解压。
+// 控制帧（close/ping/pong）同样以消息形式交给钩子。
+type WSMessage struct {
+	Direction WSDirection
+	Opcode    WSOpcode
+	Data      []byte
+}
+
+// WebSocketHook 在消息转发前调用，可检查或就地修改消息，返回 nil 表示丢弃该消息，
+// 也可以返回新的消息替换原消息；通过 WSConn 可向任一方向注入消息。
+// 两个方向的消息在各自的 goroutine 中处理，钩子需自行保证并发安全。
+type WebSocketHook func(c *WSConn, msg *WSMessage) *WSMessage
+
+// WSConn 表示一条被代理的 WebSocket 连接。
+type WSConn struct {
+	req    *http.Request
+	client *wsWriter
+	server *wsWriter
+	close  func()
+	tunnel *wsTunnel
+
+	goingAway atomic.Bool // 已向两端发送关闭帧，不再转发后续帧
+}
+
+func newWSConn(req *http.Request, client, srv io.Writer, closeBoth func()) *WSConn {
+	return &WSConn{
+		req:    req,
+		client: &wsWriter{w: client},
+		server: &wsWriter{w: srv, mask: true},
+		close:  closeBoth,
+	}
+}
+
+// Request 返回发起升级的请求，可通过 FlowFromRequest 取得对应的 Flow。
+func (c *WSConn) Request() *http.Request { return c.req }
+
+// SendToClient 向客户端注入一条消息。
+func (c *WSConn) SendToClient(op WSOpcode, data []byte) error {
+	c.tunnel.record(&WSMessage{Direction: WSFromServer, Opcode: op, Data: data}, wsInjected)
+	return c.client.writeMessage(op, data)
+}
+
+// SendToServer 向服务器注入一条消息（按协议要求自动加掩码）。
+func (c *WSConn) SendToServer(op WSOpcode, data []byte) error {
+	c.tunnel.record(&WSMessage{Direction: WSFromClient, Opcode: op, Data: data}, wsInjected)
+	return c.server.writeMessage(op, data)
+}
+
+// Close 关闭两端连接。
+func (c *WSConn) Close() { c.close() }
+
+// goAway 向两端发送 1001（Going Away）关闭帧，此后丢弃两个方向上的后续帧，
+// 等待双方按协议各自关闭连接。
+func (c *WSConn) goAway() {
+	if c.goingAway.Swap(true) {
+		return
+	}
+	payload := binary.BigEndian.AppendUint16(nil, 1001)
+	payload = append(payload, "proxy shutting down"...)
+	c.client.writeMessage(WSClose, payload)
+	c.server.writeMessage(WSClose, payload)
+}
+
+// wsWriter 串行化同一方向上的帧写入；mask 为 true 时（发往服务器）按协议加掩码。
+type wsWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	mask bool
+}
+
+func (w *wsWriter) writeMessage(op WSOpcode, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeWSFrame(w.w, &wsFrame{fin: true, opcode: op, payload: data}, w.mask)
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv     byte // RSV1-3，位于首字节的 0x70
+	opcode  WSOpcode
+	payload []byte
+}
+
+// wsHeader 是一帧的帧头。
+type wsHeader struct {
+	raw    []byte // 原始字节（含扩展长度与掩码键），用于原样转发
+	fin    bool
+	rsv    byte
+	opcode WSOpcode
+	masked bool
+	key    [4]byte
+	length uint64
+}
+
+// readWSHeader 读取并校验帧头。
+func readWSHeader(r io.Reader, limit int64) (*wsHeader, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	h := &wsHeader{
+		fin:    raw[0]&0x80 != 0,
+		rsv:    raw[0] & 0x70,
+		opcode: WSOpcode(raw[0] & 0x0f),
+		masked: raw[1]&0x80 != 0,
+		length: uint64(raw[1] & 0x7f),
+	}
+	switch h.length {
+	case 126:
+		raw = raw[:4]
+		if _, err := io.ReadFull(r, raw[2:]); err != nil {
+			return nil, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(raw[2:]))
+	case 127:
+		raw = raw[:10]
+		if _, err := io.ReadFull(r, raw[2:]); err != nil {
+			return nil, err
+		}
+		h.length = binary.BigEndian.Uint64(raw[2:])
+	}
+	if h.length > uint64(limit) {
+		return nil, errWSTooLarge
+	}
+	if h.opcode.isControl() && (h.length > 125 || !h.fin) {
+		return nil, fmt.Errorf("invalid websocket control frame")
+	}
+	if h.masked {
+		n := len(raw)
+		raw = raw[:n+4]
+		if _, err := io.ReadFull(r, raw[n:]); err != nil {
+			return nil, err
+		}
+		copy(h.key[:], raw[n:])
+	}
+	h.raw = raw
+	return h, nil
+}
+
+// readWSFrame 读取一帧并去除掩码。
+func readWSFrame(r io.Reader, limit int64) (*wsFrame, error) {
+	h, err := readWSHeader(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	f := &wsFrame{fin: h.fin, rsv: h.rsv, opcode: h.opcode, payload: make([]byte, h.length)}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if h.masked {
+		maskBytes(h.key, f.payload)
+	}
+	return f, nil
+}
+
+// writeWSFrame 以一次 Write 写出一帧；mask 为 true 时使用随机掩码。
+func writeWSFrame(w io.Writer, f *wsFrame, mask bool) error {
+	var buf bytes.Buffer
+	b0 := byte(f.opcode) | f.rsv
+	if f.fin {
+		b0 |= 0x80
+	}
+	buf.WriteByte(b0)
+
+	var b1 byte
+	if mask {
+		b1 = 0x80
+	}
+	n := len(f.payload)
+	switch {
+	case n < 126:
+		buf.WriteByte(b1 | byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(b1 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b1 | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(n))
+	}
+
+	payload := f.payload
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf.Write(key[:])
+		payload = append([]byte(nil), payload...)
+		maskBytes(key, payload)
+	}
+	buf.Write(payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func maskBytes(key [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= key[i&3]
+	}
+}
+
+// wsDeflateParams 是握手协商出的 permessage-deflate 参数。
+type wsDeflateParams struct {
+	clientNoContext bool
+	serverNoContext bool
+}
+
+// parseWSExtensions 解析 101 响应中的 Sec-WebSocket-Extensions。
+// ok 为 false 表示协商了无法解析的扩展，此时只能透传字节。
+func parseWSExtensions(h http.Header) (deflate *wsDeflateParams, ok bool) {
+	for _, line := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(line, ",") {
+			parts := strings.Split(ext, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			if !strings.EqualFold(name, "permessage-deflate") {
+				return nil, false
+			}
+			deflate = &wsDeflateParams{}
+			for _, p := range parts[1:] {
+				switch strings.ToLower(strings.TrimSpace(strings.SplitN(p, "=", 2)[0])) {
+				case "client_no_context_takeover":
+					deflate.clientNoContext = true
+				case "server_no_context_takeover":
+					deflate.serverNoContext = true
+				}
+			}
+		}
+	}
+	return deflate, true
+}
+
+// wsInflater 按方向解压 permessage-deflate 消息；启用上下文接管时保留最近 32KB 作为字典。
+type wsInflater struct {
+	noContext bool
+	dict      []byte
+}
+
+var wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+func (i *wsInflater) inflate(p []byte) ([]byte, error) {
+	fr := flate.NewReaderDict(io.MultiReader(bytes.NewReader(p), bytes.NewReader(wsDeflateTail)), i.dict)
+	defer fr.Close()
+	out, err := io.ReadAll(io.LimitReader(fr, maxWSMessageSize+1))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("inflate websocket message: %w", err)
+	}
+	if len(out) > maxWSMessageSize {
+		return nil, errWSTooLarge
+	}
+	if !i.noContext {
+		i.dict = append(i.dict, out...)
+		if len(i.dict) > wsWindowSize {
+			i.dict = append([]byte(nil), i.dict[len(i.dict)-wsWindowSize:]...)
+		}
+	}
+	return out, nil
+}
+
+// pumpWebSocket 解析一个方向上的帧流，把完整消息交给钩子后转发。
+// 压缩消息解压后以未压缩形式（RSV1=0）转发，permessage-deflate 允许逐条消息选择是否压缩，
+// 因此无需改写握手。
+func (m *MITM) pumpWebSocket(c *WSConn, dir WSDirection, src io.Reader, dst *wsWriter, inflater *wsInflater) error {
+	r := bufio.NewReader(src)
+	var (
+		msgOp      WSOpcode
+		compressed bool
+		buf        []byte
+	)
+	for {
+		f, err := readWSFrame(r, maxWSMessageSize)
+		if err != nil {
+			return err
+		}
+		if c.goingAway.Load() {
+			continue
+		}
+
+		if f.opcode.isControl() {
+			if err := m.deliverWSMessage(c, dst, &WSMessage{Direction: dir, Opcode: f.opcode, Data: f.payload}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if f.opcode != WSContinuation {
+			msgOp, compressed, buf = f.opcode, f.rsv&0x40 != 0 && inflater != nil, nil
+		}
+		if len(buf)+len(f.payload) > maxWSMessageSize {
+			return errWSTooLarge
+		}
+		buf = append(buf, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		data := buf
+		if compressed {
+			if data, err = inflater.inflate(buf); err != nil {
+				return err
+			}
+		}
+		buf = nil
+		if err := m.deliverWSMessage(c, dst, &WSMessage{Direction: dir, Opcode: msgOp, Data: data}); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *MITM) deliverWSMessage(c *WSConn, dst *wsWriter, msg *WSMessage) error {
+	if m.wsHook != nil {
+		orig := *msg
+		if msg = m.wsHook(c, msg); msg == nil {
+			c.tunnel.record(&orig, wsDropped)
+			return nil
+		}
+	}
+	c.tunnel.record(msg, wsForwarded)
+	return dst.writeMessage(msg.Opcode, msg.Data)
+}
+
+// proxyWebSocket 在两个方向上解析并转发帧，任一方向结束时关闭两端连接。
+func (m *MITM) proxyWebSocket(c *WSConn, resp *http.Response, client io.Reader, srv io.Reader) {
+	req := c.req
+	deflate, ok := parseWSExtensions(resp.Header)
+	if !ok {
+		m.flowLog(req).Warn("websocket: unsupported extensions, relaying raw frames", "extensions", resp.Header.Values("Sec-WebSocket-Extensions"))
+		m.relayWebSocket(c, client, srv)
+		return
+	}
+	if m.wsTunnels != nil {
+		c.tunnel = m.wsTunnels.add(c)
+		defer m.wsTunnels.remove(c.tunnel.id)
+	}
+	var fromClient, fromServer *wsInflater
+	if deflate != nil {
+		fromClient = &wsInflater{noContext: deflate.clientNoContext}
+		fromServer = &wsInflater{noContext: deflate.serverNoContext}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := m.pumpWebSocket(c, WSFromServer, srv, c.client, fromServer); err != nil && !errors.Is(err, io.EOF) {
+			m.flowLog(req).Debug("websocket server->client failed", "error", err)
+		}
+		c.close()
+	}()
+	go func() {
+		defer wg.Done()
+		if err := m.pumpWebSocket(c, WSFromClient, client, c.server, fromClient); err != nil && !errors.Is(err, io.EOF) {
+			m.flowLog(req).Debug("websocket client->server failed", "error", err)
+		}
+		c.close()
+	}()
+	wg.Wait()
+}
+
+// relayWebSocket 逐帧原样转发（不去掩码、不解压），帧之间可安全注入控制帧（见 WSConn.goAway）。
+func (m *MITM) relayWebSocket(c *WSConn, client io.Reader, srv io.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := relayWSFrames(c, c.client, srv); err != nil && !errors.Is(err, io.EOF) {
+			m.flowLog(c.req).Debug("websocket relay server->client failed", "error", err)
+		}
+		c.close()
+	}()
+	go func() {
+		defer wg.Done()
+		if err := relayWSFrames(c, c.server, client); err != nil && !errors.Is(err, io.EOF) {
+			m.flowLog(c.req).Debug("websocket relay client->server failed", "error", err)
+		}
+		c.close()
+	}()
+	wg.Wait()
+}
+
+// relayWSFrames 把 src 中的帧原样写到 dst，每帧在 dst 的锁内写出。
+func relayWSFrames(c *WSConn, dst *wsWriter, src io.Reader) error {
+	r := bufio.NewReader(src)
+	for {
+		h, err := readWSHeader(r, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		if c.goingAway.Load() {
+			if _, err := io.CopyN(io.Discard, r, int64(h.length)); err != nil {
+				return err
+			}
+			continue
+		}
+		dst.mu.Lock()
+		_, err = dst.w.Write(h.raw)
+		if err == nil {
+			_, err = io.CopyN(dst.w, r, int64(h.length))
+		}
+		dst.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tunnel 在两端之间原样双向复制字节，任一方向结束时关闭两端连接。
+func (m *MITM) tunnel(client io.ReadWriter, srv io.ReadWriter, closeBoth func()) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(client, srv); err != nil {
+			m.logger.Debug("tunnel copy server->client failed", "error", err)
+		}
+		closeBoth()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(srv, client); err != nil {
+			m.logger.Debug("tunnel copy client->server failed", "error", err)
+		}
+		closeBoth()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,251 @@
+package core_refactor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsCompressor 模拟启用上下文接管的 permessage-deflate 发送端。
+type wsCompressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newWSCompressor() *wsCompressor {
+	c := &wsCompressor{}
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	return c
+}
+
+func (c *wsCompressor) compress(p []byte) []byte {
+	c.buf.Reset()
+	c.w.Write(p)
+	c.w.Flush()
+	return bytes.TrimSuffix(append([]byte(nil), c.buf.Bytes()...), wsDeflateTail)
+}
+
+func TestWSFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writeWSFrame(&buf, &wsFrame{fin: false, opcode: WSText, payload: []byte("hel")}, true)
+	writeWSFrame(&buf, &wsFrame{fin: true, opcode: WSPing, payload: []byte("p")}, true)
+	writeWSFrame(&buf, &wsFrame{fin: true, opcode: WSContinuation, payload: bytes.Repeat([]byte("l"), 70000)}, false)
+
+	f, err := readWSFrame(&buf, maxWSMessageSize)
+	if err != nil || f.fin || f.opcode != WSText || string(f.payload) != "hel" {
+		t.Fatalf("first frame = %+v, %v", f, err)
+	}
+	if f, _ = readWSFrame(&buf, maxWSMessageSize); f.opcode != WSPing || string(f.payload) != "p" {
+		t.Fatalf("ping frame = %+v", f)
+	}
+	if f, _ = readWSFrame(&buf, maxWSMessageSize); !f.fin || len(f.payload) != 70000 {
+		t.Fatalf("continuation frame fin=%v len=%d", f.fin, len(f.payload))
+	}
+
+	writeWSFrame(&buf, &wsFrame{fin: true, opcode: WSBinary, payload: make([]byte, 200)}, false)
+	if _, err := readWSFrame(&buf, 100); err != errWSTooLarge {
+		t.Fatalf("oversized frame err = %v", err)
+	}
+}
+
+func TestWSInflateContextTakeover(t *testing.T) {
+	c := newWSCompressor()
+	in := &wsInflater{}
+	for i := 0; i < 3; i++ {
+		msg := []byte(strings.Repeat("hello websocket ", 10))
+		out, err := in.inflate(c.compress(msg))
+		if err != nil || !bytes.Equal(out, msg) {
+			t.Fatalf("message %d: %q, %v", i, out, err)
+		}
+	}
+
+	if d, ok := parseWSExtensions(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_no_context_takeover"}}); !ok || d == nil || !d.clientNoContext || d.serverNoContext {
+		t.Fatalf("deflate params = %+v, %v", d, ok)
+	}
+	if _, ok := parseWSExtensions(http.Header{"Sec-Websocket-Extensions": {"x-custom"}}); ok {
+		t.Fatal("unknown extension must not be parsed")
+	}
+}
+
+// startWSEchoServer 启动一个协商 permessage-deflate 的 WebSocket 服务器：
+// 收到的消息以 "echo: " 前缀压缩并分两片回发。
+func startWSEchoServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: x\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+		rw.Flush()
+
+		comp := newWSCompressor()
+		for {
+			f, err := readWSFrame(rw, maxWSMessageSize)
+			if err != nil {
+				return
+			}
+			if f.opcode == WSClose {
+				writeWSFrame(conn, &wsFrame{fin: true, opcode: WSClose}, false)
+				return
+			}
+			data := comp.compress(append([]byte("echo: "), f.payload...))
+			half := len(data) / 2
+			writeWSFrame(conn, &wsFrame{fin: false, rsv: 0x40, opcode: f.opcode, payload: data[:half]}, false)
+			writeWSFrame(conn, &wsFrame{fin: true, opcode: WSContinuation, payload: data[half:]}, false)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// dialWebSocket 通过代理完成 WebSocket 握手，返回客户端连接及其读取器。
+func dialWebSocket(t *testing.T, addr, host string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n", host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %v %v", resp, err)
+	}
+	return conn, br
+}
+
+func TestWebSocketHook(t *testing.T) {
+	host := startWSEchoServer(t)
+	seen := make(chan string, 10)
+	hook := func(c *WSConn, msg *WSMessage) *WSMessage {
+		if msg.Opcode != WSText {
+			return msg
+		}
+		seen <- string(msg.Direction) + ":" + string(msg.Data)
+		switch string(msg.Data) {
+		case "drop me":
+			return nil
+		case "inject":
+			c.SendToClient(WSText, []byte("injected"))
+		}
+		if msg.Direction == WSFromClient {
+			msg.Data = bytes.ToUpper(msg.Data)
+		}
+		return msg
+	}
+	addr := startTestMITM(t, nil, WithWebSocketHook(hook))
+	conn, br := dialWebSocket(t, addr, host)
+
+	for _, m := range []string{"drop me", "hi", "inject"} {
+		writeWSFrame(conn, &wsFrame{fin: true, opcode: WSText, payload: []byte(m)}, true)
+	}
+
+	var got []string
+	for len(got) < 3 {
+		f, err := readWSFrame(br, maxWSMessageSize)
+		if err != nil {
+			t.Fatalf("read frame: %v (got %q)", err, got)
+		}
+		if f.rsv != 0 || !f.fin {
+			t.Fatalf("forwarded frame must be a single uncompressed frame: %+v", f)
+		}
+		got = append(got, string(f.payload))
+	}
+	// 注入的消息与服务器回显在不同方向上并发，只比较内容集合。
+	sort.Strings(got)
+	want := []string{"echo: HI", "echo: INJECT", "injected"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("client received %q, want %q", got, want)
+	}
+
+	close(seen)
+	var log []string
+	for s := range seen {
+		log = append(log, s)
+	}
+	if len(log) < 5 || log[0] != "client:drop me" {
+		t.Fatalf("hook saw %q", log)
+	}
+
+	writeWSFrame(conn, &wsFrame{fin: true, opcode: WSClose}, true)
+	if f, err := readWSFrame(br, maxWSMessageSize); err != nil || f.opcode != WSClose {
+		t.Fatalf("close frame = %+v, %v", f, err)
+	}
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("connection not closed cleanly: %v", err)
+	}
+}
+
+func TestWebSocketFramesBufferedWithHandshake(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 101 响应与第一帧在同一次写入中发出。
+		var buf bytes.Buffer
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: x\r\n\r\n")
+		writeWSFrame(&buf, &wsFrame{fin: true, opcode: WSText, payload: []byte("hello")}, false)
+		conn.Write(buf.Bytes())
+		f, err := readWSFrame(rw, maxWSMessageSize)
+		if err != nil {
+			return
+		}
+		writeWSFrame(conn, &wsFrame{fin: true, opcode: WSText, payload: append([]byte("got "), f.payload...)}, false)
+	}))
+	t.Cleanup(upstream.Close)
+	host := upstream.Listener.Addr().String()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"relay", nil},
+		{"hook", []Option{WithWebSocketHook(func(c *WSConn, msg *WSMessage) *WSMessage { return msg })}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startTestMITM(t, nil, tc.opts...)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			// 升级请求与第一帧同样在一次写入中发出。
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", host)
+			writeWSFrame(&buf, &wsFrame{fin: true, opcode: WSText, payload: []byte("ping")}, true)
+			conn.Write(buf.Bytes())
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("handshake: %v %v", resp, err)
+			}
+			for _, want := range []string{"hello", "got ping"} {
+				f, err := readWSFrame(br, maxWSMessageSize)
+				if err != nil || string(f.payload) != want {
+					t.Fatalf("frame = %+v, %v, want %q", f, err, want)
+				}
+			}
+		})
+	}
+}
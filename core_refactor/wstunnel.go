@@ -0,0 +1,307 @@
+package core_refactor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultWSHistory 是每条 WebSocket 连接默认保留的消息条数。
+const defaultWSHistory = 500
+
+// ErrWebSocketNotFound 表示指定的 WebSocket 连接不存在或已关闭。
+var ErrWebSocketNotFound = errors.New("websocket tunnel not found")
+
+// WSTunnelInfo 描述一条活动的 WebSocket 连接。
+type WSTunnelInfo struct {
+	ID         uint64    `json:"id"`
+	FlowID     uint64    `json:"flowId"`
+	URL        string    `json:"url"`
+	ClientAddr string    `json:"clientAddr"`
+	StartTime  time.Time `json:"startTime"`
+	// Messages 是该连接上经过代理的消息总数（含已滚出历史的消息）。
+	Messages uint64 `json:"messages"`
+}
+
+// WSLoggedMessage 是消息历史中的一条记录；文本消息以原文保存，其余以 base64 保存。
+type WSLoggedMessage struct {
+	Seq       uint64      `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Direction WSDirection `json:"direction"`
+	Opcode    string      `json:"opcode"`
+	Size      int         `json:"size"`
+	Data      string      `json:"data"`
+	Encoding  string      `json:"encoding,omitempty"`
+	// Status 为 forwarded、dropped（被钩子丢弃）或 injected（由钩子或管理接口注入）。
+	Status string `json:"status"`
+}
+
+const (
+	wsForwarded = "forwarded"
+	wsDropped   = "dropped"
+	wsInjected  = "injected"
+)
+
+type wsTunnel struct {
+	id   uint64
+	conn *WSConn
+
+	mu      sync.Mutex
+	info    WSTunnelInfo
+	limit   int
+	history []WSLoggedMessage
+}
+
+// record 将消息追加到有界历史中；tunnel 为 nil（未启用记录）时忽略。
+func (t *wsTunnel) record(msg *WSMessage, status string) {
+	if t == nil {
+		return
+	}
+	lm := WSLoggedMessage{
+		Time:      time.Now(),
+		Direction: msg.Direction,
+		Opcode:    msg.Opcode.String(),
+		Size:      len(msg.Data),
+		Status:    status,
+	}
+	if msg.Opcode == WSText || (msg.Opcode.isControl() && utf8.Valid(msg.Data)) {
+		lm.Data = string(msg.Data)
+	} else {
+		lm.Data, lm.Encoding = base64.StdEncoding.EncodeToString(msg.Data), "base64"
+	}
+
+	t.mu.Lock()
+	t.info.Messages++
+	lm.Seq = t.info.Messages
+	t.history = append(t.history, lm)
+	if len(t.history) > t.limit {
+		t.history = append(t.history[:0:0], t.history[len(t.history)-t.limit:]...)
+	}
+	t.mu.Unlock()
+}
+
+// wsRegistry 跟踪活动的 WebSocket 连接及其消息历史。
+type wsRegistry struct {
+	mu      sync.Mutex
+	seq     uint64
+	limit   int
+	tunnels map[uint64]*wsTunnel
+}
+
+func newWSRegistry(limit int) *wsRegistry {
+	if limit <= 0 {
+		limit = defaultWSHistory
+	}
+	return &wsRegistry{limit: limit, tunnels: make(map[uint64]*wsTunnel)}
+}
+
+func (r *wsRegistry) add(c *WSConn) *wsTunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	t := &wsTunnel{
+		id:    r.seq,
+		conn:  c,
+		limit: r.limit,
+		info: WSTunnelInfo{
+			ID:        r.seq,
+			URL:       c.req.URL.String(),
+			StartTime: time.Now(),
+		},
+	}
+	if f := FlowFromRequest(c.req); f != nil {
+		t.info.FlowID, t.info.ClientAddr = f.ID, f.ClientAddr
+	}
+	r.tunnels[t.id] = t
+	return t
+}
+
+func (r *wsRegistry) remove(id uint64) {
+	r.mu.Lock()
+	delete(r.tunnels, id)
+	r.mu.Unlock()
+}
+
+func (r *wsRegistry) get(id uint64) (*wsTunnel, error) {
+	if r == nil {
+		return nil, ErrWebSocketNotFound
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tunnels[id]
+	if !ok {
+		return nil, ErrWebSocketNotFound
+	}
+	return t, nil
+}
+
+// WebSocketTunnels 返回当前活动的 WebSocket 连接；需要通过 WithWebSocketLog 启用。
+func (m *MITM) WebSocketTunnels() []WSTunnelInfo {
+	if m.wsTunnels == nil {
+		return nil
+	}
+	m.wsTunnels.mu.Lock()
+	out := make([]WSTunnelInfo, 0, len(m.wsTunnels.tunnels))
+	for _, t := range m.wsTunnels.tunnels {
+		t.mu.Lock()
+		out = append(out, t.info)
+		t.mu.Unlock()
+	}
+	m.wsTunnels.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// WebSocketMessages 返回指定连接中序号大于 since 的历史消息。
+func (m *MITM) WebSocketMessages(id, since uint64) ([]WSLoggedMessage, error) {
+	t, err := m.wsTunnels.get(id)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []WSLoggedMessage{}
+	for _, lm := range t.history {
+		if lm.Seq > since {
+			out = append(out, lm)
+		}
+	}
+	return out, nil
+}
+
+// SendWebSocket 向指定连接的一端注入消息；to 为 WSFromServer 时发往客户端（即伪装成服务器消息），
+// 为 WSFromClient 时发往服务器。
+func (m *MITM) SendWebSocket(id uint64, to WSDirection, op WSOpcode, data []byte) error {
+	t, err := m.wsTunnels.get(id)
+	if err != nil {
+		return err
+	}
+	switch to {
+	case WSFromServer:
+		return t.conn.SendToClient(op, data)
+	case WSFromClient:
+		return t.conn.SendToServer(op, data)
+	}
+	return fmt.Errorf("unknown websocket direction %q", to)
+}
+
+// CloseWebSocket 关闭指定连接的两端。
+func (m *MITM) CloseWebSocket(id uint64) error {
+	t, err := m.wsTunnels.get(id)
+	if err != nil {
+		return err
+	}
+	t.conn.Close()
+	return nil
+}
+
+// wsSendCommand 是管理接口注入消息的请求体。
+type wsSendCommand struct {
+	ID uint64 `json:"id"`
+	// To 为 client（发往客户端）或 server（发往服务器）。
+	To     string `json:"to"`
+	Opcode string `json:"opcode,omitempty"`
+	Data   string `json:"data"`
+	// Encoding 为 base64 时 Data 按 base64 解码。
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func parseWSOpcode(s string) (WSOpcode, error) {
+	switch s {
+	case "", "text":
+		return WSText, nil
+	case "binary":
+		return WSBinary, nil
+	case "ping":
+		return WSPing, nil
+	case "pong":
+		return WSPong, nil
+	case "close":
+		return WSClose, nil
+	}
+	return 0, fmt.Errorf("unknown websocket opcode %q", s)
+}
+
+// handleWebSockets 管理 WebSocket 连接：GET 列出连接（带 id 时返回该连接 since 之后的消息），
+// POST 注入消息，DELETE ?id= 关闭连接。
+func (m *MITM) handleWebSockets(w http.ResponseWriter, r *http.Request) {
+	if m.wsTunnels == nil {
+		http.Error(w, "websocket log is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	var id uint64
+	if v := q.Get("id"); v != "" {
+		var err error
+		if id, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if id == 0 {
+			writeJSON(w, http.StatusOK, m.WebSocketTunnels())
+			return
+		}
+		since, _ := strconv.ParseUint(q.Get("since"), 10, 64)
+		var msgs []WSLoggedMessage
+		if msgs, err = m.WebSocketMessages(id, since); err == nil {
+			writeJSON(w, http.StatusOK, msgs)
+			return
+		}
+	case http.MethodPost:
+		var cmd wsSendCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, "decode websocket command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = m.sendWSCommand(cmd); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case http.MethodDelete:
+		if err = m.CloseWebSocket(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrWebSocketNotFound) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (m *MITM) sendWSCommand(cmd wsSendCommand) error {
+	op, err := parseWSOpcode(cmd.Opcode)
+	if err != nil {
+		return err
+	}
+	data := []byte(cmd.Data)
+	if cmd.Encoding == "base64" {
+		if data, err = base64.StdEncoding.DecodeString(cmd.Data); err != nil {
+			return fmt.Errorf("decode data: %w", err)
+		}
+	}
+	switch cmd.To {
+	case "client":
+		return m.SendWebSocket(cmd.ID, WSFromServer, op, data)
+	case "server":
+		return m.SendWebSocket(cmd.ID, WSFromClient, op, data)
+	}
+	return fmt.Errorf("unknown target %q, want client or server", cmd.To)
+}
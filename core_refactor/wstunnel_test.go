@@ -0,0 +1,71 @@
+package core_refactor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebSocketLogAndInject(t *testing.T) {
+	host := startWSEchoServer(t)
+	var m *MITM
+	addr := startTestMITM(t, func(mm *MITM) { m = mm }, WithWebSocketLog(2))
+	conn, br := dialWebSocket(t, addr, host)
+
+	writeWSFrame(conn, &wsFrame{fin: true, opcode: WSText, payload: []byte("hi")}, true)
+	if f, err := readWSFrame(br, maxWSMessageSize); err != nil || string(f.payload) != "echo: hi" {
+		t.Fatalf("echo = %+v, %v", f, err)
+	}
+
+	manage := func(method, query, body string) (*http.Response, string) {
+		return doProxyRequest(t, addr, fmt.Sprintf("%s %s%s HTTP/1.1\r\nHost: 127.0.0.1:%s\r\nContent-Length: %d\r\n\r\n%s",
+			method, RouteWebSockets, query, managePort(addr), len(body), body))
+	}
+
+	_, body := manage("GET", "", "")
+	var tunnels []WSTunnelInfo
+	if err := json.Unmarshal([]byte(body), &tunnels); err != nil || len(tunnels) != 1 || tunnels[0].Messages != 2 {
+		t.Fatalf("tunnels = %s, %v", body, err)
+	}
+	id := tunnels[0].ID
+
+	cmd := fmt.Sprintf(`{"id":%d,"to":"client","opcode":"binary","data":"AAEC","encoding":"base64"}`, id)
+	if resp, body := manage("POST", "", cmd); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("inject: %d %s", resp.StatusCode, body)
+	}
+	if f, err := readWSFrame(br, maxWSMessageSize); err != nil || f.opcode != WSBinary || string(f.payload) != "\x00\x01\x02" {
+		t.Fatalf("injected frame = %+v, %v", f, err)
+	}
+
+	// 历史上限为 2：最早的客户端消息已滚出，序号仍连续。
+	msgs, err := m.WebSocketMessages(id, 0)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("messages = %+v, %v", msgs, err)
+	}
+	if msgs[0].Seq != 2 || msgs[0].Data != "echo: hi" || msgs[0].Status != wsForwarded ||
+		msgs[1].Direction != WSFromServer || msgs[1].Encoding != "base64" || msgs[1].Status != wsInjected {
+		t.Fatalf("messages = %+v", msgs)
+	}
+	if _, body := manage("GET", fmt.Sprintf("?id=%d&since=2", id), ""); !json.Valid([]byte(body)) || len(body) < 10 {
+		t.Fatalf("messages since 2 = %s", body)
+	}
+
+	if resp, _ := manage("POST", "", `{"id":999,"to":"client","data":"x"}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown tunnel status = %d", resp.StatusCode)
+	}
+	if resp, _ := manage("DELETE", fmt.Sprintf("?id=%d", id), ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("close status = %d", resp.StatusCode)
+	}
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	for i := 0; i < 100 && len(m.WebSocketTunnels()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(m.WebSocketTunnels()); n != 0 {
+		t.Fatalf("closed tunnel still listed: %d", n)
+	}
+}
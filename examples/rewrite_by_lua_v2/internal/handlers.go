@@ -15,6 +15,7 @@ import (
 
 // NewRequestHandler 创建基于 Lua 的请求重写处理器。
 // Lua 返回 bodyFilePath 时直接短路响应；否则修改 req 的协议、Host、Path 和 Header。
+// 第五个参数为请求方身份（代理认证用户名或客户端 IP），便于脚本按使用者区分行为。
 func NewRequestHandler(pool *Pool, logger *log.Logger) func(*http.Request) *http.Response {
 	return func(req *http.Request) *http.Response {
 		L, err := pool.Get()
@@ -24,18 +25,17 @@ func NewRequestHandler(pool *Pool, logger *log.Logger) func(*http.Request) *http
 		}
 		defer SafePut(pool, L, logger)
 
-		headersTbl := GoHeadersToLua(L, req.Header)
-		fn := L.GetGlobal("GoRequest")
-		if fn == lua.LNil {
-			logger.Println("lua function GoRequest not found")
-			return nil
+		identity := ""
+		if f := core_refactor.FlowFromRequest(req); f != nil {
+			identity = f.Identity()
 		}
-
-		err = L.CallByParam(lua.P{Fn: fn, NRet: 5, Protect: true},
+		headersTbl := GoHeadersToLua(L, req.Header)
+		err = pool.Call(L, "GoRequest", 5,
 			lua.LString(req.URL.Scheme),
 			lua.LString(req.Host),
 			lua.LString(req.URL.Path),
 			headersTbl,
+			lua.LString(identity),
 		)
 		if err != nil {
 			logger.Printf("GoRequest error: %v", err)
@@ -54,7 +54,7 @@ func NewRequestHandler(pool *Pool, logger *log.Logger) func(*http.Request) *http
 		}
 		L.Pop(5)
 
-		// 直接返回本地文件作为响应；此时 headers 作为响应头写入。
+		// 直接返回本地文件（或目录映射）作为响应；此时 headers 作为响应头写入。
 		if bodyFilePath != "" {
 			return buildFileResponse(req, bodyFilePath, newHeaders, logger)
 		}
@@ -79,30 +79,19 @@ func NewRequestHandler(pool *Pool, logger *log.Logger) func(*http.Request) *http
 	}
 }
 
-// buildFileResponse 将本地文件构造为 HTTP 响应。
+// buildFileResponse 将本地文件或目录构造为 HTTP 响应（map local）。
+// path 为目录时按请求路径映射到该目录下的文件，并支持索引文件；
+// MIME 类型按扩展名推断，Range / If-None-Match / If-Modified-Since 由核心处理。
 func buildFileResponse(req *http.Request, path string, respHeaders http.Header, logger *log.Logger) *http.Response {
-	data, err := os.ReadFile(path)
+	info, err := os.Stat(path)
 	if err != nil {
 		logger.Printf("read mock file %q error: %v", path, err)
 		return errorResponse(req, http.StatusNotFound, fmt.Sprintf("mock file not found: %s", path))
 	}
-
-	if respHeaders == nil {
-		respHeaders = http.Header{}
-	}
-	if respHeaders.Get("Content-Type") == "" {
-		respHeaders.Set("Content-Type", "application/json; charset=utf-8")
-	}
-
-	return &http.Response{
-		StatusCode:    http.StatusOK,
-		ProtoMajor:    1,
-		ProtoMinor:    1,
-		Request:       req,
-		Header:        respHeaders,
-		Body:          io.NopCloser(bytes.NewReader(data)),
-		ContentLength: int64(len(data)),
+	if info.IsDir() {
+		return core_refactor.ServeLocalDir(req, path, respHeaders)
 	}
+	return core_refactor.ServeLocalFile(req, path, respHeaders)
 }
 
 // errorResponse 构造一个短路的错误响应。
@@ -130,7 +119,7 @@ func NewProxySelector(pool *Pool, logger *log.Logger) core_refactor.ProxyFunc {
 		}
 		defer SafePut(pool, L, logger)
 
-		s, err := CallLuaString(L, "GoProxy", lua.LString(host))
+		s, err := pool.CallString(L, "GoProxy", lua.LString(host))
 		if err != nil {
 			logger.Printf("GoProxy error: %v", err)
 			return core_refactor.Proxy{}
@@ -160,7 +149,7 @@ func NewHTMLInjector(pool *Pool, logger *log.Logger) func(*http.Response) string
 		}
 		defer SafePut(pool, L, logger)
 
-		path, err := CallLuaString(L, "GoInject", lua.LString(host))
+		path, err := pool.CallString(L, "GoInject", lua.LString(host))
 		if err != nil {
 			logger.Printf("GoInject error: %v", err)
 			return ""
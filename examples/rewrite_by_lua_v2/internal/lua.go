@@ -5,7 +5,9 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/WaterGod1723/mitm-proxy/core_refactor"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -15,6 +17,7 @@ type Pool struct {
 	maxSize int
 	mu      sync.Mutex
 	states  []*lua.LState
+	metrics *core_refactor.Metrics
 }
 
 // NewPool 创建 Lua 状态池，maxSize 控制池中最大缓存数量。
@@ -124,13 +127,28 @@ func LuaTableToGoHeaders(tbl *lua.LTable) http.Header {
 	return h
 }
 
-// CallLuaString 调用返回 string 的 Lua 全局函数。
-func CallLuaString(L *lua.LState, name string, args ...lua.LValue) (string, error) {
+// SetMetrics 设置指标集，通过 Call 执行的 Lua 回调会上报耗时与错误。
+func (p *Pool) SetMetrics(m *core_refactor.Metrics) {
+	p.metrics = m
+}
+
+// Call 调用 Lua 全局函数 name，返回值保留在栈上（nret 个）。
+func (p *Pool) Call(L *lua.LState, name string, nret int, args ...lua.LValue) error {
 	fn := L.GetGlobal(name)
 	if fn == lua.LNil {
-		return "", fmt.Errorf("lua function %q not found", name)
+		err := fmt.Errorf("lua function %q not found", name)
+		p.metrics.ObserveLua(name, 0, err)
+		return err
 	}
-	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+	start := time.Now()
+	err := L.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, args...)
+	p.metrics.ObserveLua(name, time.Since(start), err)
+	return err
+}
+
+// CallString 调用返回 string 的 Lua 全局函数。
+func (p *Pool) CallString(L *lua.LState, name string, args ...lua.LValue) (string, error) {
+	if err := p.Call(L, name, 1, args...); err != nil {
 		return "", err
 	}
 	result := L.Get(-1)
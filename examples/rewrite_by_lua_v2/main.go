@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +22,12 @@ func main() {
 	certPath := flag.String("cert", "./cert/cert.pem", "根证书路径")
 	keyPath := flag.String("key", "./cert/key.pem", "根证书私钥路径")
 	verbose := flag.Bool("v", false, "启用详细日志")
+	accessLogPath := flag.String("access-log", "", "访问日志文件路径（按 100MB 滚动），为空时不记录")
+	htpasswd := flag.String("htpasswd", "", "htpasswd 文件路径，设置后代理客户端需通过 Basic 认证")
+	accessLogFormat := flag.String("access-log-format", "combined", "访问日志格式：common、combined 或 json")
+	adminAddr := flag.String("admin", "", "独立管理接口地址（host:port 或 unix:/path/to.sock），为空时仅提供带内管理接口")
+	adminToken := flag.String("admin-token", "", "独立管理接口的 Bearer token")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "收到退出信号后等待进行中请求完成的最长时间，再次收到信号时立即退出")
 	flag.Parse()
 
 	logger := newLogger(*verbose)
@@ -34,6 +42,8 @@ func main() {
 
 	// Lua 状态池。
 	pool := internal.NewPool(cfg, 8)
+	metrics := core_refactor.NewMetrics()
+	pool.SetMetrics(metrics)
 
 	// 配置热重载：配置变更时清空状态池，后续请求使用新脚本。
 	cfg.SetOnChange(func(script string) {
@@ -45,14 +55,42 @@ func main() {
 	go cfg.Watch(2*time.Second, stopWatch)
 
 	// 构造 MITM 代理。
-	m, err := core_refactor.New(
+	opts := []core_refactor.Option{
 		core_refactor.WithCAPath(*certPath, *keyPath),
 		core_refactor.WithLogger(logger),
+		core_refactor.WithMetrics(metrics),
 		core_refactor.WithRequestHandler(internal.NewRequestHandler(pool, logger)),
 		core_refactor.WithResponseHandler(internal.NewResponseHandler(pool, logger)),
 		core_refactor.WithProxy(internal.NewProxySelector(pool, logger)),
 		core_refactor.WithHTMLInjector(internal.NewHTMLInjector(pool, logger)),
-	)
+	}
+	if *htpasswd != "" {
+		store, err := core_refactor.LoadHtpasswd(*htpasswd)
+		if err != nil {
+			logger.Fatalf("load htpasswd error: %v", err)
+		}
+		opts = append(opts, core_refactor.WithProxyAuth(core_refactor.ProxyAuth{Store: store}))
+	}
+	if *accessLogPath != "" {
+		format, err := core_refactor.ParseAccessLogFormat(*accessLogFormat)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		accessLog, err := core_refactor.OpenRotatingFile(*accessLogPath, 100<<20, 5)
+		if err != nil {
+			logger.Fatalf("open access log error: %v", err)
+		}
+		defer accessLog.Close()
+		opts = append(opts, core_refactor.WithAccessLog(accessLog, format))
+	}
+	if *adminAddr != "" {
+		admin := core_refactor.AdminConfig{Addr: *adminAddr, Token: *adminToken, InBand: true}
+		if path, ok := strings.CutPrefix(*adminAddr, "unix:"); ok {
+			admin.Network, admin.Addr = "unix", path
+		}
+		opts = append(opts, core_refactor.WithAdmin(admin))
+	}
+	m, err := core_refactor.New(opts...)
 	if err != nil {
 		logger.Fatalf("create mitm proxy error: %v", err)
 	}
@@ -99,8 +137,14 @@ func main() {
 		}
 	case sig := <-sigCh:
 		logger.Printf("received signal %v, shutting down...", sig)
-		if err := m.Stop(); err != nil {
-			logger.Printf("stop mitm proxy error: %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		go func() {
+			<-sigCh
+			cancel()
+		}()
+		if err := m.Shutdown(ctx); err != nil {
+			logger.Printf("shutdown mitm proxy error: %v", err)
 		}
 	}
 }
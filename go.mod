@@ -2,4 +2,7 @@ module github.com/WaterGod1723/mitm-proxy
 
 go 1.22.1
 
-require github.com/yuin/gopher-lua v1.1.1
+require (
+	github.com/yuin/gopher-lua v1.1.1
+	gopkg.in/yaml.v3 v3.0.1
+)